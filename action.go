@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/isucon/isucandar/agent"
 )
@@ -23,7 +25,7 @@ func GetInitializeAction(ctx context.Context, ag *agent.Agent) (*http.Response,
 	}
 
 	// リクエストを実行
-	return ag.Do(ctx, req)
+	return doAction(ctx, ag, req)
 }
 
 // GET /login を送信
@@ -35,7 +37,7 @@ func GetLoginAction(ctx context.Context, ag *agent.Agent) (*http.Response, error
 	}
 
 	// リクエストを実行
-	return ag.Do(ctx, req)
+	return doAction(ctx, ag, req)
 }
 
 // POST /login を送信
@@ -53,7 +55,7 @@ func PostLoginAction(ctx context.Context, ag *agent.Agent, accountName, password
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	// リクエストを実行
-	return ag.Do(ctx, req)
+	return doAction(ctx, ag, req)
 }
 
 // GET / を送信
@@ -65,16 +67,23 @@ func GetRootAction(ctx context.Context, ag *agent.Agent) (*http.Response, error)
 	}
 
 	// リクエストを実行
-	return ag.Do(ctx, req)
+	return doAction(ctx, ag, req)
 }
 
-// POST / を送信
-func PostRootAction(ctx context.Context, ag *agent.Agent, post *Post, csrfToken string) (*http.Response, error) {
-	img, err := randomImage()
+// GET /logout を送信
+func GetLogoutAction(ctx context.Context, ag *agent.Agent) (*http.Response, error) {
+	// リクエストを生成
+	req, err := ag.GET("/logout")
 	if err != nil {
 		return nil, err
 	}
 
+	// リクエストを実行
+	return doAction(ctx, ag, req)
+}
+
+// POST / を送信
+func PostRootAction(ctx context.Context, ag *agent.Agent, post *Post, img []byte, csrfToken string) (*http.Response, error) {
 	body := bytes.NewBuffer([]byte{})
 	form := multipart.NewWriter(body)
 
@@ -108,5 +117,69 @@ func PostRootAction(ctx context.Context, ag *agent.Agent, post *Post, csrfToken
 	req.Header.Add("Content-Type", form.FormDataContentType())
 
 	// リクエストを実行
-	return ag.Do(ctx, req)
+	return doAction(ctx, ag, req)
+}
+
+// GET /posts/:id を送信
+func GetPostAction(ctx context.Context, ag *agent.Agent, postID int) (*http.Response, error) {
+	// リクエストを生成
+	req, err := ag.GET(fmt.Sprintf("/posts/%d", postID))
+	if err != nil {
+		return nil, err
+	}
+
+	// リクエストを実行
+	return doAction(ctx, ag, req)
+}
+
+// POST /comment を送信
+func PostCommentAction(ctx context.Context, ag *agent.Agent, comment *Comment, csrfToken string) (*http.Response, error) {
+	values := url.Values{}
+	values.Add("post_id", strconv.Itoa(comment.PostID))
+	values.Add("comment", comment.Comment)
+	values.Add("csrf_token", csrfToken)
+
+	// リクエストを生成
+	req, err := ag.POST("/comment", strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// リクエストを実行
+	return doAction(ctx, ag, req)
+}
+
+// リクエストのログに出すユーザー名を context に入れるキー
+type accountNameKey struct{}
+
+// リクエストのログに出すユーザー名を ctx に設定
+// User-Agent ヘッダーは変えたくないので agent.Agent.Name は使わない
+func withAccountName(ctx context.Context, accountName string) context.Context {
+	return context.WithValue(ctx, accountNameKey{}, accountName)
+}
+
+// リクエストを実行し、ユーザー、エンドポイント、ステータス、所要時間をデバッグログに出力
+func doAction(ctx context.Context, ag *agent.Agent, req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	res, err := ag.Do(ctx, req)
+	if !AdminLogger.Enabled(LogLevelDebug) {
+		return res, err
+	}
+
+	accountName, _ := ctx.Value(accountNameKey{}).(string)
+	fields := []interface{}{
+		"user", accountName,
+		"endpoint", req.Method + " " + req.URL.Path,
+		"duration", time.Since(startedAt),
+	}
+	if err != nil {
+		fields = append(fields, "error", err)
+	} else {
+		fields = append(fields, "status", res.StatusCode)
+	}
+	AdminLogger.Debug("request", fields...)
+
+	return res, err
 }
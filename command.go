@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/score"
+)
+
+// サブコマンドの終了コード
+const (
+	// 正常終了
+	ExitCodeOK = 0
+	// ベンチマークや検証が失敗した
+	ExitCodeFail = 1
+	// 引数が不正
+	ExitCodeUsage = 2
+	// ベンチマーカー自体の準備に失敗した
+	ExitCodeError = 3
+)
+
+// サブコマンドを省略した場合に実行するコマンド
+const DefaultCommand = "run"
+
+// サブコマンドの定義
+type Command struct {
+	Name    string
+	Summary string
+	// 引数を受け取り、終了コードを返す
+	Run func(args []string) int
+}
+
+// 利用できるサブコマンドの一覧
+var Commands = []*Command{
+	{Name: "run", Summary: "Run the full benchmark", Run: RunCommand},
+	{Name: "smoke", Summary: "Prepare the target and run every scenario once", Run: SmokeCommand},
+	{Name: "validate", Summary: "Run only the consistency checks without initializing the target", Run: ValidateCommand},
+	{Name: "check-data", Summary: "Check the dump files for referential integrity", Run: CheckDataCommand},
+	{Name: "agent", Summary: "Wait for jobs from a coordinator and run the load", Run: AgentCommand},
+	{Name: "coordinate", Summary: "Run the benchmark on several agents and merge the results", Run: CoordinateCommand},
+	{Name: "serve", Summary: "Serve an HTTP API to queue, watch and cancel benchmark jobs", Run: ServeCommand},
+	{Name: "history", Summary: "List saved results per team and target and compare their scores", Run: HistoryCommand},
+	{Name: "compare", Summary: "Compare two results and exit with an error on regressions", Run: CompareCommand},
+}
+
+// 引数の先頭をサブコマンド名として実行し、終了コードを返す
+// 先頭がフラグならサブコマンドを省略したものとして run を実行する
+func RunCommandLine(args []string) int {
+	name := DefaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	switch name {
+	case "help":
+		printCommands(os.Stdout)
+		return ExitCodeOK
+	}
+
+	for _, command := range Commands {
+		if command.Name == name {
+			return command.Run(args)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+	printCommands(os.Stderr)
+	return ExitCodeUsage
+}
+
+// サブコマンドの一覧を出力
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: benchmarker <command> [options]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	for _, command := range Commands {
+		fmt.Fprintf(w, "  %-12s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintf(w, "Run 'benchmarker <command> -h' for the options of each command. Without a command, %s is used.\n", DefaultCommand)
+}
+
+// サブコマンドごとの FlagSet を生成
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// FlagSet で引数をパースし、失敗した場合の終了コードを返す
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitCodeOK, false
+		}
+		return ExitCodeUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return ExitCodeUsage, false
+	}
+
+	return ExitCodeOK, true
+}
+
+// ベンチマーク対象と初期データに関するフラグ
+func addTargetFlags(fs *flag.FlagSet, option *Option) {
+	fs.StringVar(&option.TargetHost, "target-host", DefaultTargetHost, "Benchmark target host with port, or a comma-separated list of them, e.g. app1:8080,app2:8080 (host:port=weight with weighted)")
+	fs.StringVar(&option.TargetDistribution, "target-distribution", DefaultTargetDistribution, "How to spread users over multiple targets: round-robin, sticky or weighted")
+	fs.DurationVar(&option.RequestTimeout, "request-timeout", DefaultRequestTimeout, "Default request timeout")
+	fs.DurationVar(&option.InitializeRequestTimeout, "initialize-request-timeout", DefaultInitializeRequestTimeout, "Initialize request timeout")
+	fs.DurationVar(&option.TimelineGracePeriod, "timeline-grace-period", DefaultTimelineGracePeriod, "Allowed delay until a new post appears in the timeline")
+	fs.Int64Var(&option.Seed, "seed", DefaultSeed, "Random seed (0 means a time-based seed)")
+	fs.StringVar(&option.UserDistribution, "user-distribution", DefaultUserDistribution, "User selection: uniform, zipf[:exponent] or hotset[:ratio[:probability]]")
+	fs.StringVar(&option.StateFile, "state-file", DefaultStateFile, "Save the benchmarker state to this file after the run")
+	fs.BoolVar(&option.Continue, "continue", DefaultContinue, "Resume from --state-file without initializing the target")
+	addDumpFlags(fs, option)
+}
+
+// ダンプデータに関するフラグ
+func addDumpFlags(fs *flag.FlagSet, option *Option) {
+	fs.StringVar(&option.DumpDir, "dump-dir", DefaultDumpDir, "Directory containing users.json, posts.json and comments.json")
+}
+
+// エラー出力に関するフラグ
+func addErrorFlags(fs *flag.FlagSet, option *Option) {
+	fs.IntVar(&option.ErrorExamples, "error-examples", DefaultErrorExamples, "Number of example messages shown for each kind of error")
+	fs.IntVar(&option.ErrorGroups, "error-groups", DefaultErrorGroups, "Maximum number of error kinds shown to contestants")
+	fs.StringVar(&option.ErrorLog, "error-log", DefaultErrorLog, "Write all errors with backtraces to this file instead of the admin log")
+}
+
+// ログ出力に関するフラグ
+func addLogFlags(fs *flag.FlagSet, option *Option) {
+	fs.StringVar(&option.LogFormat, "log-format", DefaultLogFormat, "Log format: text or json")
+	fs.StringVar(&option.LogLevel, "log-level", DefaultLogLevel, "Minimum level of the admin log: debug, info, warn or error (the contestant log is never filtered)")
+	fs.StringVar(&option.ContestantLog, "contestant-log", DefaultContestantLog, "Write the contestant log to this file instead of stdout")
+	fs.StringVar(&option.AdminLog, "admin-log", DefaultAdminLog, "Write the admin log to this file instead of stderr")
+}
+
+// 対象に関するオプションの組み合わせを検証し、シード未指定なら時刻から生成する
+func prepareTargetOption(option *Option) error {
+	// 再開するには保存した状態が必要
+	if option.Continue && option.StateFile == "" {
+		return errors.New("--continue requires --state-file")
+	}
+
+	// 対象の一覧を生成
+	targets, err := ParseTargets(option.TargetHost, option.TargetDistribution)
+	if err != nil {
+		return err
+	}
+	option.Targets = targets
+	option.Endpoints = &EndpointLatency{}
+
+	// シード未指定なら時刻から生成し、同じ実行を再現できるよう設定として出力する
+	if option.Seed == 0 {
+		option.Seed = time.Now().UnixNano()
+	}
+
+	return nil
+}
+
+// シナリオを1回実行する isucandar.Benchmark を生成して実行
+// ctx をキャンセルすると実行中のステップを中断して結果を返す
+func startBenchmark(ctx context.Context, scenario interface{}, loadTimeout time.Duration) (*isucandar.BenchmarkResult, error) {
+	benchmark, err := isucandar.NewBenchmark(
+		// isucandar.Benchmark はステップ内の panic を自動で recover する機能があるが、今回は利用しない
+		isucandar.WithoutPanicRecover(),
+		isucandar.WithLoadTimeout(loadTimeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// ベンチマークにシナリオを追加
+	// Load は終了を待てるよう包んでから追加する
+	waiter := newLoadWaiter()
+	if p, ok := scenario.(isucandar.PrepareScenario); ok {
+		benchmark.Prepare(p.Prepare)
+	}
+	if l, ok := scenario.(isucandar.LoadScenario); ok {
+		benchmark.Load(waiter.wrap(l.Load))
+	}
+	if v, ok := scenario.(isucandar.ValidationScenario); ok {
+		benchmark.Validation(v.Validation)
+	}
+
+	// 最上位の context.Context を生成
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := benchmark.Start(ctx)
+	waiter.wait()
+
+	return result, nil
+}
+
+// Load の終了を待つための構造体
+// isucandar は負荷走行の時間切れで Load の終了を待たずに次へ進むので、
+// シナリオに記録した結果を読む前に Load が返るのを待つ
+type loadWaiter struct {
+	mu      sync.Mutex
+	running bool
+	closed  bool
+	done    chan struct{}
+}
+
+func newLoadWaiter() *loadWaiter {
+	return &loadWaiter{done: make(chan struct{})}
+}
+
+// Load を包んで、実行中かどうかと終了を記録する
+func (w *loadWaiter) wrap(load isucandar.BenchmarkStepFunc) isucandar.BenchmarkStepFunc {
+	return func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return nil
+		}
+		w.running = true
+		w.mu.Unlock()
+		defer close(w.done)
+
+		return load(ctx, step)
+	}
+}
+
+// Load が実行中なら返るまで待つ。この後に呼ばれた Load は何もしない
+func (w *loadWaiter) wait() {
+	w.mu.Lock()
+	w.closed = true
+	running := w.running
+	w.mu.Unlock()
+
+	if running {
+		<-w.done
+	}
+}
+
+// ベンチマーク中に発生したエラーを出力
+// 大会運営向けにはすべてのエラーをスタックトレース付きで、選手向けには種類ごとにまとめて出力する
+func reportErrors(option Option, result *isucandar.BenchmarkResult) error {
+	errorLogger := AdminLogger
+	if option.ErrorLog != "" {
+		errorLogFile, err := os.Create(option.ErrorLog)
+		if err != nil {
+			return err
+		}
+		defer errorLogFile.Close()
+		errorLogger = NewLogger(errorLogFile, "error", "")
+		if err := errorLogger.SetFormat(option.LogFormat); err != nil {
+			return err
+		}
+	}
+	errs := result.Errors.All()
+	for _, err := range errs {
+		errorLogger.Error(fmt.Sprintf("%+v", err), "code", strings.Join(failure.GetErrorCodes(err), "/"))
+	}
+
+	// 選手向けには同じ種類のエラーをまとめて表示
+	SummarizeErrors(errs, option.ErrorExamples).Print(ContestantLogger, option.ErrorGroups)
+
+	// リクエストエラーを分類ごとに表示
+	errorCounts := result.Errors.Count()
+	for _, class := range RequestErrorClasses {
+		if count := errorCounts[class.ErrorCode()]; count > 0 {
+			ContestantLogger.Printf("%s errors: %d", class, count)
+		}
+	}
+
+	return nil
+}
+
+// スコアの内訳をタグ順に大会運営向けロガーへ出力
+func reportScoreBreakdown(result *isucandar.BenchmarkResult) {
+	breakdown := result.Score.Breakdown()
+	tags := make([]string, 0, len(breakdown))
+	for tag := range breakdown {
+		tags = append(tags, string(tag))
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		count := breakdown[score.ScoreTag(tag)]
+		AdminLogger.Info(fmt.Sprintf("%s: %d", tag, count), "tag", tag, "count", count)
+	}
+}
+
+// 検証系のサブコマンドの結果を出力し、エラーの有無から終了コードを決める
+func reportCheckResult(name string, result *isucandar.BenchmarkResult) int {
+	if errs := result.Errors.All(); len(errs) > 0 {
+		ContestantLogger.Printf("%s: fail (%d errors)", name, len(errs))
+		return ExitCodeFail
+	}
+
+	ContestantLogger.Printf("%s: pass", name)
+	return ExitCodeOK
+}
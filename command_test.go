@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCommandLine(t *testing.T) {
+	assert.Equal(t, ExitCodeOK, RunCommandLine([]string{"help"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"unknown"}))
+
+	// 各サブコマンドは自身のフラグだけを受け付ける
+	assert.Equal(t, ExitCodeOK, RunCommandLine([]string{"smoke", "-h"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"check-data", "--target-host=localhost"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"validate", "extra"}))
+
+	// サブコマンドを省略すると run として扱う
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"--persistence-phase=unknown"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"run", "--continue"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"run", "--scenarios=unknown"}))
+
+	// ダンプファイルがなければエラー
+	assert.Equal(t, ExitCodeError, RunCommandLine([]string{"check-data", "--dump-dir=" + t.TempDir()}))
+}
+
+func TestValidateCommandInitialize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, v interface{}) {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	write("users.json", []*User{{ID: 1, AccountName: "mary", CreatedAt: now}})
+	write("posts.json", []*Post{})
+	write("comments.json", []*Comment{})
+
+	initialized := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/initialize" {
+			atomic.AddInt32(&initialized, 1)
+		}
+	}))
+	defer server.Close()
+	args := []string{"validate", "--target-host=" + strings.TrimPrefix(server.URL, "http://"), "--dump-dir=" + dir}
+
+	// 既定では対象を初期化しない
+	RunCommandLine(args)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&initialized))
+
+	RunCommandLine(append(args, "--initialize"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&initialized))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/isucon/isucandar/score"
+)
+
+// compare で回帰とみなす閾値のデフォルト値
+const (
+	DefaultCompareScoreDrop       = 5.0
+	DefaultCompareTagDrop         = 10.0
+	DefaultCompareLatencyIncrease = 20.0
+	DefaultCompareLatencyNoise    = 10 * time.Millisecond
+	DefaultCompareErrorIncrease   = 50.0
+	DefaultCompareErrorNoise      = 5
+	DefaultCompareDropIncrease    = 1.0
+)
+
+// 比べる所要時間のパーセンタイル
+var compareQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
+// 比較する項目の種類
+const (
+	CompareSectionScore    = "score"
+	CompareSectionTag      = "tag"
+	CompareSectionEndpoint = "endpoint"
+	CompareSectionScenario = "scenario"
+	CompareSectionDrop     = "drop"
+	CompareSectionError    = "error"
+)
+
+// 回帰とみなす閾値
+// 割合はパーセントで、負の値ならその項目は回帰を判定しない
+type CompareThresholds struct {
+	// スコアの合計が下がった割合
+	ScoreDrop float64 `json:"score_drop"`
+	// タグごとの件数が下がった割合
+	TagDrop float64 `json:"tag_drop"`
+	// 所要時間のパーセンタイルが伸びた割合
+	LatencyIncrease float64 `json:"latency_increase"`
+	// 所要時間がこれ以下しか伸びていなければ誤差とみなす
+	LatencyNoise time.Duration `json:"latency_noise"`
+	// エラーコードごとの件数が増えた割合
+	ErrorIncrease float64 `json:"error_increase"`
+	// エラーの件数がこれ以下しか増えていなければ誤差とみなす
+	ErrorNoise int `json:"error_noise"`
+	// シナリオを開始できなかった割合が増えたポイント数
+	DropIncrease float64 `json:"drop_increase"`
+}
+
+// 比較した1項目
+// 所要時間の値はナノ秒、開始できなかった割合は 0.01% 単位
+type CompareItem struct {
+	Section    string `json:"section"`
+	Name       string `json:"name"`
+	Baseline   int64  `json:"baseline"`
+	Current    int64  `json:"current"`
+	Regression bool   `json:"regression"`
+}
+
+// 基準からの変化の割合(パーセント)
+// 基準が 0 なら増減に応じて ±Inf、変わらなければ 0
+func (i *CompareItem) Change() float64 {
+	if i.Baseline == 0 {
+		if i.Current == 0 {
+			return 0
+		}
+		return math.Inf(int(i.Current))
+	}
+	return float64(i.Current-i.Baseline) / float64(i.Baseline) * 100
+}
+
+// 値を項目の種類に合わせて表示用にする
+func (i *CompareItem) format(v int64) string {
+	switch i.Section {
+	case CompareSectionEndpoint, CompareSectionScenario:
+		return time.Duration(v).Round(time.Microsecond).String()
+	case CompareSectionDrop:
+		return fmt.Sprintf("%.2f%%", float64(v)/100)
+	default:
+		return fmt.Sprintf("%d", v)
+	}
+}
+
+// 2回の結果の比較
+type CompareReport struct {
+	Baseline    string         `json:"baseline"`
+	Current     string         `json:"current"`
+	Items       []*CompareItem `json:"items"`
+	Regressions int            `json:"regressions"`
+}
+
+// 項目を追加し、回帰なら数える
+func (r *CompareReport) add(item *CompareItem) {
+	r.Items = append(r.Items, item)
+	if item.Regression {
+		r.Regressions++
+	}
+}
+
+// 基準から threshold パーセントより下がったか
+func dropped(baseline, current int64, threshold float64) bool {
+	if threshold < 0 || baseline <= 0 {
+		return false
+	}
+	return float64(current) < float64(baseline)*(1-threshold/100)
+}
+
+// 2回の結果を比べ、閾値を超えて悪くなった項目を回帰とする
+func CompareRunResults(baseline, current *RunResult, thresholds CompareThresholds) *CompareReport {
+	report := &CompareReport{
+		Baseline: baseline.ID,
+		Current:  current.ID,
+		Items:    []*CompareItem{},
+	}
+
+	// スコア
+	report.add(&CompareItem{Section: CompareSectionScore, Name: "addition", Baseline: baseline.Score.Addition, Current: current.Score.Addition})
+	report.add(&CompareItem{Section: CompareSectionScore, Name: "deduction", Baseline: baseline.Score.Deduction, Current: current.Score.Deduction})
+	report.add(&CompareItem{
+		Section:    CompareSectionScore,
+		Name:       "total",
+		Baseline:   baseline.Score.Total,
+		Current:    current.Score.Total,
+		Regression: dropped(baseline.Score.Total, current.Score.Total, thresholds.ScoreDrop),
+	})
+	if baseline.Score.Failed || current.Score.Failed {
+		report.add(&CompareItem{
+			Section:    CompareSectionScore,
+			Name:       "failed",
+			Baseline:   boolToInt64(baseline.Score.Failed),
+			Current:    boolToInt64(current.Score.Failed),
+			Regression: current.Score.Failed && !baseline.Score.Failed,
+		})
+	}
+
+	// タグごとの件数
+	for _, tag := range compareTags(baseline.Breakdown, current.Breakdown) {
+		b, c := baseline.Breakdown[tag], current.Breakdown[tag]
+		report.add(&CompareItem{
+			Section:    CompareSectionTag,
+			Name:       string(tag),
+			Baseline:   b,
+			Current:    c,
+			Regression: dropped(b, c, thresholds.TagDrop),
+		})
+	}
+
+	// エンドポイントとシナリオの所要時間
+	// 片方にしか記録がないものは比べられないので飛ばす
+	if baseline.Endpoints != nil && current.Endpoints != nil {
+		for _, name := range baseline.Endpoints.Endpoints() {
+			compareLatency(report, CompareSectionEndpoint, name, baseline.Endpoints.Latency(name), current.Endpoints.Latency(name), thresholds)
+		}
+	}
+	if baseline.Latency != nil && current.Latency != nil {
+		for _, name := range baseline.Latency.Scenarios() {
+			compareLatency(report, CompareSectionScenario, name, baseline.Latency.Latency(name), current.Latency.Latency(name), thresholds)
+		}
+
+		// 開始できなかった分は所要時間に表れないので、その割合も比べる
+		for _, name := range current.Latency.Scenarios() {
+			if baseline.Latency.Dropped(name) == 0 && current.Latency.Dropped(name) == 0 {
+				continue
+			}
+			b := int64(math.Round(baseline.Latency.DropRatio(name) * 10000))
+			c := int64(math.Round(current.Latency.DropRatio(name) * 10000))
+			report.add(&CompareItem{
+				Section:    CompareSectionDrop,
+				Name:       name,
+				Baseline:   b,
+				Current:    c,
+				Regression: thresholds.DropIncrease >= 0 && float64(c-b) > thresholds.DropIncrease*100,
+			})
+		}
+	}
+
+	// エラーコードごとの件数
+	b, c := errorCodeCounts(baseline.Errors), errorCodeCounts(current.Errors)
+	codes := []string{}
+	for code := range b {
+		codes = append(codes, code)
+	}
+	for code := range c {
+		if _, ok := b[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		regression := thresholds.ErrorIncrease >= 0 &&
+			c[code]-b[code] > thresholds.ErrorNoise &&
+			float64(c[code]) > float64(b[code])*(1+thresholds.ErrorIncrease/100)
+		report.add(&CompareItem{
+			Section:    CompareSectionError,
+			Name:       code,
+			Baseline:   int64(b[code]),
+			Current:    int64(c[code]),
+			Regression: regression,
+		})
+	}
+
+	return report
+}
+
+// 所要時間のパーセンタイルを比べて追加する
+func compareLatency(report *CompareReport, section, name string, baseline, current *LatencyHistogram, thresholds CompareThresholds) {
+	if baseline.Count() == 0 || current.Count() == 0 {
+		return
+	}
+
+	for _, q := range compareQuantiles {
+		b, c := baseline.Quantile(q.q), current.Quantile(q.q)
+		regression := thresholds.LatencyIncrease >= 0 &&
+			c-b > thresholds.LatencyNoise &&
+			float64(c) > float64(b)*(1+thresholds.LatencyIncrease/100)
+		report.add(&CompareItem{
+			Section:    section,
+			Name:       name + " " + q.name,
+			Baseline:   int64(b),
+			Current:    int64(c),
+			Regression: regression,
+		})
+	}
+}
+
+// 両方の結果に出てくるタグを名前順に返す
+func compareTags(baseline, current score.ScoreTable) []score.ScoreTag {
+	seen := map[score.ScoreTag]bool{}
+	tags := []score.ScoreTag{}
+	for _, table := range []score.ScoreTable{baseline, current} {
+		for tag := range table {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	return tags
+}
+
+// エラーの件数をルートを問わずコードごとに数える
+func errorCodeCounts(summary *ErrorSummary) map[string]int {
+	counts := map[string]int{}
+	if summary == nil {
+		return counts
+	}
+	for _, group := range summary.Groups {
+		counts[group.Code] += group.Count
+	}
+
+	return counts
+}
+
+// 真偽値を比較できるよう 1 か 0 にする
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 比較の結果を表にして出力
+func (r *CompareReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "baseline: %s\ncurrent:  %s\n\n", r.Baseline, r.Current)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SECTION\tNAME\tBASELINE\tCURRENT\tCHANGE\t")
+	for _, item := range r.Items {
+		change := "-"
+		switch c := item.Change(); {
+		case math.IsInf(c, 0):
+			change = "new"
+		case c != 0:
+			change = fmt.Sprintf("%+.1f%%", c)
+		}
+		mark := ""
+		if item.Regression {
+			mark = "REGRESSION"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Section, item.Name, item.format(item.Baseline), item.format(item.Current), change, mark)
+	}
+	tw.Flush()
+
+	if r.Regressions > 0 {
+		fmt.Fprintf(w, "\n%d regressions\n", r.Regressions)
+	} else {
+		fmt.Fprintln(w, "\nno regressions")
+	}
+}
+
+// 比較する結果をロードする
+// 保存先が開かれていれば ID として、なければファイルのパスとして扱う
+func loadCompareResult(store ResultStore, name string) (*RunResult, error) {
+	if store != nil {
+		return store.Get(name)
+	}
+
+	result, err := LoadRunResult(name)
+	if err != nil {
+		return nil, err
+	}
+	if result.ID == "" {
+		result.ID = name
+	}
+	return result, nil
+}
+
+// compare サブコマンド
+// 基準の結果と今回の結果を比べ、閾値を超えて悪くなった項目があれば ExitCodeFail で終了する
+func CompareCommand(args []string) int {
+	baselineName := ""
+	currentName := ""
+	storeSpec := DefaultStore
+	asJSON := false
+	thresholds := CompareThresholds{}
+
+	fs := newFlagSet("compare")
+	fs.StringVar(&baselineName, "baseline", "", "Result file to compare against (a run ID with --store)")
+	fs.StringVar(&currentName, "current", "", "Result file of the run to check (a run ID with --store)")
+	fs.StringVar(&storeSpec, "store", DefaultStore, "Read --baseline and --current as run IDs from this store: file:<dir> or sqlite:<path>")
+	fs.BoolVar(&asJSON, "json", false, "Print the comparison as JSON")
+	fs.Float64Var(&thresholds.ScoreDrop, "max-score-drop", DefaultCompareScoreDrop, "Regression if the total score drops by more than this percent (negative disables)")
+	fs.Float64Var(&thresholds.TagDrop, "max-tag-drop", DefaultCompareTagDrop, "Regression if a score tag count drops by more than this percent (negative disables)")
+	fs.Float64Var(&thresholds.LatencyIncrease, "max-latency-increase", DefaultCompareLatencyIncrease, "Regression if a p50/p90/p99 latency grows by more than this percent (negative disables)")
+	fs.DurationVar(&thresholds.LatencyNoise, "latency-noise", DefaultCompareLatencyNoise, "Ignore latency increases up to this duration")
+	fs.Float64Var(&thresholds.ErrorIncrease, "max-error-increase", DefaultCompareErrorIncrease, "Regression if an error code occurs more than this percent more often (negative disables)")
+	fs.IntVar(&thresholds.ErrorNoise, "error-noise", DefaultCompareErrorNoise, "Ignore error count increases up to this many per error code")
+	fs.Float64Var(&thresholds.DropIncrease, "max-drop-increase", DefaultCompareDropIncrease, "Regression if the share of a scenario's arrivals dropped at --max-in-flight grows by more than this many percentage points (negative disables)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if baselineName == "" || currentName == "" {
+		fmt.Fprintln(os.Stderr, "compare requires --baseline and --current")
+		return ExitCodeUsage
+	}
+
+	var store ResultStore
+	if storeSpec != "" {
+		var err error
+		store, err = OpenResultStore(storeSpec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCodeError
+		}
+		defer store.Close()
+	}
+
+	baseline, err := loadCompareResult(store, baselineName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", baselineName, err)
+		return ExitCodeError
+	}
+	current, err := loadCompareResult(store, currentName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", currentName, err)
+		return ExitCodeError
+	}
+
+	report := CompareRunResults(baseline, current, thresholds)
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if report.Regressions > 0 {
+		return ExitCodeFail
+	}
+	return ExitCodeOK
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar/score"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	option := Option{TargetHost: server.Listener.Addr().String(), RequestTimeout: time.Second, Endpoints: &EndpointLatency{}}
+	ag, err := option.NewUserAgent("mary")
+	require.NoError(t, err)
+
+	for _, id := range []int{1, 2, 3} {
+		_, err := GetPostAction(context.Background(), ag, id)
+		require.NoError(t, err)
+	}
+	_, err = GetRootAction(context.Background(), ag)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"GET /", "GET /posts/:id"}, option.Endpoints.Endpoints())
+	assert.Equal(t, int64(3), option.Endpoints.Latency("GET /posts/:id").Count())
+
+	// initialize は負荷走行のリクエストではないので記録しない
+	ag, err = option.NewAgent(true)
+	require.NoError(t, err)
+	_, err = GetInitializeAction(context.Background(), ag)
+	require.NoError(t, err)
+	assert.Len(t, option.Endpoints.Endpoints(), 2)
+}
+
+func TestEndpointLatencyJSON(t *testing.T) {
+	e := &EndpointLatency{}
+	for i := 1; i <= 10; i++ {
+		e.Record("GET /", time.Duration(i)*time.Millisecond)
+	}
+
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+	decoded := &EndpointLatency{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, e.Latency("GET /").String(), decoded.Latency("GET /").String())
+
+	decoded.Merge(e)
+	assert.Equal(t, int64(20), decoded.Latency("GET /").Count())
+}
+
+// 所要時間が d のリクエストを記録した結果を生成
+func newCompareRunResult(id string, total int64, tags score.ScoreTable, d time.Duration, errors map[string]int) *RunResult {
+	endpoints := &EndpointLatency{}
+	for i := 0; i < 100; i++ {
+		endpoints.Record("GET /posts/:id", d)
+	}
+	summary := &ErrorSummary{Groups: []*ErrorGroup{}}
+	for code, count := range errors {
+		summary.Total += count
+		summary.Groups = append(summary.Groups, &ErrorGroup{Code: code, Method: "GET", Route: "/", Count: count})
+	}
+
+	return &RunResult{
+		ID:        id,
+		Score:     ScoreSummary{Total: total},
+		Breakdown: tags,
+		Errors:    summary,
+		Endpoints: endpoints,
+	}
+}
+
+func findCompareItem(report *CompareReport, section, name string) *CompareItem {
+	for _, item := range report.Items {
+		if item.Section == section && item.Name == name {
+			return item
+		}
+	}
+	return nil
+}
+
+func TestCompareRunResults(t *testing.T) {
+	thresholds := CompareThresholds{
+		ScoreDrop:       5,
+		TagDrop:         10,
+		LatencyIncrease: 20,
+		LatencyNoise:    10 * time.Millisecond,
+		ErrorIncrease:   0,
+	}
+	baseline := newCompareRunResult("base", 1000, score.ScoreTable{"get-index": 100, "post-comment": 50}, 100*time.Millisecond, map[string]int{"validation": 2})
+
+	// 誤差の範囲なら回帰にしない
+	current := newCompareRunResult("cur", 970, score.ScoreTable{"get-index": 95, "post-comment": 50}, 110*time.Millisecond, map[string]int{"validation": 2})
+	report := CompareRunResults(baseline, current, thresholds)
+	assert.Equal(t, 0, report.Regressions)
+	assert.Equal(t, "base", report.Baseline)
+	require.NotNil(t, findCompareItem(report, CompareSectionEndpoint, "GET /posts/:id p99"))
+
+	current = newCompareRunResult("cur", 900, score.ScoreTable{"get-index": 80, "post-comment": 50}, 200*time.Millisecond, map[string]int{"validation": 2, "timeout": 1})
+	report = CompareRunResults(baseline, current, thresholds)
+	assert.True(t, findCompareItem(report, CompareSectionScore, "total").Regression)
+	assert.True(t, findCompareItem(report, CompareSectionTag, "get-index").Regression)
+	assert.False(t, findCompareItem(report, CompareSectionTag, "post-comment").Regression)
+	assert.True(t, findCompareItem(report, CompareSectionEndpoint, "GET /posts/:id p99").Regression)
+	assert.False(t, findCompareItem(report, CompareSectionError, "validation").Regression)
+	assert.True(t, findCompareItem(report, CompareSectionError, "timeout").Regression)
+	assert.Equal(t, 1+1+3+1, report.Regressions)
+
+	// 負の閾値はその項目の判定をしない
+	report = CompareRunResults(baseline, current, CompareThresholds{ScoreDrop: -1, TagDrop: -1, LatencyIncrease: -1, ErrorIncrease: -1})
+	assert.Equal(t, 0, report.Regressions)
+
+	// エラーは割合と件数の両方を超えて増えたら回帰
+	errorThresholds := CompareThresholds{ScoreDrop: -1, TagDrop: -1, LatencyIncrease: -1, ErrorIncrease: DefaultCompareErrorIncrease, ErrorNoise: DefaultCompareErrorNoise}
+	baseline = newCompareRunResult("base", 1000, score.ScoreTable{}, 100*time.Millisecond, map[string]int{"validation": 20})
+	current = newCompareRunResult("cur", 1000, score.ScoreTable{}, 100*time.Millisecond, map[string]int{"validation": 28, "timeout": 1})
+	report = CompareRunResults(baseline, current, errorThresholds)
+	assert.Equal(t, 0, report.Regressions)
+	current = newCompareRunResult("cur", 1000, score.ScoreTable{}, 100*time.Millisecond, map[string]int{"validation": 31, "timeout": 6})
+	report = CompareRunResults(baseline, current, errorThresholds)
+	assert.True(t, findCompareItem(report, CompareSectionError, "validation").Regression)
+	assert.True(t, findCompareItem(report, CompareSectionError, "timeout").Regression)
+
+	// 開始できなかった割合が閾値のポイント数を超えて増えたら回帰
+	dropThresholds := CompareThresholds{ScoreDrop: -1, TagDrop: -1, LatencyIncrease: -1, ErrorIncrease: -1, DropIncrease: DefaultCompareDropIncrease}
+	baseline = newCompareRunResult("base", 1000, score.ScoreTable{}, 100*time.Millisecond, nil)
+	baseline.Latency = &LatencyRecorder{}
+	current = newCompareRunResult("cur", 1000, score.ScoreTable{}, 100*time.Millisecond, nil)
+	current.Latency = &LatencyRecorder{}
+	now := time.Now()
+	for i := 0; i < 99; i++ {
+		baseline.Latency.Record(ScenarioOrderedIndex, now, now, now.Add(100*time.Millisecond))
+		current.Latency.Record(ScenarioOrderedIndex, now, now, now.Add(100*time.Millisecond))
+	}
+	current.Latency.RecordDropped(ScenarioOrderedIndex)
+	report = CompareRunResults(baseline, current, dropThresholds)
+	item := findCompareItem(report, CompareSectionDrop, ScenarioOrderedIndex)
+	require.NotNil(t, item)
+	assert.Equal(t, int64(0), item.Baseline)
+	assert.Equal(t, int64(100), item.Current)
+	assert.False(t, item.Regression)
+	for i := 0; i < 10; i++ {
+		current.Latency.RecordDropped(ScenarioOrderedIndex)
+	}
+	report = CompareRunResults(baseline, current, dropThresholds)
+	assert.True(t, findCompareItem(report, CompareSectionDrop, ScenarioOrderedIndex).Regression)
+	assert.Equal(t, 1, report.Regressions)
+
+	// fail になったら回帰
+	current = newCompareRunResult("cur", 0, score.ScoreTable{}, 100*time.Millisecond, nil)
+	current.Score.Failed = true
+	report = CompareRunResults(baseline, current, CompareThresholds{ScoreDrop: -1, TagDrop: -1, LatencyIncrease: -1, ErrorIncrease: -1})
+	assert.True(t, findCompareItem(report, CompareSectionScore, "failed").Regression)
+}
+
+func TestCompareCommand(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, result *RunResult) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		require.NoError(t, err)
+		defer file.Close()
+		require.NoError(t, encodeRunResult(file, result))
+		return path
+	}
+
+	baseline := write("baseline.json", newCompareRunResult("", 1000, score.ScoreTable{"get-index": 100}, 100*time.Millisecond, nil))
+	same := write("same.json", newCompareRunResult("", 1000, score.ScoreTable{"get-index": 100}, 100*time.Millisecond, nil))
+	worse := write("worse.json", newCompareRunResult("", 500, score.ScoreTable{"get-index": 50}, 100*time.Millisecond, nil))
+
+	assert.Equal(t, ExitCodeOK, RunCommandLine([]string{"compare", "--baseline=" + baseline, "--current=" + same}))
+	assert.Equal(t, ExitCodeFail, RunCommandLine([]string{"compare", "--baseline=" + baseline, "--current=" + worse}))
+	assert.Equal(t, ExitCodeOK, RunCommandLine([]string{"compare", "--baseline=" + baseline, "--current=" + worse, "--max-score-drop=60", "--max-tag-drop=60"}))
+	assert.Equal(t, ExitCodeUsage, RunCommandLine([]string{"compare", "--baseline=" + baseline}))
+	assert.Equal(t, ExitCodeError, RunCommandLine([]string{"compare", "--baseline=" + baseline, "--current=" + filepath.Join(dir, "missing.json")}))
+}
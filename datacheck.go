@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+)
+
+// check-data のデフォルト値
+const DefaultMaxProblems = 20
+
+// ダンプデータの検証結果
+type DataCheckReport struct {
+	Users    int
+	Posts    int
+	Comments int
+	// 見つかった不整合の説明
+	Problems []string
+}
+
+// 不整合がないか
+func (r *DataCheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *DataCheckReport) addProblem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// ダンプファイルをロードし、モデル間の参照が整合しているかを検証する
+// ファイルが読めない、または ID が重複している場合はエラーを返す
+func CheckDumpData(option Option) (*DataCheckReport, error) {
+	users := &UserSet{}
+	if err := users.LoadJSON(option.DumpFile("users.json")); err != nil {
+		return nil, fmt.Errorf("users.json: %w", err)
+	}
+	posts := &PostSet{}
+	if err := posts.LoadJSON(option.DumpFile("posts.json")); err != nil {
+		return nil, fmt.Errorf("posts.json: %w", err)
+	}
+	comments := &CommentSet{}
+	if err := comments.LoadJSON(option.DumpFile("comments.json")); err != nil {
+		return nil, fmt.Errorf("comments.json: %w", err)
+	}
+
+	return CheckData(users, posts, comments), nil
+}
+
+// ロード済みのモデルの参照を検証する
+func CheckData(users *UserSet, posts *PostSet, comments *CommentSet) *DataCheckReport {
+	report := &DataCheckReport{
+		Users:    users.Len(),
+		Posts:    posts.Len(),
+		Comments: comments.Len(),
+	}
+
+	// アカウント名はログインに使うので空や重複は許さない
+	accountNames := map[string]int{}
+	users.ForEach(func(_ int, user *User) {
+		if user.AccountName == "" {
+			report.addProblem("user %d: empty account name", user.ID)
+			return
+		}
+		if id, ok := accountNames[user.AccountName]; ok {
+			report.addProblem("user %d: account name %q is also used by user %d", user.ID, user.AccountName, id)
+			return
+		}
+		accountNames[user.AccountName] = user.ID
+	})
+
+	posts.ForEach(func(_ int, post *Post) {
+		if _, ok := users.Get(post.UserID); !ok {
+			report.addProblem("post %d: user %d does not exist", post.ID, post.UserID)
+		}
+	})
+
+	comments.ForEach(func(_ int, comment *Comment) {
+		if _, ok := users.Get(comment.UserID); !ok {
+			report.addProblem("comment %d: user %d does not exist", comment.ID, comment.UserID)
+		}
+
+		post, ok := posts.Get(comment.PostID)
+		if !ok {
+			report.addProblem("comment %d: post %d does not exist", comment.ID, comment.PostID)
+			return
+		}
+		if comment.CreatedAt.Before(post.CreatedAt) {
+			report.addProblem("comment %d: created before post %d", comment.ID, post.ID)
+		}
+	})
+
+	return report
+}
+
+// check-data サブコマンド
+// 不整合が見つかれば失敗、ダンプファイルが読めなければエラーとする
+func CheckDataCommand(args []string) int {
+	option := Option{}
+	maxProblems := 0
+
+	fs := newFlagSet("check-data")
+	addDumpFlags(fs, &option)
+	fs.IntVar(&maxProblems, "max-problems", DefaultMaxProblems, "Maximum number of problems shown")
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	report, err := CheckDumpData(option)
+	if err != nil {
+		ContestantLogger.Error(fmt.Sprintf("failed to load dump: %v", err), "dump_dir", option.DumpFile(""))
+		return ExitCodeError
+	}
+
+	ContestantLogger.Info(
+		fmt.Sprintf("users: %d, posts: %d, comments: %d", report.Users, report.Posts, report.Comments),
+		"users", report.Users, "posts", report.Posts, "comments", report.Comments,
+	)
+	for i, problem := range report.Problems {
+		if i >= maxProblems {
+			ContestantLogger.Printf("... and %d more problems", len(report.Problems)-maxProblems)
+			break
+		}
+		ContestantLogger.Warn(problem)
+	}
+
+	if !report.OK() {
+		ContestantLogger.Printf("check-data: fail (%d problems)", len(report.Problems))
+		return ExitCodeFail
+	}
+
+	ContestantLogger.Print("check-data: pass")
+	return ExitCodeOK
+}
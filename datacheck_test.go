@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckData(t *testing.T) {
+	now := time.Now()
+
+	users := &UserSet{}
+	users.Add(&User{ID: 1, AccountName: "mary", CreatedAt: now})
+	users.Add(&User{ID: 2, AccountName: "mary", CreatedAt: now})
+
+	posts := &PostSet{}
+	posts.Add(&Post{ID: 10, UserID: 1, CreatedAt: now})
+	posts.Add(&Post{ID: 20, UserID: 3, CreatedAt: now})
+
+	comments := &CommentSet{}
+	comments.Add(&Comment{ID: 100, PostID: 10, UserID: 2, CreatedAt: now.Add(time.Second)})
+	comments.Add(&Comment{ID: 200, PostID: 30, UserID: 1, CreatedAt: now})
+	comments.Add(&Comment{ID: 300, PostID: 10, UserID: 1, CreatedAt: now.Add(-time.Second)})
+
+	report := CheckData(users, posts, comments)
+	assert.False(t, report.OK())
+	assert.Equal(t, 2, report.Users)
+	assert.Equal(t, 2, report.Posts)
+	assert.Equal(t, 3, report.Comments)
+	assert.ElementsMatch(t, []string{
+		`user 2: account name "mary" is also used by user 1`,
+		"post 20: user 3 does not exist",
+		"comment 200: post 30 does not exist",
+		"comment 300: created before post 10",
+	}, report.Problems)
+}
+
+func TestCheckDumpData(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, v interface{}) {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+
+	write("users.json", []*User{{ID: 1, AccountName: "mary", CreatedAt: now}})
+	write("posts.json", []*Post{{ID: 10, UserID: 1, CreatedAt: now}})
+
+	// comments.json がなければエラー
+	_, err := CheckDumpData(Option{DumpDir: dir})
+	assert.Error(t, err)
+
+	write("comments.json", []*Comment{{ID: 100, PostID: 10, UserID: 1, CreatedAt: now}})
+	report, err := CheckDumpData(Option{DumpDir: dir})
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+
+	assert.Equal(t, ExitCodeOK, RunCommandLine([]string{"check-data", "--dump-dir=" + dir}))
+}
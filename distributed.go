@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/score"
+)
+
+// 分散実行に関するオプションのデフォルト値
+const (
+	// 認証なしで負荷走行を受け付けるので、既定ではループバックだけで待ち受ける
+	DefaultAgentListen = "127.0.0.1:9100"
+	DefaultAgentToken  = ""
+	DefaultAgents      = ""
+	// 全エージェントが準備を終えてから負荷走行を始めるまでの猶予
+	DefaultStartDelay = 5 * time.Second
+)
+
+// エージェントが負荷走行の依頼を受け付けるパス
+const agentRunPath = "/run"
+
+// コーディネーターからエージェントへの負荷走行の依頼
+// Option のファイルのパスはエージェント側で解決するので、各エージェントに同じファイルを置いておく
+type AgentJob struct {
+	Option Option `json:"option"`
+	// 全エージェントが負荷走行を始める時刻
+	// コーディネーターの時計で決めるので、各ホストの時計は NTP などで合わせておく
+	StartAt time.Time `json:"start_at"`
+}
+
+// エージェントで発生したエラー
+// エラーコードとメッセージだけを受け渡し、コーディネーターで組み立て直す
+type AgentError struct {
+	Codes   []string `json:"codes"`
+	Message string   `json:"message"`
+}
+
+// エージェントの負荷走行の結果
+type AgentResult struct {
+	Partition int              `json:"partition"`
+	Scores    score.ScoreTable `json:"scores"`
+	Errors    []AgentError     `json:"errors"`
+	Latency   *LatencyRecorder `json:"latency"`
+	Endpoints *EndpointLatency `json:"endpoints"`
+	OpenLoop  OpenLoopReport   `json:"open_loop"`
+	// 対象の host:port ごとのリクエストの記録
+	Targets map[string]*TargetMetrics `json:"targets"`
+	// 負荷プロファイルのフェーズごとの結果。プロファイルがなければ空
+	Phases []*PhaseResult `json:"phases"`
+	// 準備が開始時刻に間に合わず、負荷走行が遅れて始まった時間
+	LateStart time.Duration `json:"late_start"`
+}
+
+// エラーを受け渡せる形にする
+// リクエストのメソッドとルートが分かるエラーは、まとめて表示できるようメッセージの先頭に付ける
+func NewAgentError(err error) AgentError {
+	codes := []string{}
+	for _, code := range failure.GetErrorCodes(err) {
+		if code != failure.UnknownErrorCode.ErrorCode() {
+			codes = append(codes, code)
+		}
+	}
+
+	// エラーコードを付けただけの failure.Error を外した中身のメッセージを使う
+	inner := err
+	for {
+		fe, ok := inner.(*failure.Error)
+		if !ok || fe.Unwrap() == nil {
+			break
+		}
+		inner = fe.Unwrap()
+	}
+	message := inner.Error()
+	if method, route := errorRequestRoute(err); method != "" && !errorRequestPattern.MatchString(message) {
+		message = fmt.Sprintf("%s %s : %s", method, route, message)
+	}
+
+	return AgentError{Codes: codes, Message: message}
+}
+
+// エラーコードを付け直したエラーを返す
+func (e AgentError) Err() error {
+	err := errors.New(e.Message)
+	for i := len(e.Codes) - 1; i >= 0; i-- {
+		err = failure.NewError(failure.StringCode(e.Codes[i]), err)
+	}
+
+	return err
+}
+
+// 依頼された負荷走行を実行して結果を返す
+// 初期化はコーディネーターが済ませているので行わない
+// コーディネーターとの接続が切れて ctx がキャンセルされたら中断する
+func RunAgentJob(ctx context.Context, job AgentJob) (*AgentResult, error) {
+	option := job.Option
+	// 状態はプロセスごとに持つので、分散実行では保存も再開もできない
+	// エージェントのファイルを読み書きさせないよう、コーディネーター以外からの依頼でも拒否する
+	if option.StateFile != "" || option.Continue || option.PersistencePhase != "" {
+		return nil, failure.NewError(ErrInvalidOption, errors.New("state file, continue and persistence phase cannot be used with agents"))
+	}
+	option.SkipInitialize = true
+	if err := prepareTargetOption(&option); err != nil {
+		return nil, err
+	}
+	if err := validateLoadOption(option); err != nil {
+		return nil, err
+	}
+
+	scenario, loadDuration, err := newLoadScenario(option)
+	if err != nil {
+		return nil, err
+	}
+	scenario.StartAt = job.StartAt
+
+	result, err := startBenchmark(ctx, scenario, loadDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	agentResult := &AgentResult{
+		Partition: option.Partition,
+		Scores:    result.Score.Breakdown(),
+		Errors:    []AgentError{},
+		Latency:   &scenario.Latency,
+		Endpoints: option.Endpoints,
+		OpenLoop:  scenario.OpenLoop.Snapshot(),
+		Targets:   map[string]*TargetMetrics{},
+		Phases:    []*PhaseResult{},
+		LateStart: scenario.LateStart,
+	}
+	for _, target := range option.Targets.Targets() {
+		agentResult.Targets[target.Host] = target.Metrics
+	}
+	if scenario.Phases != nil {
+		agentResult.Phases = scenario.Phases.Results()
+	}
+	for _, err := range result.Errors.All() {
+		agentResult.Errors = append(agentResult.Errors, NewAgentError(err))
+	}
+
+	return agentResult, nil
+}
+
+// コーディネーターからの依頼を受け付ける http.Handler
+// 負荷走行は同時に1つだけ実行する
+type AgentServer struct {
+	// 空でなければ Authorization ヘッダーに同じトークンを持つ依頼だけを受け付ける
+	Token string
+
+	mu sync.Mutex
+}
+
+// http.Handler インターフェースを実装
+func (a *AgentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != agentRunPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r, a.Token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !a.mu.TryLock() {
+		http.Error(w, "another job is running", http.StatusConflict)
+		return
+	}
+	defer a.mu.Unlock()
+
+	job := AgentJob{}
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	AdminLogger.Info(fmt.Sprintf("job started: partition %d/%d", job.Option.Partition, job.Option.Partitions), "partition", job.Option.Partition, "partitions", job.Option.Partitions)
+	result, err := RunAgentJob(r.Context(), job)
+	if err != nil {
+		AdminLogger.Error(fmt.Sprintf("job failed: %v", err))
+		status := http.StatusInternalServerError
+		if failure.IsCode(err, ErrInvalidOption) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	AdminLogger.Info(fmt.Sprintf("job finished: %d errors", len(result.Errors)), "errors", len(result.Errors))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Authorization ヘッダーに token を持つリクエストか
+// token が空なら認証しない
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// エージェントに負荷走行を依頼して結果を待つ
+// token が空でなければ Authorization ヘッダーに付ける
+func requestAgentJob(ctx context.Context, host, token string, job AgentJob) (*AgentResult, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s%s", host, agentRunPath), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("agent %s: %s: %s", host, res.Status, strings.TrimSpace(string(message)))
+	}
+
+	result := &AgentResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("agent %s: invalid result: %v", host, err)
+	}
+
+	return result, nil
+}
+
+// 全エージェントにユーザーを分けて負荷走行を依頼し、すべての結果を待つ
+// 各エージェントは startAt に揃えて負荷走行を始める
+// 1つでも失敗したら結果をまとめられないので、残りのエージェントを中断して最初のエラーを返す
+func runAgents(ctx context.Context, agents []string, token string, option Option, startAt time.Time) ([]*AgentResult, error) {
+	results := make([]*AgentResult, len(agents))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	once := &sync.Once{}
+	var firstErr error
+
+	wg := &sync.WaitGroup{}
+	for i, host := range agents {
+		job := AgentJob{Option: option, StartAt: startAt}
+		job.Option.Partition = i
+		job.Option.Partitions = len(agents)
+
+		wg.Add(1)
+		go func(i int, host string, job AgentJob) {
+			defer wg.Done()
+
+			result, err := requestAgentJob(ctx, host, token, job)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = result
+		}(i, host, job)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return results, nil
+}
+
+// エージェントの結果を1つのベンチマーク結果にまとめる
+// スコアとエラーは isucandar.BenchmarkResult に入れ直すので、そのまま集計や表示に使える
+func mergeAgentResults(results []*AgentResult) (*isucandar.BenchmarkResult, *LatencyRecorder, *OpenLoopReport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := &isucandar.BenchmarkResult{
+		Score:  score.NewScore(ctx),
+		Errors: failure.NewErrors(ctx),
+	}
+	latency := &LatencyRecorder{}
+	openLoop := &OpenLoopReport{}
+
+	for _, r := range results {
+		for tag, count := range r.Scores {
+			for i := int64(0); i < count; i++ {
+				result.Score.Add(tag)
+			}
+		}
+		for _, e := range r.Errors {
+			result.Errors.Add(e.Err())
+		}
+		if r.Latency != nil {
+			latency.Merge(r.Latency)
+		}
+		openLoop.Started += r.OpenLoop.Started
+		openLoop.Dropped += r.OpenLoop.Dropped
+	}
+	result.Score.Done()
+	result.Errors.Done()
+
+	return result, latency, openLoop
+}
+
+// agent サブコマンド
+// コーディネーターからの依頼を待ち受け、負荷走行を実行して結果を返す
+func AgentCommand(args []string) int {
+	option := Option{}
+	listen := DefaultAgentListen
+	token := DefaultAgentToken
+
+	fs := newFlagSet("agent")
+	fs.StringVar(&listen, "listen", DefaultAgentListen, "Address to accept jobs from the coordinator")
+	fs.StringVar(&token, "token", DefaultAgentToken, "Token required from the coordinator in the Authorization: Bearer header (recommended when listening on a non-loopback address)")
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: listen, Handler: &AgentServer{Token: token}}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	AdminLogger.Printf("agent listening on %s", listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	return ExitCodeOK
+}
+
+// coordinate サブコマンド
+// 対象を初期化し、複数のエージェントで同時に負荷走行を実行して結果をまとめる
+// 負荷の設定は各エージェントにそのまま渡るので、並列数や到着率はエージェントごとの値になる
+func CoordinateCommand(args []string) int {
+	option := Option{}
+	agentList := DefaultAgents
+	agentToken := DefaultAgentToken
+	startDelay := DefaultStartDelay
+
+	fs := newFlagSet("coordinate")
+	addTargetFlags(fs, &option)
+	addLoadFlags(fs, &option)
+	addStoreFlags(fs, &option)
+	fs.StringVar(&agentList, "agents", DefaultAgents, "Comma-separated host:port list of benchmarker agents")
+	fs.StringVar(&agentToken, "agent-token", DefaultAgentToken, "Shared token sent to the agents")
+	fs.DurationVar(&startDelay, "start-delay", DefaultStartDelay, "Time given to the agents to load the dump before the load starts together")
+	addErrorFlags(fs, &option)
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	agents := []string{}
+	for _, host := range strings.Split(agentList, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			agents = append(agents, host)
+		}
+	}
+	if len(agents) == 0 {
+		AdminLogger.Print("coordinate requires --agents")
+		return ExitCodeUsage
+	}
+	// 状態はプロセスごとに持つので、分散実行では保存も再開もできない
+	if option.StateFile != "" || option.Continue {
+		AdminLogger.Print("--state-file and --continue cannot be used with coordinate")
+		return ExitCodeUsage
+	}
+
+	if err := prepareTargetOption(&option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	if err := validateLoadOption(option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	AdminLogger.Print(option)
+
+	// エージェントのフェーズごとの結果をまとめるのに使う
+	var profile *LoadProfile
+	if option.LoadProfile != "" {
+		profile, err = LoadLoadProfile(option.LoadProfile)
+		if err != nil {
+			AdminLogger.Print(err)
+			return ExitCodeError
+		}
+	}
+
+	scoringProfile, err := loadScoringProfile(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	store, err := openOptionStore(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	// 中断されたらエージェントとの接続を切り、各エージェントの負荷走行も止める
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 対象の初期化はコーディネーターが1回だけ行う
+	startedAt := time.Now()
+	validation, err := initializeTarget(ctx, option)
+	if err == nil && !validation.IsEmpty() {
+		err = validation
+	}
+	if err != nil {
+		ContestantLogger.Printf("fail: initialize: %v", err)
+		return ExitCodeFail
+	}
+
+	startAt := time.Now().Add(startDelay)
+	results, err := runAgents(ctx, agents, agentToken, option, startAt)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	result, latency, openLoop := mergeAgentResults(results)
+	for i, r := range results {
+		AdminLogger.Info(
+			fmt.Sprintf("agent %s: partition %d, %d errors", agents[i], r.Partition, len(r.Errors)),
+			"agent", agents[i],
+			"partition", r.Partition,
+			"errors", len(r.Errors),
+		)
+		if r.LateStart > 0 {
+			AdminLogger.Warn(
+				fmt.Sprintf("agent %s started %s late: increase --start-delay", agents[i], r.LateStart),
+				"agent", agents[i],
+				"late", r.LateStart,
+			)
+		}
+	}
+
+	// エージェントごとのエンドポイント、対象、フェーズの記録をまとめる
+	var phases *PhaseRecorder
+	if profile != nil {
+		phases = NewPhaseRecorder(profile, startAt)
+	}
+	for _, r := range results {
+		if r.Endpoints != nil {
+			option.Endpoints.Merge(r.Endpoints)
+		}
+		for _, target := range option.Targets.Targets() {
+			if metrics, ok := r.Targets[target.Host]; ok && metrics != nil {
+				target.Metrics.Merge(metrics)
+			}
+		}
+		if phases != nil {
+			phases.Merge(r.Phases)
+		}
+	}
+
+	if err := reportErrors(option, result); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	reportScoreBreakdown(result)
+
+	latency.Print(ContestantLogger)
+	if openLoop.Started+openLoop.Dropped > 0 {
+		ContestantLogger.Printf("arrival: %s", openLoop)
+	}
+	option.Targets.Print(ContestantLogger)
+	if phases != nil {
+		phases.Print(ContestantLogger)
+	}
+
+	runResult := NewRunResult(option, scoringProfile, result, latency, startedAt)
+	saveRunResult(store, runResult)
+	writeRunResultFile(option.ResultFile, runResult)
+
+	return reportScore(option, scoringProfile, result)
+}
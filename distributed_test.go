@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/score"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentError(t *testing.T) {
+	original := failure.NewError(isucandar.ErrLoad, failure.NewError(ErrInvalidResponse, errors.New("GET /posts/1 : status code 500")))
+
+	e := NewAgentError(original)
+	assert.Equal(t, []string{isucandar.ErrLoad.ErrorCode(), ErrInvalidResponse.ErrorCode()}, e.Codes)
+	assert.Equal(t, "GET /posts/1 : status code 500", e.Message)
+
+	// 組み立て直したエラーはコードも表示も元と同じになる
+	rebuilt := e.Err()
+	assert.Equal(t, failure.GetErrorCodes(original), failure.GetErrorCodes(rebuilt))
+	assert.Equal(t, errorGroupCode(original), errorGroupCode(rebuilt))
+	assert.Equal(t, fmt.Sprintf("%v", original), fmt.Sprintf("%v", rebuilt))
+	method, route := errorRequestRoute(rebuilt)
+	assert.Equal(t, "GET", method)
+	assert.Equal(t, "/posts/:id", route)
+
+	// コードの付いていない途中のエラーのメッセージは残す
+	e = NewAgentError(failure.NewError(ErrFailedLoadJSON, fmt.Errorf("open users.json: %w", os.ErrNotExist)))
+	assert.Equal(t, "open users.json: file does not exist", e.Message)
+}
+
+func TestLatencyRecorderJSON(t *testing.T) {
+	r := &LatencyRecorder{}
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		r.Record(ScenarioPostImage, now, now, now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	decoded := &LatencyRecorder{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+
+	assert.Equal(t, []string{ScenarioPostImage}, decoded.Scenarios())
+	assert.Equal(t, r.Latency(ScenarioPostImage).String(), decoded.Latency(ScenarioPostImage).String())
+
+	// 別の記録と足し合わせる
+	decoded.Merge(r)
+	assert.Equal(t, int64(200), decoded.Latency(ScenarioPostImage).Count())
+	assert.Equal(t, int64(200), decoded.ServiceTime(ScenarioPostImage).Count())
+	assert.Equal(t, 100*time.Millisecond, decoded.Latency(ScenarioPostImage).Max())
+
+	assert.Error(t, json.Unmarshal([]byte(`{"buckets":[[-1,1]]}`), NewLatencyHistogram()))
+}
+
+func TestMergeAgentResults(t *testing.T) {
+	latency := &LatencyRecorder{}
+	now := time.Now()
+	latency.Record(ScenarioOrderedIndex, now, now, now.Add(time.Second))
+
+	results := []*AgentResult{
+		{
+			Scores:   score.ScoreTable{ScoreGETRoot: 10, ScorePOSTRoot: 2},
+			Errors:   []AgentError{{Codes: []string{ErrInvalidResponse.ErrorCode()}, Message: "GET / : bad"}},
+			Latency:  latency,
+			OpenLoop: OpenLoopReport{Started: 5, Dropped: 1},
+		},
+		{
+			Scores:   score.ScoreTable{ScoreGETRoot: 5},
+			Errors:   []AgentError{},
+			Latency:  latency,
+			OpenLoop: OpenLoopReport{Started: 3},
+		},
+	}
+
+	result, merged, openLoop := mergeAgentResults(results)
+	assert.Equal(t, score.ScoreTable{ScoreGETRoot: 15, ScorePOSTRoot: 2}, result.Score.Breakdown())
+	assert.Len(t, result.Errors.All(), 1)
+	assert.Equal(t, int64(2), merged.Latency(ScenarioOrderedIndex).Count())
+	assert.Equal(t, int64(8), openLoop.Started)
+	assert.Equal(t, int64(1), openLoop.Dropped)
+
+	// GET / が 1 点、POST / が 5 点、エラーが 1 点減点
+	summary := DefaultScoringProfile().Calculate(result)
+	assert.Equal(t, int64(24), summary.Total)
+}
+
+func TestRunAgents(t *testing.T) {
+	agents := []string{}
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(&AgentServer{})
+		defer server.Close()
+		agents = append(agents, strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	// ダンプがないので各エージェントは Prepare で失敗し、そのエラーを結果として返す
+	option := Option{
+		TargetHost: "localhost:1",
+		Seed:       42,
+		DumpDir:    t.TempDir(),
+	}
+	results, err := runAgents(context.Background(), agents, "", option, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for i, r := range results {
+		assert.Equal(t, i, r.Partition)
+		require.Len(t, r.Errors, 1)
+		assert.Contains(t, r.Errors[0].Codes, ErrFailedLoadJSON.ErrorCode())
+		assert.Contains(t, r.Targets, "localhost:1")
+	}
+
+	// 不正なオプションはエージェントのエラーとして返る
+	option.Scenarios = "unknown"
+	_, err = runAgents(context.Background(), agents, "", option, time.Time{})
+	assert.Error(t, err)
+}
+
+func TestScenarioLateStart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, v interface{}) {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	write("users.json", []*User{{ID: 1, AccountName: "mary", CreatedAt: now}})
+	write("posts.json", []*Post{})
+	write("comments.json", []*Comment{})
+
+	option := Option{
+		TargetHost:       "localhost:1",
+		Seed:             42,
+		DumpDir:          dir,
+		UserDistribution: DefaultUserDistribution,
+		ThinkTime:        DefaultThinkTime,
+		SkipInitialize:   true,
+	}
+	scenario, _, err := newLoadScenario(option)
+	require.NoError(t, err)
+
+	// 開始時刻を過ぎてから準備が終わったら、待たずに遅れを記録する
+	scenario.StartAt = now.Add(-time.Second)
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover(), isucandar.WithLoadTimeout(time.Millisecond))
+	require.NoError(t, err)
+	benchmark.Prepare(scenario.Prepare)
+	result := benchmark.Start(context.Background())
+	assert.Empty(t, result.Errors.All())
+	assert.GreaterOrEqual(t, scenario.LateStart, time.Second)
+}
+
+func TestRunAgentsCancelsOnFailure(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "another job is running", http.StatusConflict)
+	}))
+	defer busy.Close()
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 本文を読み終えると接続の切断を検知できる
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer slow.Close()
+
+	// 1つが失敗したら残りのエージェントの負荷走行を待たずに中断する
+	agents := []string{strings.TrimPrefix(slow.URL, "http://"), strings.TrimPrefix(busy.URL, "http://")}
+	_, err := runAgents(context.Background(), agents, "", Option{}, time.Time{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "409 Conflict")
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the other agent was not canceled")
+	}
+}
+
+func TestAgentServer(t *testing.T) {
+	server := httptest.NewServer(&AgentServer{})
+	defer server.Close()
+
+	res, err := http.Get(server.URL + agentRunPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, err = http.Post(server.URL+agentRunPath, "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(server.URL + "/unknown")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// エージェントのファイルを読み書きする依頼は受け付けない
+	for _, option := range []Option{{StateFile: "state.json"}, {Continue: true}, {PersistencePhase: PersistencePhaseWrite}} {
+		_, err := requestAgentJob(context.Background(), strings.TrimPrefix(server.URL, "http://"), "", AgentJob{Option: option})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "400 Bad Request")
+	}
+}
+
+func TestAgentServerToken(t *testing.T) {
+	server := httptest.NewServer(&AgentServer{Token: "secret"})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	_, err := requestAgentJob(context.Background(), host, "", AgentJob{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+	_, err = requestAgentJob(context.Background(), host, "wrong", AgentJob{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+
+	// トークンが合えば依頼を受け付ける
+	_, err = requestAgentJob(context.Background(), host, "secret", AgentJob{Option: Option{StateFile: "state.json"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400 Bad Request")
+}
+
+func TestPartitionUsers(t *testing.T) {
+	users := []*User{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}
+
+	assert.Equal(t, users, partitionUsers(users, 0, 0))
+	assert.Equal(t, []*User{users[0], users[2], users[4]}, partitionUsers(users, 0, 2))
+	assert.Equal(t, []*User{users[1], users[3]}, partitionUsers(users, 1, 2))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// エンドポイントごとのレスポンスまでの所要時間
+// エンドポイントは "GET /posts/:id" のように ID やアカウント名を置き換えたルートでまとめる
+type EndpointLatency struct {
+	mu      sync.Mutex
+	latency map[string]*LatencyHistogram
+}
+
+// リクエストのメソッドとパスからエンドポイント名を作る
+func endpointName(req *http.Request) string {
+	return req.Method + " " + errorRoute(req.URL.Path)
+}
+
+// エンドポイントのヒストグラムを返す。なければ作る
+func (e *EndpointLatency) histogram(endpoint string) *LatencyHistogram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.latency == nil {
+		e.latency = map[string]*LatencyHistogram{}
+	}
+	h, ok := e.latency[endpoint]
+	if !ok {
+		h = NewLatencyHistogram()
+		e.latency[endpoint] = h
+	}
+
+	return h
+}
+
+// レスポンスを受け取れたリクエストを1件記録
+func (e *EndpointLatency) Record(endpoint string, d time.Duration) {
+	e.histogram(endpoint).Record(d)
+}
+
+// 記録のあるエンドポイントの一覧
+func (e *EndpointLatency) Endpoints() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(e.latency))
+	for name := range e.latency {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// エンドポイントの所要時間
+func (e *EndpointLatency) Latency(endpoint string) *LatencyHistogram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if h, ok := e.latency[endpoint]; ok {
+		return h
+	}
+	return NewLatencyHistogram()
+}
+
+// 別の記録の内容をエンドポイントごとに足し合わせる
+func (e *EndpointLatency) Merge(other *EndpointLatency) {
+	for _, name := range other.Endpoints() {
+		e.histogram(name).Merge(other.Latency(name))
+	}
+}
+
+// json.Marshaler インターフェースを実装
+func (e *EndpointLatency) MarshalJSON() ([]byte, error) {
+	v := map[string]*LatencyHistogram{}
+	for _, name := range e.Endpoints() {
+		v[name] = e.Latency(name)
+	}
+
+	return json.Marshal(v)
+}
+
+// json.Unmarshaler インターフェースを実装
+func (e *EndpointLatency) UnmarshalJSON(data []byte) error {
+	v := map[string]*LatencyHistogram{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.latency = map[string]*LatencyHistogram{}
+	for name, h := range v {
+		if h != nil {
+			e.latency[name] = h
+		}
+	}
+
+	return nil
+}
+
+// リクエストごとに EndpointLatency へ記録する http.RoundTripper
+// 負荷走行の終了で中断したリクエストとレスポンスを受け取れなかったリクエストは記録しない
+type endpointTransport struct {
+	base    http.RoundTripper
+	latency *EndpointLatency
+}
+
+// http.RoundTripper インターフェースを実装
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	res, err := t.base.RoundTrip(req)
+	if err == nil && !errors.Is(req.Context().Err(), context.Canceled) {
+		t.latency.Record(endpointName(req), time.Since(startedAt))
+	}
+
+	return res, err
+}
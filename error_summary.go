@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+)
+
+// コード、メソッド、ルートが同じエラーのまとまり
+type ErrorGroup struct {
+	Code     string   `json:"code"`
+	Method   string   `json:"method"`
+	Route    string   `json:"route"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// エラーをまとめた結果
+type ErrorSummary struct {
+	Total  int           `json:"total"`
+	Groups []*ErrorGroup `json:"groups"`
+}
+
+var (
+	// バリデータが生成するエラーメッセージの先頭の "GET /path : "
+	errorRequestPattern = regexp.MustCompile(`^([A-Z]+) (/\S*) : `)
+	// ルートとしてまとめるためにパス中の ID を置き換える
+	errorRouteIDPattern      = regexp.MustCompile(`/\d+(/|$)`)
+	errorRouteAccountPattern = regexp.MustCompile(`^/@[^/]+`)
+	// isucandar がステップごとに付けるコードはまとめる際には使わない
+	errorStepCodes = map[string]struct{}{
+		isucandar.ErrPrepare.ErrorCode():    {},
+		isucandar.ErrLoad.ErrorCode():       {},
+		isucandar.ErrValidation.ErrorCode(): {},
+	}
+)
+
+// エラーをコード、メソッド、ルートごとにまとめる
+// 各まとまりには最初の examples 件のメッセージを例として残す
+func SummarizeErrors(errs []error, examples int) *ErrorSummary {
+	summary := &ErrorSummary{
+		Total:  len(errs),
+		Groups: []*ErrorGroup{},
+	}
+	groups := map[string]*ErrorGroup{}
+
+	for _, err := range errs {
+		code := errorGroupCode(err)
+		method, route := errorRequestRoute(err)
+
+		key := code + " " + method + " " + route
+		group, ok := groups[key]
+		if !ok {
+			group = &ErrorGroup{
+				Code:     code,
+				Method:   method,
+				Route:    route,
+				Examples: []string{},
+			}
+			groups[key] = group
+			summary.Groups = append(summary.Groups, group)
+		}
+
+		group.Count++
+		if len(group.Examples) < examples {
+			group.Examples = append(group.Examples, fmt.Sprintf("%v", err))
+		}
+	}
+
+	// 件数の多い順、同数なら最初に発生した順
+	sort.SliceStable(summary.Groups, func(i, j int) bool {
+		return summary.Groups[i].Count > summary.Groups[j].Count
+	})
+
+	return summary
+}
+
+// ステップのコードを除いたエラーコードを外側から順に / でつなげる
+func errorGroupCode(err error) string {
+	codes := []string{}
+	for _, code := range failure.GetErrorCodes(err) {
+		if _, ok := errorStepCodes[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == 0 {
+		return failure.UnknownErrorCode.ErrorCode()
+	}
+	return strings.Join(codes, "/")
+}
+
+// エラーの原因となったリクエストのメソッドとルートを返す
+// 分からなければ空文字列を返す
+func errorRequestRoute(err error) (string, string) {
+	// リクエスト自体が失敗したエラー
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, perr := url.Parse(urlErr.URL); perr == nil {
+			return strings.ToUpper(urlErr.Op), errorRoute(u.Path)
+		}
+	}
+
+	// バリデータのエラーは "METHOD /path : message" の形式
+	var unwrapped error = err
+	for {
+		next := errors.Unwrap(unwrapped)
+		if next == nil {
+			break
+		}
+		unwrapped = next
+	}
+	if m := errorRequestPattern.FindStringSubmatch(unwrapped.Error()); m != nil {
+		return m[1], errorRoute(m[2])
+	}
+
+	return "", ""
+}
+
+// パス中の ID やアカウント名を置き換えてルートにする
+func errorRoute(path string) string {
+	route := errorRouteAccountPattern.ReplaceAllString(path, "/@:account_name")
+	for errorRouteIDPattern.MatchString(route) {
+		route = errorRouteIDPattern.ReplaceAllString(route, "/:id$1")
+	}
+	return route
+}
+
+// まとめた結果を最大 maxGroups 件まで出力する
+func (s *ErrorSummary) Print(logger *Logger, maxGroups int) {
+	if s.Total == 0 {
+		return
+	}
+
+	logger.Printf("errors: %d (%d kinds)", s.Total, len(s.Groups))
+	for i, group := range s.Groups {
+		if i >= maxGroups {
+			logger.Printf("... and %d more kinds", len(s.Groups)-maxGroups)
+			break
+		}
+
+		if group.Method == "" {
+			logger.Printf("[%s] x%d", group.Code, group.Count)
+		} else {
+			logger.Printf("[%s] %s %s x%d", group.Code, group.Method, group.Route, group.Count)
+		}
+		for _, example := range group.Examples {
+			logger.Printf("  %s", strings.ReplaceAll(example, "\n", "\n  "))
+		}
+	}
+}
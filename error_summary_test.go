@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeErrors(t *testing.T) {
+	errs := []error{}
+	for i := 0; i < 5; i++ {
+		errs = append(errs, failure.NewError(isucandar.ErrLoad, failure.NewError(
+			ErrInvalidStatusCode,
+			fmt.Errorf("GET /posts/%d : expected(200) != actual(500)", i+1),
+		)))
+	}
+	errs = append(errs, failure.NewError(isucandar.ErrLoad, failure.NewError(
+		ErrInvalidRequest,
+		ClassifyRequestError(&url.Error{Op: "Post", URL: "http://localhost/login", Err: errors.New("malformed")}),
+	)))
+	errs = append(errs, failure.NewError(ErrFailedLoadJSON, errors.New("open ./dump/comments.json")))
+
+	summary := SummarizeErrors(errs, 2)
+	assert.Equal(t, 7, summary.Total)
+	assert.Len(t, summary.Groups, 3)
+
+	group := summary.Groups[0]
+	assert.Equal(t, "status-code", group.Code)
+	assert.Equal(t, "GET", group.Method)
+	assert.Equal(t, "/posts/:id", group.Route)
+	assert.Equal(t, 5, group.Count)
+	assert.Len(t, group.Examples, 2)
+
+	group = summary.Groups[1]
+	assert.Equal(t, "request/protocol", group.Code)
+	assert.Equal(t, "POST", group.Method)
+	assert.Equal(t, "/login", group.Route)
+
+	group = summary.Groups[2]
+	assert.Equal(t, "load-json", group.Code)
+	assert.Equal(t, "", group.Method)
+}
+
+func TestErrorSummaryPrint(t *testing.T) {
+	errs := []error{}
+	for _, path := range []string{"/", "/login", "/@mary", "/posts/1"} {
+		errs = append(errs, failure.NewError(ErrNotFound, fmt.Errorf("GET %s : not found", path)))
+	}
+
+	buf := &bytes.Buffer{}
+	SummarizeErrors(errs, 1).Print(newTestLogger(buf), 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, "errors: 4 (4 kinds)", lines[0])
+	assert.Equal(t, "[not-found] GET / x1", lines[1])
+	assert.Contains(t, buf.String(), "GET /@:account_name x1")
+	assert.Equal(t, "... and 1 more kinds", lines[len(lines)-1])
+}
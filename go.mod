@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/PuerkitoBio/goquery v1.8.0
 	github.com/isucon/isucandar v0.0.0-20220322062028-6dd56dc57d72
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/stretchr/testify v1.7.1
 )
 
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// history で表示する件数のデフォルト値(0 なら全件)
+const DefaultHistoryLimit = 0
+
+// チームと対象ごとに並べた過去の実行の1件
+type HistoryEntry struct {
+	ID        string    `json:"id"`
+	Team      string    `json:"team"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	Score     int64     `json:"score"`
+	Failed    bool      `json:"failed"`
+	Errors    int       `json:"errors"`
+	// シナリオの中で最も遅い p99
+	WorstP99 time.Duration `json:"worst_p99"`
+	// 同じチームと対象の前回からのスコアの差。初回は nil
+	Delta *int64 `json:"delta,omitempty"`
+	// 同じチームと対象の中で最高スコアか
+	Best bool `json:"best"`
+}
+
+// 結果をチームと対象ごとに古い順に並べ、前回との差と最高スコアを求める
+func NewHistory(results []*RunResult) []*HistoryEntry {
+	sorted := make([]*RunResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Team != b.Team {
+			return a.Team < b.Team
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.StartedAt.Before(b.StartedAt)
+	})
+
+	entries := make([]*HistoryEntry, 0, len(sorted))
+	best := map[string]*HistoryEntry{}
+	var prev *HistoryEntry
+	for _, r := range sorted {
+		entry := &HistoryEntry{
+			ID:        r.ID,
+			Team:      r.Team,
+			Target:    r.Target,
+			StartedAt: r.StartedAt,
+			Score:     r.Score.Total,
+			Failed:    r.Score.Failed,
+		}
+		if r.Errors != nil {
+			entry.Errors = r.Errors.Total
+		}
+		if r.Latency != nil {
+			for _, name := range r.Latency.Scenarios() {
+				if p99 := r.Latency.Latency(name).Quantile(0.99); p99 > entry.WorstP99 {
+					entry.WorstP99 = p99
+				}
+			}
+		}
+
+		if prev != nil && prev.Team == entry.Team && prev.Target == entry.Target {
+			delta := entry.Score - prev.Score
+			entry.Delta = &delta
+		}
+
+		key := entry.Team + "\x00" + entry.Target
+		if b, ok := best[key]; !ok || entry.Score > b.Score {
+			best[key] = entry
+		}
+
+		entries = append(entries, entry)
+		prev = entry
+	}
+
+	for _, entry := range best {
+		entry.Best = true
+	}
+
+	return entries
+}
+
+// 過去の実行を表にして出力
+func printHistory(w io.Writer, entries []*HistoryEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEAM\tTARGET\tID\tSTARTED\tSCORE\tDELTA\tERRORS\tWORST P99\tBEST")
+	for _, e := range entries {
+		team := e.Team
+		if team == "" {
+			team = "-"
+		}
+		score := fmt.Sprintf("%d", e.Score)
+		if e.Failed {
+			score += " (fail)"
+		}
+		delta := ""
+		if e.Delta != nil {
+			delta = fmt.Sprintf("%+d", *e.Delta)
+		}
+		best := ""
+		if e.Best {
+			best = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			team, e.Target, e.ID, e.StartedAt.Local().Format("2006-01-02 15:04:05"), score, delta, e.Errors, e.WorstP99.Round(time.Millisecond), best)
+	}
+	tw.Flush()
+}
+
+// history サブコマンド
+// 保存した過去の実行をチームと対象ごとに一覧し、スコアの推移を比べる
+func HistoryCommand(args []string) int {
+	storeSpec := DefaultStore
+	filter := ResultFilter{}
+	show := ""
+	asJSON := false
+
+	fs := newFlagSet("history")
+	fs.StringVar(&storeSpec, "store", DefaultStore, "Result store to read: file:<dir> or sqlite:<path>")
+	fs.StringVar(&filter.Team, "team", "", "Show only the runs of this team")
+	fs.StringVar(&filter.Target, "target-host", "", "Show only the runs against this target or set of targets (order and weights are ignored)")
+	fs.IntVar(&filter.Limit, "limit", DefaultHistoryLimit, "Show only this many latest runs (0 means all)")
+	fs.StringVar(&show, "show", "", "Print the full result of this run ID as JSON")
+	fs.BoolVar(&asJSON, "json", false, "Print the runs as JSON")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if storeSpec == "" {
+		fmt.Fprintln(os.Stderr, "history requires --store")
+		return ExitCodeUsage
+	}
+	// 保存した結果と同じ形にそろえて絞り込む
+	if filter.Target != "" {
+		target, err := NormalizeTargetHost(filter.Target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCodeUsage
+		}
+		filter.Target = target
+	}
+
+	store, err := OpenResultStore(storeSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCodeError
+	}
+	defer store.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if show != "" {
+		result, err := store.Get(show)
+		if errors.Is(err, ErrResultNotFound) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", show, err)
+			return ExitCodeFail
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitCodeError
+		}
+		encodeRunResult(os.Stdout, result)
+		return ExitCodeOK
+	}
+
+	results, err := store.List(filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCodeError
+	}
+
+	entries := NewHistory(results)
+	if asJSON {
+		encoder.Encode(entries)
+	} else {
+		printHistory(os.Stdout, entries)
+	}
+
+	return ExitCodeOK
+}
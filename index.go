@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+)
+
+// Set の二次インデックスが満たすインターフェース
+// Set のロックを取った状態で呼ばれる
+type setIndexer[T Model] interface {
+	insert(node *setNode[T])
+	remove(node *setNode[T])
+}
+
+// モデルから取り出したキーごとにモデルを Set と同じ並び順で保持する二次インデックス
+// Set.Add の際に Set のロック内で更新されるので、常に Set の内容と一致する
+type SetIndex[T Model, K comparable] struct {
+	set   *Set[T]
+	key   func(T) K
+	roots map[K]*setNode[T]
+	// モデルの ID ごとに追加時のキーを覚えておき、キーが変わっても取り除けるようにする
+	keys map[int]K
+}
+
+// key でモデルからキーを取り出す二次インデックスを生成して Set に登録
+// 登録時点で Set に含まれるモデルもインデックスされる
+func NewSetIndex[T Model, K comparable](set *Set[T], key func(T) K) *SetIndex[T, K] {
+	index := &SetIndex[T, K]{
+		set:   set,
+		key:   key,
+		roots: make(map[K]*setNode[T]),
+		keys:  make(map[int]K),
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for _, node := range set.dict {
+		index.insert(node)
+	}
+	set.indexes = append(set.indexes, index)
+
+	return index
+}
+
+// setIndexer.insert の実装
+func (i *SetIndex[T, K]) insert(node *setNode[T]) {
+	k := i.key(node.model)
+	i.roots[k] = insertSetNode(i.roots[k], node.detached())
+	i.keys[node.id] = k
+}
+
+// setIndexer.remove の実装
+func (i *SetIndex[T, K]) remove(node *setNode[T]) {
+	k, ok := i.keys[node.id]
+	if !ok {
+		return
+	}
+
+	if root := removeSetNode(i.roots[k], node); root != nil {
+		i.roots[k] = root
+	} else {
+		delete(i.roots, k)
+	}
+	delete(i.keys, node.id)
+}
+
+// キーに一致するモデルをスナップショットとして返す
+func (i *SetIndex[T, K]) Get(key K) SetSnapshot[T] {
+	i.set.mu.RLock()
+	defer i.set.mu.RUnlock()
+
+	return SetSnapshot[T]{root: i.roots[key]}
+}
+
+// User の Set
+type UserSet struct {
+	Set[*User]
+
+	indexOnce   sync.Once
+	accountName *SetIndex[*User, string]
+}
+
+// インデックスは初回の検索時に作成し、以降は Set.Add で更新される
+func (s *UserSet) initIndexes() {
+	s.indexOnce.Do(func() {
+		s.accountName = NewSetIndex(&s.Set, func(m *User) string { return m.AccountName })
+	})
+}
+
+// アカウント名から User を取るメソッド
+func (s *UserSet) ByAccountName(accountName string) (*User, bool) {
+	s.initIndexes()
+
+	users := s.accountName.Get(accountName)
+	if users.Len() == 0 {
+		return nil, false
+	}
+
+	return users.At(0), true
+}
+
+// Post の Set
+type PostSet struct {
+	Set[*Post]
+
+	indexOnce sync.Once
+	userID    *SetIndex[*Post, int]
+}
+
+// インデックスは初回の検索時に作成し、以降は Set.Add で更新される
+func (s *PostSet) initIndexes() {
+	s.indexOnce.Do(func() {
+		s.userID = NewSetIndex(&s.Set, func(m *Post) int { return m.UserID })
+	})
+}
+
+// User の ID からその User の Post を新しい順に返すメソッド
+func (s *PostSet) ByUserID(userID int) SetSnapshot[*Post] {
+	s.initIndexes()
+
+	return s.userID.Get(userID)
+}
+
+// Comment の Set
+type CommentSet struct {
+	Set[*Comment]
+
+	indexOnce sync.Once
+	postID    *SetIndex[*Comment, int]
+	userID    *SetIndex[*Comment, int]
+}
+
+// インデックスは初回の検索時に作成し、以降は Set.Add で更新される
+func (s *CommentSet) initIndexes() {
+	s.indexOnce.Do(func() {
+		s.postID = NewSetIndex(&s.Set, func(m *Comment) int { return m.PostID })
+		s.userID = NewSetIndex(&s.Set, func(m *Comment) int { return m.UserID })
+	})
+}
+
+// Post の ID からその Post への Comment を新しい順に返すメソッド
+func (s *CommentSet) ByPostID(postID int) SetSnapshot[*Comment] {
+	s.initIndexes()
+
+	return s.postID.Get(postID)
+}
+
+// User の ID からその User の Comment を新しい順に返すメソッド
+func (s *CommentSet) ByUserID(userID int) SetSnapshot[*Comment] {
+	s.initIndexes()
+
+	return s.userID.Get(userID)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetIndex(t *testing.T) {
+	set := &Set[*TestSetModel]{}
+	now := time.Now()
+
+	// インデックス作成前に追加したモデル
+	before := &TestSetModel{ID: 1, CreatedAt: now}
+	set.Add(before)
+
+	index := NewSetIndex(set, func(m *TestSetModel) int { return m.ID % 2 })
+
+	// インデックス作成後に追加したモデル
+	newer := &TestSetModel{ID: 3, CreatedAt: now.Add(1 * time.Second)}
+	even := &TestSetModel{ID: 2, CreatedAt: now}
+	set.Add(newer)
+	set.Add(even)
+
+	odd := index.Get(1)
+	assert.Equal(t, 2, odd.Len())
+	assert.Equal(t, newer, odd.At(0))
+	assert.Equal(t, before, odd.At(1))
+
+	assert.Equal(t, 1, index.Get(0).Len())
+	assert.Equal(t, 0, index.Get(5).Len())
+
+	// スナップショットは以降の追加の影響を受けない
+	set.Add(&TestSetModel{ID: 5, CreatedAt: now})
+	assert.Equal(t, 2, odd.Len())
+	assert.Equal(t, 3, index.Get(1).Len())
+}
+
+func TestUserSetByAccountName(t *testing.T) {
+	set := &UserSet{}
+	assert.NoError(t, set.LoadJSON("./dump/users.json"))
+
+	user, ok := set.ByAccountName("mary")
+	assert.True(t, ok)
+	assert.Equal(t, 1, user.ID)
+
+	_, ok = set.ByAccountName("isucon")
+	assert.False(t, ok)
+
+	set.Add(&User{ID: 1001, AccountName: "isucon", CreatedAt: time.Now()})
+	user, ok = set.ByAccountName("isucon")
+	assert.True(t, ok)
+	assert.Equal(t, 1001, user.ID)
+}
+
+func TestPostSetByUserID(t *testing.T) {
+	set := &PostSet{}
+	assert.NoError(t, set.LoadJSON("./dump/posts.json"))
+
+	expected := []*Post{}
+	set.ForEach(func(_ int, post *Post) {
+		if post.UserID == 753 {
+			expected = append(expected, post)
+		}
+	})
+
+	posts := set.ByUserID(753)
+	assert.Equal(t, len(expected), posts.Len())
+	posts.ForEach(func(idx int, post *Post) {
+		assert.Equal(t, expected[idx], post)
+	})
+}
+
+func TestCommentSetIndexes(t *testing.T) {
+	set := &CommentSet{}
+	now := time.Now()
+	set.Add(&Comment{ID: 1, PostID: 10, UserID: 100, CreatedAt: now})
+	set.Add(&Comment{ID: 2, PostID: 10, UserID: 200, CreatedAt: now.Add(1 * time.Second)})
+	set.Add(&Comment{ID: 3, PostID: 20, UserID: 100, CreatedAt: now})
+
+	byPost := set.ByPostID(10)
+	assert.Equal(t, 2, byPost.Len())
+	assert.Equal(t, 2, byPost.At(0).ID)
+
+	byUser := set.ByUserID(100)
+	assert.Equal(t, 2, byUser.Len())
+	assert.Equal(t, 1, byUser.At(0).ID)
+	assert.Equal(t, 3, byUser.At(1).ID)
+}
+
+func TestSetIndexReindex(t *testing.T) {
+	set := &PostSet{}
+	now := time.Now()
+	post := &Post{ID: 1, UserID: 10, CreatedAt: now}
+	set.Add(post)
+	set.Add(&Post{ID: 2, UserID: 10, CreatedAt: now})
+
+	assert.Equal(t, 2, set.ByUserID(10).Len())
+
+	// インデックスのキーを変えて Update すると付け直される
+	post.UserID = 20
+	assert.True(t, set.Update(post))
+	assert.Equal(t, 1, set.ByUserID(10).Len())
+	assert.Equal(t, post, set.ByUserID(20).At(0))
+
+	// Remove でインデックスからも消える
+	set.Remove(post.ID)
+	assert.Equal(t, 0, set.ByUserID(20).Len())
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ヒストグラムの精度
+// 値の上位 latencySubBucketBits ビットで区間を分けるので、相対誤差は 1/2^(latencySubBucketBits-1) 以下になる
+const (
+	latencySubBucketBits  = 7
+	latencySubBucketCount = 1 << latencySubBucketBits
+	latencySubBucketHalf  = latencySubBucketCount / 2
+	// マイクロ秒単位で 2^63 までを表せる区間数
+	latencyBucketCount = latencySubBucketCount + (64-latencySubBucketBits)*latencySubBucketHalf
+)
+
+// 所要時間の分布を記録するヒストグラム
+// 値をマイクロ秒単位で対数的な区間に分けて数えるので、件数によらず一定のメモリで分位点を求められる
+type LatencyHistogram struct {
+	mu     sync.Mutex
+	counts [latencyBucketCount]int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// 空のヒストグラムを生成
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{}
+}
+
+// マイクロ秒の値が入る区間の番号
+func latencyBucketIndex(v uint64) int {
+	if v < latencySubBucketCount {
+		return int(v)
+	}
+
+	shift := bits.Len64(v) - latencySubBucketBits
+	mantissa := v >> shift
+	return latencySubBucketCount + (shift-1)*latencySubBucketHalf + int(mantissa-latencySubBucketHalf)
+}
+
+// 区間に入る値の上限(マイクロ秒)
+func latencyBucketUpperBound(idx int) uint64 {
+	if idx < latencySubBucketCount {
+		return uint64(idx)
+	}
+
+	idx -= latencySubBucketCount
+	shift := idx/latencySubBucketHalf + 1
+	mantissa := uint64(idx%latencySubBucketHalf + latencySubBucketHalf)
+	return (mantissa+1)<<shift - 1
+}
+
+// 所要時間を記録
+func (h *LatencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[latencyBucketIndex(uint64(d/time.Microsecond))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// 別のヒストグラムの内容を足し合わせる
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	other.mu.Lock()
+	counts := other.counts
+	count, sum, min, max := other.count, other.sum, other.min, other.max
+	other.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, c := range counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || min < h.min {
+		h.min = min
+	}
+	if max > h.max {
+		h.max = max
+	}
+	h.count += count
+	h.sum += sum
+}
+
+// JSON で受け渡すヒストグラムの内容
+// 区間は件数のあるものだけを番号と件数の組で持つ
+type latencyHistogramJSON struct {
+	Buckets [][2]int64    `json:"buckets"`
+	Count   int64         `json:"count"`
+	Sum     time.Duration `json:"sum"`
+	Min     time.Duration `json:"min"`
+	Max     time.Duration `json:"max"`
+}
+
+// json.Marshaler インターフェースを実装
+func (h *LatencyHistogram) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v := latencyHistogramJSON{
+		Buckets: [][2]int64{},
+		Count:   h.count,
+		Sum:     h.sum,
+		Min:     h.min,
+		Max:     h.max,
+	}
+	for i, c := range h.counts {
+		if c > 0 {
+			v.Buckets = append(v.Buckets, [2]int64{int64(i), c})
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// json.Unmarshaler インターフェースを実装
+func (h *LatencyHistogram) UnmarshalJSON(data []byte) error {
+	v := latencyHistogramJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts = [latencyBucketCount]int64{}
+	for _, bucket := range v.Buckets {
+		if bucket[0] < 0 || bucket[0] >= latencyBucketCount {
+			return fmt.Errorf("latency bucket %d is out of range", bucket[0])
+		}
+		h.counts[bucket[0]] += bucket[1]
+	}
+	h.count, h.sum, h.min, h.max = v.Count, v.Sum, v.Min, v.Max
+
+	return nil
+}
+
+// 記録した件数
+func (h *LatencyHistogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.count
+}
+
+// 最大値
+func (h *LatencyHistogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.max
+}
+
+// 平均値
+func (h *LatencyHistogram) Mean() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// q (0 から 1) の分位点
+// 区間の上限を返すので、実際の値より最大で区間の幅だけ大きくなる
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := int64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			d := time.Duration(latencyBucketUpperBound(i)) * time.Microsecond
+			// 区間の上限が実際の最大値を超えないようにする
+			if d > h.max {
+				d = h.max
+			}
+			if d < h.min {
+				d = h.min
+			}
+			return d
+		}
+	}
+
+	return h.max
+}
+
+// 件数と主な分位点を1行にまとめる
+func (h *LatencyHistogram) String() string {
+	return fmt.Sprintf(
+		"count=%d mean=%s p50=%s p90=%s p99=%s p99.9=%s max=%s",
+		h.Count(),
+		h.Mean().Round(time.Microsecond),
+		h.Quantile(0.5).Round(time.Microsecond),
+		h.Quantile(0.9).Round(time.Microsecond),
+		h.Quantile(0.99).Round(time.Microsecond),
+		h.Quantile(0.999).Round(time.Microsecond),
+		h.Max().Round(time.Microsecond),
+	)
+}
+
+// シナリオごとの所要時間の記録
+// Latency は予定した開始時刻から終了までの時間で、サーバーが遅れて開始が遅れた分も含む
+// ServiceTime は実際に開始してから終了までの時間
+// Dropped は同時実行数の上限で開始できなかった回数で、所要時間には含まれないので並べて示す
+type LatencyRecorder struct {
+	mu          sync.Mutex
+	latency     map[string]*LatencyHistogram
+	serviceTime map[string]*LatencyHistogram
+	dropped     map[string]int64
+}
+
+// シナリオのヒストグラムを返す。なければ作る
+// r.mu を取得した状態で呼ぶ
+func (r *LatencyRecorder) histogramsLocked(scenario string) (*LatencyHistogram, *LatencyHistogram) {
+	if r.latency == nil {
+		r.latency = map[string]*LatencyHistogram{}
+		r.serviceTime = map[string]*LatencyHistogram{}
+	}
+	latency, ok := r.latency[scenario]
+	if !ok {
+		latency = NewLatencyHistogram()
+		r.latency[scenario] = latency
+		r.serviceTime[scenario] = NewLatencyHistogram()
+	}
+
+	return latency, r.serviceTime[scenario]
+}
+
+// シナリオの1回の実行を記録
+func (r *LatencyRecorder) Record(scenario string, intendedAt, startedAt, finishedAt time.Time) {
+	r.mu.Lock()
+	latency, serviceTime := r.histogramsLocked(scenario)
+	r.mu.Unlock()
+
+	latency.Record(finishedAt.Sub(intendedAt))
+	serviceTime.Record(finishedAt.Sub(startedAt))
+}
+
+// シナリオを予定どおりに開始できなかった1回を記録
+func (r *LatencyRecorder) RecordDropped(scenario string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.histogramsLocked(scenario)
+	if r.dropped == nil {
+		r.dropped = map[string]int64{}
+	}
+	r.dropped[scenario]++
+}
+
+// 記録のあるシナリオ名の一覧
+func (r *LatencyRecorder) Scenarios() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.latency))
+	for name := range r.latency {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// シナリオの予定時刻からの所要時間
+func (r *LatencyRecorder) Latency(scenario string) *LatencyHistogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok := r.latency[scenario]; ok {
+		return h
+	}
+	return NewLatencyHistogram()
+}
+
+// シナリオを開始できなかった回数
+func (r *LatencyRecorder) Dropped(scenario string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.dropped[scenario]
+}
+
+// 予定した開始のうち開始できなかった割合
+func (r *LatencyRecorder) DropRatio(scenario string) float64 {
+	dropped := r.Dropped(scenario)
+	if dropped == 0 {
+		return 0
+	}
+
+	return float64(dropped) / float64(r.Latency(scenario).Count()+dropped)
+}
+
+// シナリオの実際の開始時刻からの所要時間
+func (r *LatencyRecorder) ServiceTime(scenario string) *LatencyHistogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok := r.serviceTime[scenario]; ok {
+		return h
+	}
+	return NewLatencyHistogram()
+}
+
+// 別の記録の内容をシナリオごとに足し合わせる
+func (r *LatencyRecorder) Merge(other *LatencyRecorder) {
+	for _, name := range other.Scenarios() {
+		dropped := other.Dropped(name)
+
+		r.mu.Lock()
+		latency, serviceTime := r.histogramsLocked(name)
+		if dropped > 0 {
+			if r.dropped == nil {
+				r.dropped = map[string]int64{}
+			}
+			r.dropped[name] += dropped
+		}
+		r.mu.Unlock()
+
+		latency.Merge(other.Latency(name))
+		serviceTime.Merge(other.ServiceTime(name))
+	}
+}
+
+// JSON で受け渡す記録の内容
+type latencyRecorderJSON struct {
+	Latency     map[string]*LatencyHistogram `json:"latency"`
+	ServiceTime map[string]*LatencyHistogram `json:"service_time"`
+	Dropped     map[string]int64             `json:"dropped,omitempty"`
+}
+
+// json.Marshaler インターフェースを実装
+func (r *LatencyRecorder) MarshalJSON() ([]byte, error) {
+	v := latencyRecorderJSON{
+		Latency:     map[string]*LatencyHistogram{},
+		ServiceTime: map[string]*LatencyHistogram{},
+	}
+	for _, name := range r.Scenarios() {
+		v.Latency[name] = r.Latency(name)
+		v.ServiceTime[name] = r.ServiceTime(name)
+		if dropped := r.Dropped(name); dropped > 0 {
+			if v.Dropped == nil {
+				v.Dropped = map[string]int64{}
+			}
+			v.Dropped[name] = dropped
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// json.Unmarshaler インターフェースを実装
+func (r *LatencyRecorder) UnmarshalJSON(data []byte) error {
+	v := latencyRecorderJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latency = map[string]*LatencyHistogram{}
+	r.serviceTime = map[string]*LatencyHistogram{}
+	for name, latency := range v.Latency {
+		if latency == nil {
+			continue
+		}
+		serviceTime, ok := v.ServiceTime[name]
+		if !ok || serviceTime == nil {
+			serviceTime = NewLatencyHistogram()
+		}
+		r.latency[name] = latency
+		r.serviceTime[name] = serviceTime
+	}
+	r.dropped = map[string]int64{}
+	for name, dropped := range v.Dropped {
+		if _, ok := r.latency[name]; ok && dropped > 0 {
+			r.dropped[name] = dropped
+		}
+	}
+
+	return nil
+}
+
+// シナリオごとの所要時間を出力
+func (r *LatencyRecorder) Print(logger *Logger) {
+	for _, name := range r.Scenarios() {
+		latency, serviceTime := r.Latency(name), r.ServiceTime(name)
+		message := fmt.Sprintf("latency %s: %s", name, latency)
+		keyvals := []interface{}{
+			"scenario", name,
+			"p50", latency.Quantile(0.5),
+			"p99", latency.Quantile(0.99),
+			"max", latency.Max(),
+		}
+		// 開始できなかった分は所要時間に含まれず、飽和するほど p99 が良く見えるので並べて出す
+		if dropped := r.Dropped(name); dropped > 0 {
+			ratio := r.DropRatio(name)
+			message += fmt.Sprintf(" dropped=%d (%.1f%%)", dropped, ratio*100)
+			keyvals = append(keyvals, "dropped", dropped, "drop_ratio", ratio)
+		}
+		logger.Info(message, keyvals...)
+		// 開始の遅れがある場合だけ実際の処理時間も出す
+		if serviceTime.Quantile(0.99) != latency.Quantile(0.99) {
+			logger.Info(
+				fmt.Sprintf("service time %s: %s", name, serviceTime),
+				"scenario", name,
+				"p50", serviceTime.Quantile(0.5),
+				"p99", serviceTime.Quantile(0.99),
+				"max", serviceTime.Max(),
+			)
+		}
+	}
+}
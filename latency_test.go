@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	// 区間の上限は必ずその区間の値以上で、相対誤差は精度の範囲に収まる
+	for _, v := range []uint64{0, 1, 127, 128, 129, 1000, 123456, 1 << 40} {
+		upper := latencyBucketUpperBound(latencyBucketIndex(v))
+		assert.GreaterOrEqual(t, upper, v)
+		assert.LessOrEqual(t, float64(upper-v), float64(v)/latencySubBucketHalf+1)
+	}
+	assert.Less(t, latencyBucketIndex(1<<63), latencyBucketCount)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := NewLatencyHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(1000), h.Count())
+	assert.Equal(t, time.Second, h.Max())
+	assert.InDelta(t, float64(500500*time.Microsecond), float64(h.Mean()), float64(time.Microsecond))
+	assert.InEpsilon(t, float64(500*time.Millisecond), float64(h.Quantile(0.5)), 0.02)
+	assert.InEpsilon(t, float64(990*time.Millisecond), float64(h.Quantile(0.99)), 0.02)
+	assert.Equal(t, time.Second, h.Quantile(1))
+
+	other := NewLatencyHistogram()
+	other.Record(2 * time.Second)
+	h.Merge(other)
+	assert.Equal(t, int64(1001), h.Count())
+	assert.Equal(t, 2*time.Second, h.Max())
+	assert.Equal(t, 2*time.Second, h.Quantile(1))
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	r := &LatencyRecorder{}
+	intendedAt := time.Now()
+	startedAt := intendedAt.Add(300 * time.Millisecond)
+	r.Record(ScenarioOrderedIndex, intendedAt, startedAt, startedAt.Add(100*time.Millisecond))
+
+	assert.Equal(t, []string{ScenarioOrderedIndex}, r.Scenarios())
+	// 開始の遅れも所要時間に含める
+	assert.Equal(t, 400*time.Millisecond, r.Latency(ScenarioOrderedIndex).Max())
+	assert.Equal(t, 100*time.Millisecond, r.ServiceTime(ScenarioOrderedIndex).Max())
+	assert.Equal(t, int64(0), r.Latency(ScenarioPostImage).Count())
+}
+
+func TestLatencyRecorderDropped(t *testing.T) {
+	r := &LatencyRecorder{}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		r.Record(ScenarioOrderedIndex, now, now, now.Add(100*time.Millisecond))
+	}
+	r.RecordDropped(ScenarioOrderedIndex)
+	// 開始できなかっただけのシナリオも一覧に出す
+	r.RecordDropped(ScenarioPostImage)
+
+	assert.Equal(t, []string{ScenarioOrderedIndex, ScenarioPostImage}, r.Scenarios())
+	assert.Equal(t, int64(1), r.Dropped(ScenarioOrderedIndex))
+	assert.InDelta(t, 0.25, r.DropRatio(ScenarioOrderedIndex), 1e-9)
+	assert.InDelta(t, 1.0, r.DropRatio(ScenarioPostImage), 1e-9)
+	assert.Equal(t, 0.0, r.DropRatio(ScenarioLoginFailure))
+
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	decoded := &LatencyRecorder{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, int64(1), decoded.Dropped(ScenarioOrderedIndex))
+	assert.Equal(t, int64(1), decoded.Dropped(ScenarioPostImage))
+
+	decoded.Merge(r)
+	assert.Equal(t, int64(2), decoded.Dropped(ScenarioOrderedIndex))
+	assert.Equal(t, int64(6), decoded.Latency(ScenarioOrderedIndex).Count())
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/score"
+	"github.com/isucon/isucandar/worker"
+)
+
+// 負荷プロファイルが変化させる値
+const (
+	// 値を到着率(回/秒)としてシナリオを開始する
+	LoadProfileModeArrivalRate = "arrival-rate"
+	// 値を全ワーカーの合計の並列数として、シナリオの重みで配分する
+	LoadProfileModeParallelism = "parallelism"
+)
+
+// フェーズ内での値の変化のしかた
+const (
+	// Value で一定
+	LoadPatternStep = "step"
+	// From から To へ直線的に変化
+	LoadPatternRamp = "ramp"
+	// Value を基準に、 PeakStart から PeakDuration の間だけ Peak になる
+	LoadPatternSpike = "spike"
+	// Value を中心に Amplitude の振幅、 Period の周期で変化
+	LoadPatternSine = "sine"
+)
+
+// 並列数を変えるワーカーの並列数を見直す間隔
+const loadProfileControlInterval = 100 * time.Millisecond
+
+// "10s" のような文字列で指定する時間
+type ProfileDuration time.Duration
+
+// json.Unmarshaler インターフェースを実装
+func (d *ProfileDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %s", data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ProfileDuration(duration)
+	return nil
+}
+
+// json.Marshaler インターフェースを実装
+func (d ProfileDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// 負荷プロファイルの1フェーズ
+type LoadPhase struct {
+	Name     string          `json:"name"`
+	Pattern  string          `json:"pattern"`
+	Duration ProfileDuration `json:"duration"`
+
+	Value        float64         `json:"value"`
+	From         float64         `json:"from"`
+	To           float64         `json:"to"`
+	Peak         float64         `json:"peak"`
+	PeakStart    ProfileDuration `json:"peak_start"`
+	PeakDuration ProfileDuration `json:"peak_duration"`
+	Amplitude    float64         `json:"amplitude"`
+	Period       ProfileDuration `json:"period"`
+}
+
+// フェーズ開始からの経過時間での値
+func (p *LoadPhase) Level(offset time.Duration) float64 {
+	level := p.Value
+	switch p.Pattern {
+	case LoadPatternRamp:
+		level = p.From + (p.To-p.From)*float64(offset)/float64(p.Duration)
+	case LoadPatternSpike:
+		start := time.Duration(p.PeakStart)
+		if offset >= start && offset < start+time.Duration(p.PeakDuration) {
+			level = p.Peak
+		}
+	case LoadPatternSine:
+		level = p.Value + p.Amplitude*math.Sin(2*math.Pi*float64(offset)/float64(p.Period))
+	}
+
+	return math.Max(level, 0)
+}
+
+func (p *LoadPhase) validate() error {
+	if time.Duration(p.Duration) <= 0 {
+		return errors.New("duration must be positive")
+	}
+
+	switch p.Pattern {
+	case LoadPatternStep:
+		if p.Value < 0 {
+			return errors.New("value must not be negative")
+		}
+	case LoadPatternRamp:
+		if p.From < 0 || p.To < 0 {
+			return errors.New("from and to must not be negative")
+		}
+	case LoadPatternSpike:
+		if p.Value < 0 || p.Peak < 0 {
+			return errors.New("value and peak must not be negative")
+		}
+		if p.PeakStart < 0 || p.PeakDuration <= 0 || p.PeakStart+p.PeakDuration > p.Duration {
+			return errors.New("the spike must be within the phase")
+		}
+	case LoadPatternSine:
+		if p.Value < 0 || p.Amplitude < 0 {
+			return errors.New("value and amplitude must not be negative")
+		}
+		if time.Duration(p.Period) <= 0 {
+			return errors.New("period must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown pattern %q", p.Pattern)
+	}
+
+	return nil
+}
+
+// 時間とともに到着率や並列数を変える負荷プロファイル
+// --load-profile で JSON ファイルを指定する
+//
+//	{
+//	  "mode": "arrival-rate",
+//	  "phases": [
+//	    {"name": "warmup", "pattern": "ramp", "duration": "10s", "from": 5, "to": 50},
+//	    {"name": "spike", "pattern": "spike", "duration": "20s", "value": 50, "peak": 200, "peak_start": "5s", "peak_duration": "5s"},
+//	    {"name": "wave", "pattern": "sine", "duration": "30s", "value": 50, "amplitude": 30, "period": "10s"}
+//	  ]
+//	}
+type LoadProfile struct {
+	Mode   string       `json:"mode"`
+	Phases []*LoadPhase `json:"phases"`
+}
+
+// JSON ファイルから負荷プロファイルをロード
+func LoadLoadProfile(path string) (*LoadProfile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profile := &LoadProfile{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(profile); err != nil {
+		return nil, fmt.Errorf("invalid load profile %s: %v", path, err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid load profile %s: %v", path, err)
+	}
+
+	return profile, nil
+}
+
+// 設定の妥当性を検証し、フェーズ名を補う
+func (p *LoadProfile) Validate() error {
+	if p.Mode != LoadProfileModeArrivalRate && p.Mode != LoadProfileModeParallelism {
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	if len(p.Phases) == 0 {
+		return errors.New("no phases")
+	}
+
+	names := map[string]bool{}
+	for i, phase := range p.Phases {
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase-%d", i+1)
+		}
+		if names[phase.Name] {
+			return fmt.Errorf("phase %q is defined more than once", phase.Name)
+		}
+		names[phase.Name] = true
+
+		if err := phase.validate(); err != nil {
+			return fmt.Errorf("phase %q: %v", phase.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// 全フェーズの合計時間
+func (p *LoadProfile) Duration() time.Duration {
+	total := time.Duration(0)
+	for _, phase := range p.Phases {
+		total += time.Duration(phase.Duration)
+	}
+	return total
+}
+
+// 経過時間が含まれるフェーズの番号と、そのフェーズ開始からの経過時間
+// 全フェーズを過ぎた後は最後のフェーズの終わりとして扱う
+func (p *LoadProfile) PhaseAt(elapsed time.Duration) (int, time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	for i, phase := range p.Phases {
+		duration := time.Duration(phase.Duration)
+		if elapsed < duration {
+			return i, elapsed
+		}
+		elapsed -= duration
+	}
+
+	last := len(p.Phases) - 1
+	return last, time.Duration(p.Phases[last].Duration)
+}
+
+// 経過時間での値
+func (p *LoadProfile) Level(elapsed time.Duration) float64 {
+	i, offset := p.PhaseAt(elapsed)
+	return p.Phases[i].Level(offset)
+}
+
+// RateSchedule.Rate の実装
+func (p *LoadProfile) Rate(elapsed time.Duration) float64 {
+	return p.Level(elapsed)
+}
+
+// 合計の並列数をシナリオの重みで配分する
+// 並列数 0 は isucandar では無制限になるので、実行するワーカーには最低 1 を割り当てる
+func distributeParallelism(total float64, mix ScenarioMix, scenarios []string) map[string]int32 {
+	sum := 0
+	for _, name := range scenarios {
+		sum += mix.Weight(name)
+	}
+
+	parallelism := map[string]int32{}
+	for _, name := range scenarios {
+		n := int32(0)
+		if sum > 0 {
+			n = int32(math.Round(total * float64(mix.Weight(name)) / float64(sum)))
+		}
+		if n < 1 {
+			n = 1
+		}
+		parallelism[name] = n
+	}
+
+	return parallelism
+}
+
+// 並列数モードの負荷プロファイルに従ってワーカーの並列数を変える
+// ctx が終わるまでブロックする
+func (s *Scenario) controlParallelism(ctx context.Context, startedAt time.Time, mix ScenarioMix, workers map[string]*worker.Worker) {
+	scenarios := make([]string, 0, len(workers))
+	for name := range workers {
+		scenarios = append(scenarios, name)
+	}
+	sort.Strings(scenarios)
+
+	ticker := time.NewTicker(loadProfileControlInterval)
+	defer ticker.Stop()
+
+	for {
+		level := s.LoadProfile.Level(time.Since(startedAt))
+		for name, n := range distributeParallelism(level, mix, scenarios) {
+			workers[name].SetParallelism(n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// フェーズごとの結果
+type PhaseResult struct {
+	Name  string        `json:"name"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
+	// フェーズ中に加算されたスコアのタグごとの回数
+	Scores score.ScoreTable `json:"scores"`
+	// フェーズ中に発生したエラーの数
+	Errors int `json:"errors"`
+	// フェーズ中に予定された実行の所要時間
+	Latency *LatencyRecorder `json:"latency"`
+}
+
+// フェーズごとに結果を分けて記録する
+type PhaseRecorder struct {
+	mu        sync.Mutex
+	profile   *LoadProfile
+	startedAt time.Time
+	results   []*PhaseResult
+
+	// 前のフェーズの終わりでのスコアとエラーの数
+	lastScores score.ScoreTable
+	lastErrors int
+}
+
+// 負荷走行の開始時刻から PhaseRecorder を生成
+func NewPhaseRecorder(profile *LoadProfile, startedAt time.Time) *PhaseRecorder {
+	results := make([]*PhaseResult, 0, len(profile.Phases))
+	start := time.Duration(0)
+	for _, phase := range profile.Phases {
+		end := start + time.Duration(phase.Duration)
+		results = append(results, &PhaseResult{Name: phase.Name, Start: start, End: end, Latency: &LatencyRecorder{}})
+		start = end
+	}
+
+	return &PhaseRecorder{
+		profile:    profile,
+		startedAt:  startedAt,
+		results:    results,
+		lastScores: score.ScoreTable{},
+	}
+}
+
+// 予定時刻が含まれるフェーズにシナリオの所要時間を記録
+func (r *PhaseRecorder) RecordLatency(scenario string, intendedAt, startedAt, finishedAt time.Time) {
+	i, _ := r.profile.PhaseAt(intendedAt.Sub(r.startedAt))
+	r.results[i].Latency.Record(scenario, intendedAt, startedAt, finishedAt)
+}
+
+// 予定時刻が含まれるフェーズに開始できなかったシナリオを記録
+func (r *PhaseRecorder) RecordDropped(scenario string, intendedAt time.Time) {
+	i, _ := r.profile.PhaseAt(intendedAt.Sub(r.startedAt))
+	r.results[i].Latency.RecordDropped(scenario)
+}
+
+// i 番目のフェーズの終わりでのスコアとエラーを記録
+func (r *PhaseRecorder) closePhase(i int, result *isucandar.BenchmarkResult) {
+	scores := result.Score.Breakdown()
+	errors := len(result.Errors.All())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	diff := score.ScoreTable{}
+	for tag, count := range scores {
+		if d := count - r.lastScores[tag]; d > 0 {
+			diff[tag] = d
+		}
+	}
+	r.results[i].Scores = diff
+	r.results[i].Errors = errors - r.lastErrors
+	r.lastScores = scores
+	r.lastErrors = errors
+}
+
+// フェーズの終わりごとにスコアとエラーを区切る
+// ctx が終わった時点で途中のフェーズも区切って返る
+func (r *PhaseRecorder) Run(ctx context.Context, result *isucandar.BenchmarkResult) {
+	for i, phase := range r.results {
+		timer := time.NewTimer(time.Until(r.startedAt.Add(phase.End)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.closePhase(i, result)
+			return
+		case <-timer.C:
+		}
+		r.closePhase(i, result)
+	}
+}
+
+// フェーズごとの結果
+// 負荷走行中に読んでもよいよう、ロックを取ってコピーを返す。 Latency はそれ自体がロックで保護されているので共有する
+func (r *PhaseRecorder) Results() []*PhaseResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]*PhaseResult, 0, len(r.results))
+	for _, phase := range r.results {
+		scores := score.ScoreTable{}
+		for tag, count := range phase.Scores {
+			scores[tag] = count
+		}
+		results = append(results, &PhaseResult{
+			Name:    phase.Name,
+			Start:   phase.Start,
+			End:     phase.End,
+			Scores:  scores,
+			Errors:  phase.Errors,
+			Latency: phase.Latency,
+		})
+	}
+
+	return results
+}
+
+// 同じプロファイルで記録した別の結果をフェーズごとに足し合わせる
+// 分散実行でエージェントごとの結果をまとめるのに使う
+func (r *PhaseRecorder) Merge(results []*PhaseResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, other := range results {
+		if i >= len(r.results) {
+			break
+		}
+		phase := r.results[i]
+		if phase.Scores == nil {
+			phase.Scores = score.ScoreTable{}
+		}
+		for tag, count := range other.Scores {
+			phase.Scores[tag] += count
+		}
+		phase.Errors += other.Errors
+		if other.Latency != nil {
+			phase.Latency.Merge(other.Latency)
+		}
+	}
+}
+
+// フェーズごとの結果を出力
+func (r *PhaseRecorder) Print(logger *Logger) {
+	for _, phase := range r.Results() {
+		successes := int64(0)
+		tags := []string{}
+		for tag, count := range phase.Scores {
+			successes += count
+			tags = append(tags, fmt.Sprintf("%s: %d", tag, count))
+		}
+		sort.Strings(tags)
+
+		logger.Info(
+			fmt.Sprintf("phase %s [%s-%s]: successes: %d, errors: %d (%s)", phase.Name, phase.Start, phase.End, successes, phase.Errors, strings.Join(tags, ", ")),
+			"phase", phase.Name,
+			"successes", successes,
+			"errors", phase.Errors,
+		)
+		for _, name := range phase.Latency.Scenarios() {
+			latency := phase.Latency.Latency(name)
+			message := fmt.Sprintf("phase %s latency %s: %s", phase.Name, name, latency)
+			keyvals := []interface{}{
+				"phase", phase.Name,
+				"scenario", name,
+				"p50", latency.Quantile(0.5),
+				"p99", latency.Quantile(0.99),
+				"max", latency.Max(),
+			}
+			if dropped := phase.Latency.Dropped(name); dropped > 0 {
+				ratio := phase.Latency.DropRatio(name)
+				message += fmt.Sprintf(" dropped=%d (%.1f%%)", dropped, ratio*100)
+				keyvals = append(keyvals, "dropped", dropped, "drop_ratio", ratio)
+			}
+			logger.Info(message, keyvals...)
+		}
+	}
+}
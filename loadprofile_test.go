@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/score"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPhaseLevel(t *testing.T) {
+	ramp := &LoadPhase{Pattern: LoadPatternRamp, Duration: ProfileDuration(10 * time.Second), From: 10, To: 30}
+	assert.Equal(t, 10.0, ramp.Level(0))
+	assert.Equal(t, 20.0, ramp.Level(5*time.Second))
+
+	spike := &LoadPhase{
+		Pattern:      LoadPatternSpike,
+		Duration:     ProfileDuration(10 * time.Second),
+		Value:        10,
+		Peak:         100,
+		PeakStart:    ProfileDuration(2 * time.Second),
+		PeakDuration: ProfileDuration(3 * time.Second),
+	}
+	assert.Equal(t, 10.0, spike.Level(time.Second))
+	assert.Equal(t, 100.0, spike.Level(2*time.Second))
+	assert.Equal(t, 10.0, spike.Level(5*time.Second))
+
+	sine := &LoadPhase{Pattern: LoadPatternSine, Duration: ProfileDuration(10 * time.Second), Value: 10, Amplitude: 20, Period: ProfileDuration(4 * time.Second)}
+	assert.InDelta(t, 30.0, sine.Level(time.Second), 1e-9)
+	// 負の値は 0 にする
+	assert.Equal(t, 0.0, sine.Level(3*time.Second))
+}
+
+func TestLoadLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"mode": "parallelism",
+		"phases": [
+			{"name": "warmup", "pattern": "ramp", "duration": "10s", "from": 2, "to": 8},
+			{"pattern": "step", "duration": "5s", "value": 8}
+		]
+	}`), 0644))
+
+	profile, err := LoadLoadProfile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Second, profile.Duration())
+	assert.Equal(t, "phase-2", profile.Phases[1].Name)
+
+	i, offset := profile.PhaseAt(12 * time.Second)
+	assert.Equal(t, 1, i)
+	assert.Equal(t, 2*time.Second, offset)
+	assert.Equal(t, 5.0, profile.Level(5*time.Second))
+	// 全フェーズの後は最後の値のまま
+	assert.Equal(t, 8.0, profile.Rate(time.Minute))
+
+	for _, body := range []string{
+		`{"mode": "closed", "phases": [{"pattern": "step", "duration": "1s", "value": 1}]}`,
+		`{"mode": "parallelism", "phases": []}`,
+		`{"mode": "parallelism", "phases": [{"pattern": "step", "duration": 1, "value": 1}]}`,
+		`{"mode": "parallelism", "phases": [{"pattern": "square", "duration": "1s"}]}`,
+		`{"mode": "parallelism", "phases": [{"pattern": "spike", "duration": "1s", "peak": 5, "peak_start": "1s", "peak_duration": "1s"}]}`,
+		`{"mode": "parallelism", "phases": [{"pattern": "sine", "duration": "1s", "value": 5}]}`,
+		`{"mode": "parallelism", "phases": [{"name": "a", "pattern": "step", "duration": "1s"}, {"name": "a", "pattern": "step", "duration": "1s"}]}`,
+		`{"mode": "parallelism", "phases": [{"pattern": "step", "duration": "1s", "unknown": 1}]}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(body), 0644))
+		_, err := LoadLoadProfile(path)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestDistributeParallelism(t *testing.T) {
+	mix, err := ParseScenarioMix("post-image:3,ordered-index:1")
+	require.NoError(t, err)
+	scenarios := []string{ScenarioOrderedIndex, ScenarioPostImage}
+
+	assert.Equal(t, map[string]int32{ScenarioPostImage: 12, ScenarioOrderedIndex: 4}, distributeParallelism(16, mix, scenarios))
+	// 0 は無制限になるので最低 1 にする
+	assert.Equal(t, map[string]int32{ScenarioPostImage: 1, ScenarioOrderedIndex: 1}, distributeParallelism(0, mix, scenarios))
+}
+
+func TestPhaseRecorder(t *testing.T) {
+	profile := &LoadProfile{
+		Mode: LoadProfileModeParallelism,
+		Phases: []*LoadPhase{
+			{Name: "first", Pattern: LoadPatternStep, Duration: ProfileDuration(100 * time.Millisecond), Value: 1},
+			{Name: "second", Pattern: LoadPatternStep, Duration: ProfileDuration(100 * time.Millisecond), Value: 1},
+		},
+	}
+
+	var recorder *PhaseRecorder
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover())
+	require.NoError(t, err)
+	benchmark.Load(func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		startedAt := time.Now()
+		recorder = NewPhaseRecorder(profile, startedAt)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			recorder.Run(ctx, step.Result())
+		}()
+
+		for i := 0; i < 3; i++ {
+			step.AddScore(ScoreGETRoot)
+		}
+		recorder.RecordLatency(ScenarioOrderedIndex, startedAt, startedAt, startedAt.Add(time.Millisecond))
+
+		time.Sleep(150 * time.Millisecond)
+		step.AddScore(ScoreGETRoot)
+		step.AddScore(ScorePOSTRoot)
+		step.AddError(errors.New("failed"))
+		now := time.Now()
+		recorder.RecordLatency(ScenarioPostImage, now, now, now.Add(time.Millisecond))
+
+		<-done
+		return nil
+	})
+	benchmark.Start(context.Background())
+
+	results := recorder.Results()
+	require.Len(t, results, 2)
+	assert.Equal(t, "first", results[0].Name)
+	assert.Equal(t, int64(3), results[0].Scores[ScoreGETRoot])
+	assert.Equal(t, 0, results[0].Errors)
+	assert.Equal(t, []string{ScenarioOrderedIndex}, results[0].Latency.Scenarios())
+
+	assert.Equal(t, 100*time.Millisecond, results[1].Start)
+	assert.Equal(t, int64(1), results[1].Scores[ScoreGETRoot])
+	assert.Equal(t, int64(1), results[1].Scores[ScorePOSTRoot])
+	assert.Equal(t, 1, results[1].Errors)
+	assert.Equal(t, []string{ScenarioPostImage}, results[1].Latency.Scenarios())
+}
+
+func TestPhaseRecorderMerge(t *testing.T) {
+	profile := &LoadProfile{
+		Mode: LoadProfileModeParallelism,
+		Phases: []*LoadPhase{
+			{Name: "first", Pattern: LoadPatternStep, Duration: ProfileDuration(time.Second), Value: 1},
+			{Name: "second", Pattern: LoadPatternStep, Duration: ProfileDuration(time.Second), Value: 1},
+		},
+	}
+	now := time.Now()
+	latency := &LatencyRecorder{}
+	latency.Record(ScenarioOrderedIndex, now, now, now.Add(time.Millisecond))
+	agentResults := []*PhaseResult{
+		{Name: "first", Scores: score.ScoreTable{ScoreGETRoot: 2}, Errors: 1, Latency: latency},
+		{Name: "second", Scores: score.ScoreTable{ScorePOSTRoot: 1}, Latency: &LatencyRecorder{}},
+	}
+
+	// JSON で受け渡した結果をエージェントの数だけ足し合わせる
+	data, err := json.Marshal(agentResults)
+	require.NoError(t, err)
+	decoded := []*PhaseResult{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	recorder := NewPhaseRecorder(profile, now)
+	recorder.Merge(decoded)
+	recorder.Merge(agentResults)
+
+	results := recorder.Results()
+	assert.Equal(t, int64(4), results[0].Scores[ScoreGETRoot])
+	assert.Equal(t, 2, results[0].Errors)
+	assert.Equal(t, int64(2), results[0].Latency.Latency(ScenarioOrderedIndex).Count())
+	assert.Equal(t, int64(2), results[1].Scores[ScorePOSTRoot])
+	assert.Equal(t, time.Second, results[1].Start)
+}
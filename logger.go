@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ログレベル
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// fmt.Stringer インターフェースを実装
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// 文字列からログレベルを得る
+func ParseLogLevel(s string) (LogLevel, error) {
+	for _, level := range []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+// ログの出力形式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// テキスト形式の時刻の書式
+const DefaultLogTimeFormat = "15:04:05.000000"
+
+// ログの出力先と設定
+// 同じ出力先を共有する Logger.With で作った Logger 同士は設定も共有する
+type logSink struct {
+	mu         sync.Mutex
+	out        io.Writer
+	format     string
+	level      LogLevel
+	timeFormat string
+}
+
+// レベルとキー・バリュー形式のフィールドを持つロガー
+// Print 系のメソッドは log.Logger と同じように使え、 info レベルで出力する
+type Logger struct {
+	sink   *logSink
+	stream string
+	prefix string
+	fields []interface{}
+}
+
+// out に出力する Logger を生成
+// stream は JSON 形式で出力先の区別に使う名前、 prefix はテキスト形式で行頭に付ける文字列
+func NewLogger(out io.Writer, stream string, prefix string) *Logger {
+	return &Logger{
+		sink: &logSink{
+			out:        out,
+			format:     LogFormatText,
+			level:      LogLevelInfo,
+			timeFormat: DefaultLogTimeFormat,
+		},
+		stream: stream,
+		prefix: prefix,
+	}
+}
+
+// 出力先を変更
+func (l *Logger) SetOutput(out io.Writer) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.out = out
+}
+
+// 出力形式を変更
+func (l *Logger) SetFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.format = format
+	return nil
+}
+
+// 出力する最低のレベルを変更
+func (l *Logger) SetLevel(level LogLevel) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.level = level
+}
+
+// テキスト形式の時刻の書式を変更
+// 空文字列なら時刻を出力しない
+func (l *Logger) SetTimeFormat(layout string) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.timeFormat = layout
+}
+
+// 指定したレベルのログが出力されるか
+func (l *Logger) Enabled(level LogLevel) bool {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	return level >= l.sink.level
+}
+
+// フィールドを追加した Logger を返す
+// 引数はキーと値を交互に並べる
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{
+		sink:   l.sink,
+		stream: l.stream,
+		prefix: l.prefix,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LogLevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LogLevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LogLevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LogLevelError, msg, keyvals)
+}
+
+// log.Logger.Print 互換
+func (l *Logger) Print(v ...interface{}) {
+	l.log(LogLevelInfo, fmt.Sprint(v...), nil)
+}
+
+// log.Logger.Printf 互換
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.log(LogLevelInfo, fmt.Sprintf(format, v...), nil)
+}
+
+// log.Logger.Fatal 互換
+func (l *Logger) Fatal(v ...interface{}) {
+	l.log(LogLevelError, fmt.Sprint(v...), nil)
+	os.Exit(1)
+}
+
+// log.Logger.Fatalf 互換
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.log(LogLevelError, fmt.Sprintf(format, v...), nil)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level LogLevel, msg string, keyvals []interface{}) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	if level < l.sink.level {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	// 値のないキーは空にする
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+
+	now := time.Now()
+	var line []byte
+	if l.sink.format == LogFormatJSON {
+		line = l.formatJSON(now, level, msg, fields)
+	} else {
+		line = l.formatText(now, level, msg, fields)
+	}
+
+	l.sink.out.Write(line)
+}
+
+// "<prefix>15:04:05.000000 message key=value" の形式
+func (l *Logger) formatText(now time.Time, level LogLevel, msg string, fields []interface{}) []byte {
+	b := &strings.Builder{}
+	b.WriteString(l.prefix)
+	if l.sink.timeFormat != "" {
+		b.WriteString(now.Format(l.sink.timeFormat))
+		b.WriteString(" ")
+	}
+	if level != LogLevelInfo {
+		b.WriteString("[" + strings.ToUpper(level.String()) + "] ")
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(b, " %v=%s", fields[i], formatLogValue(fields[i+1]))
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		b.WriteString("\n")
+	}
+
+	return []byte(b.String())
+}
+
+// 1行1オブジェクトの JSON 形式
+func (l *Logger) formatJSON(now time.Time, level LogLevel, msg string, fields []interface{}) []byte {
+	entry := map[string]interface{}{
+		"time":   now.Format(time.RFC3339Nano),
+		"level":  level.String(),
+		"stream": l.stream,
+		"msg":    msg,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		switch v := value.(type) {
+		case error:
+			// failure.Error の Error はコードしか返さないのでメッセージ全体を出力する
+			value = fmt.Sprintf("%v", v)
+		case time.Duration:
+			// 集計しやすいようにミリ秒の数値にする
+			value = float64(v) / float64(time.Millisecond)
+		case fmt.Stringer:
+			value = v.String()
+		}
+		entry[fmt.Sprint(fields[i])] = value
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":   entry["time"],
+			"level":  entry["level"],
+			"stream": l.stream,
+			"msg":    msg,
+			"error":  err.Error(),
+		})
+	}
+
+	return append(line, '\n')
+}
+
+// テキスト形式では空白を含む値を引用符で囲む
+func formatLogValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
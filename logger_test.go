@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 時刻を出力しないテキスト形式のロガー
+func newTestLogger(out io.Writer) *Logger {
+	logger := NewLogger(out, "test", "")
+	logger.SetTimeFormat("")
+	return logger
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, level)
+
+	_, err = ParseLogLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestLoggerText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := newTestLogger(buf)
+
+	logger.Printf("score: %d", 10)
+	logger.With("user", "mary").Warn("slow request", "endpoint", "GET /", "note", "took long")
+	logger.Debug("hidden")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "score: 10", lines[0])
+	assert.Equal(t, `[WARN] slow request user=mary endpoint="GET /" note="took long"`, lines[1])
+}
+
+func TestLoggerLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := newTestLogger(buf)
+	logger.SetLevel(LogLevelDebug)
+
+	child := logger.With("user", "mary")
+	assert.True(t, child.Enabled(LogLevelDebug))
+	child.Debug("request")
+	assert.Equal(t, "[DEBUG] request user=mary\n", buf.String())
+
+	// With で作ったロガーとも設定を共有する
+	logger.SetLevel(LogLevelError)
+	assert.False(t, child.Enabled(LogLevelWarn))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(buf, "admin", "[ADMIN] ")
+	require.NoError(t, logger.SetFormat(LogFormatJSON))
+	assert.Error(t, logger.SetFormat("xml"))
+
+	logger.With("user", "mary").Info("request",
+		"endpoint", "GET /",
+		"status", 200,
+		"duration", 1500*time.Microsecond,
+		"error", errors.New("boom"),
+	)
+
+	entry := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "admin", entry["stream"])
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "mary", entry["user"])
+	assert.Equal(t, "GET /", entry["endpoint"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, 1.5, entry["duration"])
+	assert.Equal(t, "boom", entry["error"])
+	assert.NotEmpty(t, entry["time"])
+}
+
+func TestDoActionLog(t *testing.T) {
+	userAgent := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+	}))
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	defer func(logger *Logger) { AdminLogger = logger }(AdminLogger)
+	AdminLogger = newTestLogger(buf)
+	AdminLogger.SetLevel(LogLevelDebug)
+
+	option := Option{TargetHost: strings.TrimPrefix(server.URL, "http://"), RequestTimeout: time.Second}
+	ag, err := option.NewUserAgent("mary")
+	require.NoError(t, err)
+
+	_, err = GetRootAction(withAccountName(context.Background(), "mary"), ag)
+	require.NoError(t, err)
+
+	// ユーザー名はログにだけ出し、 User-Agent ヘッダーは変えない
+	assert.Contains(t, buf.String(), "user=mary")
+	assert.NotContains(t, userAgent, "mary")
+}
+
+func TestSetupLoggersLevel(t *testing.T) {
+	defer func(contestant, admin *Logger) { ContestantLogger, AdminLogger = contestant, admin }(ContestantLogger, AdminLogger)
+	ContestantLogger = newTestLogger(io.Discard)
+	AdminLogger = newTestLogger(io.Discard)
+
+	closeLogs, err := setupLoggers(Option{LogFormat: LogFormatText, LogLevel: "error"})
+	require.NoError(t, err)
+	defer closeLogs()
+
+	// スコアの出力は --log-level によらず出力する
+	assert.True(t, ContestantLogger.Enabled(LogLevelInfo))
+	assert.False(t, AdminLogger.Enabled(LogLevelInfo))
+}
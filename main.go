@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"os"
 	"time"
 
@@ -13,17 +14,46 @@ import (
 
 var (
 	// 選手向け情報を出力するロガー
-	ContestantLogger = log.New(os.Stdout, "", log.Ltime|log.Lmicroseconds)
+	ContestantLogger = NewLogger(os.Stdout, "contestant", "")
 	// 大会運営向け情報を出力するロガー
-	AdminLogger = log.New(os.Stderr, "[ADMIN] ", log.Ltime|log.Lmicroseconds)
+	AdminLogger = NewLogger(os.Stderr, "admin", "[ADMIN] ")
 )
 
+// 負荷走行の時間
+const LoadDuration = 1 * time.Minute
+
 // 各種オプションのデフォルト値
 const (
 	DefaultTargetHost               = "localhost:8080"
 	DefaultRequestTimeout           = 3 * time.Second
 	DefaultInitializeRequestTimeout = 10 * time.Second
 	DefaultExitErrorOnFail          = true
+	DefaultTimelineGracePeriod      = 3 * time.Second
+	DefaultSeed                     = 0
+	DefaultUserDistribution         = UserDistributionUniform
+	DefaultStateFile                = ""
+	DefaultContinue                 = false
+	DefaultPersistencePhase         = ""
+	DefaultPersistenceWrites        = 100
+	DefaultScoringProfileFile       = ""
+	DefaultErrorExamples            = 3
+	DefaultErrorGroups              = 20
+	DefaultErrorLog                 = ""
+	DefaultLogFormat                = LogFormatText
+	DefaultLogLevel                 = "info"
+	DefaultContestantLog            = ""
+	DefaultAdminLog                 = ""
+	DefaultDumpDir                  = "./dump"
+	DefaultScenarios                = ""
+	DefaultArrivalRate              = ""
+	DefaultMaxInFlight              = 1000
+	DefaultLoadProfile              = ""
+	DefaultThinkTime                = ThinkTimeNone
+	DefaultSessionScriptFile        = ""
+	DefaultTargetDistribution       = TargetDistributionRoundRobin
+	DefaultTeam                     = ""
+	DefaultStore                    = ""
+	DefaultResultFile               = ""
 )
 
 func init() {
@@ -31,90 +61,307 @@ func init() {
 }
 
 func main() {
+	os.Exit(RunCommandLine(os.Args[1:]))
+}
+
+// run サブコマンド
+// 負荷走行を含むベンチマーク全体を実行する
+func RunCommand(args []string) int {
 	// ベンチマークオプションの生成
 	option := Option{}
 
 	// 各フラグとベンチマークオプションのフィールドを紐付ける
-	flag.StringVar(&option.TargetHost, "target-host", DefaultTargetHost, "Benchmark target host with port")
-	flag.DurationVar(&option.RequestTimeout, "request-timeout", DefaultRequestTimeout, "Default request timeout")
-	flag.DurationVar(&option.InitializeRequestTimeout, "initialize-request-timeout", DefaultInitializeRequestTimeout, "Initialize request timeout")
-	flag.BoolVar(&option.ExitErrorOnFail, "exit-error-on-fail", DefaultExitErrorOnFail, "Exit with error if benchmark fails")
+	fs := newFlagSet("run")
+	addTargetFlags(fs, &option)
+	addPersistenceFlags(fs, &option)
+	addLoadFlags(fs, &option)
+	addStoreFlags(fs, &option)
+	addErrorFlags(fs, &option)
+	addLogFlags(fs, &option)
 
 	// コマンドライン引数のパースを実行
 	// この時点で各フィールドに値が設定されます
-	flag.Parse()
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	// ロガーの出力形式と出力先を設定
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	if err := preparePersistenceOption(&option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	if err := prepareTargetOption(&option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	if err := validateLoadOption(option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
 
 	// 現在の設定を大会運営向けロガーに出力
 	AdminLogger.Print(option)
 
-	// シナリオの生成
-	scenario := &Scenario{
-		Option: option,
+	// スコア計算の設定をロード
+	scoringProfile, err := loadScoringProfile(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
 	}
 
-	// ベンチマークの生成
-	benchmark, err := isucandar.NewBenchmark(
-		// isucandar.Benchmark はステップ内の panic を自動で recover する機能があるが、今回は利用しない
-		isucandar.WithoutPanicRecover(),
-		// 負荷試験の時間は1分間
-		isucandar.WithLoadTimeout(1*time.Minute),
-	)
+	// シナリオの生成
+	scenario, loadDuration, err := newLoadScenario(option)
 	if err != nil {
-		AdminLogger.Fatal(err)
+		AdminLogger.Print(err)
+		return ExitCodeError
 	}
 
-	// ベンチマークにシナリオを追加
-	benchmark.AddScenario(scenario)
-
-	// main で最上位の context.Context を生成
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// 結果の保存先を開く
+	store, err := openOptionStore(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	if store != nil {
+		defer store.Close()
+	}
 
 	// ベンチマーク開始
-	result := benchmark.Start(ctx)
+	startedAt := time.Now()
+	result, err := startBenchmark(context.Background(), scenario, loadDuration)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
 
-	// エラーをすべて表示
-	for _, err := range result.Errors.All() {
-		// 選手向けにエラーメッセージが表示される
-		ContestantLogger.Printf("%v", err)
-		// 大会運営向けにスタックトレース付きエラーメッセージが表示される
-		AdminLogger.Printf("%+v", err)
+	// 次回の実行で再開できるよう状態を保存
+	if option.StateFile != "" {
+		if err := scenario.SaveState(option.StateFile); err != nil {
+			AdminLogger.Printf("failed to save state: %v", err)
+		}
+	}
+
+	// エラーを出力
+	if err := reportErrors(option, result); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
 	}
 
 	// スコアをすべて表示
-	for tag, count := range result.Score.Breakdown() {
-		AdminLogger.Printf("%s: %d", tag, count)
+	reportScoreBreakdown(result)
+
+	// シナリオごとの所要時間を表示
+	scenario.Latency.Print(ContestantLogger)
+	if option.ArrivalRate != "" || (scenario.LoadProfile != nil && scenario.LoadProfile.Mode == LoadProfileModeArrivalRate) {
+		ContestantLogger.Printf("arrival: %s", &scenario.OpenLoop)
 	}
 
+	// 対象ごとのリクエスト数と所要時間を表示
+	option.Targets.Print(ContestantLogger)
+
+	// フェーズごとの結果を表示
+	// startBenchmark は Load の終了を待つので、最後のフェーズまで区切り終わっている
+	if scenario.Phases != nil {
+		scenario.Phases.Print(ContestantLogger)
+	}
+
+	// 永続化検証の結果を表示
+	if option.PersistencePhase == PersistencePhaseVerify {
+		ContestantLogger.Printf("persistence: %s", &scenario.Persistence)
+	}
+
+	// 結果を保存
+	runResult := NewRunResult(option, scoringProfile, result, &scenario.Latency, startedAt)
+	saveRunResult(store, runResult)
+	writeRunResultFile(option.ResultFile, runResult)
+
 	// スコアの表示
-	score := SumScore(result)
-	ContestantLogger.Printf("score: %d", score)
+	return reportScore(option, scoringProfile, result)
+}
+
+// 永続化検証に関するフラグ
+func addPersistenceFlags(fs *flag.FlagSet, option *Option) {
+	fs.StringVar(&option.PersistencePhase, "persistence-phase", DefaultPersistencePhase, "Run persistence check instead of the benchmark: write or verify")
+	fs.IntVar(&option.PersistenceWrites, "persistence-writes", DefaultPersistenceWrites, "Number of post and comment writes in the persistence write phase")
+}
+
+// 永続化検証のフェーズを検証し、フェーズに合わせてオプションを調整する
+// 永続化検証では書き込んだ内容を状態ファイルで受け渡す
+func preparePersistenceOption(option *Option) error {
+	switch option.PersistencePhase {
+	case "":
+	case PersistencePhaseWrite:
+		if option.StateFile == "" {
+			return errors.New("--persistence-phase=write requires --state-file")
+		}
+		// isucandar は 1 未満の回数を無制限として扱うので、書き込みが終わらなくなる
+		if option.PersistenceWrites < 1 {
+			return errors.New("--persistence-writes must be at least 1")
+		}
+	case PersistencePhaseVerify:
+		// 検証フェーズは再起動した対象を初期化せずに再開する
+		option.Continue = true
+	default:
+		return fmt.Errorf("unknown persistence phase: %s", option.PersistencePhase)
+	}
+
+	return nil
+}
+
+// 負荷走行に関するフラグ
+func addLoadFlags(fs *flag.FlagSet, option *Option) {
+	fs.BoolVar(&option.ExitErrorOnFail, "exit-error-on-fail", DefaultExitErrorOnFail, "Exit with error if benchmark fails")
+	fs.StringVar(&option.Scenarios, "scenarios", DefaultScenarios, "Scenarios to run with optional weights, e.g. post-image:4,ordered-index:2 (empty runs all)")
+	fs.StringVar(&option.ArrivalRate, "arrival-rate", DefaultArrivalRate, "Start scenarios at this rate per second regardless of responses, e.g. 50 or 10..100 (empty runs closed-loop workers)")
+	fs.IntVar(&option.MaxInFlight, "max-in-flight", DefaultMaxInFlight, "Maximum number of scenarios running at once with --arrival-rate (0 means unlimited)")
+	fs.StringVar(&option.LoadProfile, "load-profile", DefaultLoadProfile, "JSON file with phases that change the arrival rate or parallelism over time")
+	fs.StringVar(&option.ThinkTime, "think-time", DefaultThinkTime, "Pause before each user action: none, fixed:500ms, uniform:200ms:2s or exponential:1s[:10s]")
+	fs.StringVar(&option.SessionScript, "session-script", DefaultSessionScriptFile, "JSON file with the steps of the session scenario (default: login, browse, post, comment, logout)")
+	fs.StringVar(&option.ScoringProfile, "scoring-profile", DefaultScoringProfileFile, "JSON file with score weights, penalties and thresholds")
+}
+
+// 結果の保存に関するフラグ
+func addStoreFlags(fs *flag.FlagSet, option *Option) {
+	addTeamFlag(fs, option)
+	fs.StringVar(&option.Store, "store", DefaultStore, "Save the result to this store: file:<dir> or sqlite:<path> (sqlite requires -tags sqlite)")
+	fs.StringVar(&option.ResultFile, "result-file", DefaultResultFile, "Write the result as JSON to this file, e.g. for compare")
+}
+
+// 結果に記録するチーム名のフラグ
+func addTeamFlag(fs *flag.FlagSet, option *Option) {
+	fs.StringVar(&option.Team, "team", DefaultTeam, "Team name recorded with the result")
+}
+
+// Option.Store の保存先を開く。指定がなければ nil を返す
+func openOptionStore(option Option) (ResultStore, error) {
+	if option.Store == "" {
+		return nil, nil
+	}
+
+	return OpenResultStore(option.Store)
+}
+
+// 負荷走行に関するオプションの書式と組み合わせを検証
+func validateLoadOption(option Option) error {
+	if _, err := ParseScenarioMix(option.Scenarios); err != nil {
+		return err
+	}
+	if _, err := ParseThinkTime(option.ThinkTime); err != nil {
+		return err
+	}
+	if option.ArrivalRate != "" {
+		if _, err := ParseArrivalRate(option.ArrivalRate, LoadDuration); err != nil {
+			return err
+		}
+		if option.LoadProfile != "" {
+			return errors.New("--load-profile cannot be used with --arrival-rate")
+		}
+	}
+
+	return nil
+}
+
+// スコア計算の設定をロード
+func loadScoringProfile(option Option) (*ScoringProfile, error) {
+	if option.ScoringProfile == "" {
+		return DefaultScoringProfile(), nil
+	}
+
+	return LoadScoringProfile(option.ScoringProfile)
+}
+
+// 負荷プロファイルとセッションの操作をロードしてシナリオを生成
+// 負荷走行の時間はプロファイルがあれば全フェーズの合計になる
+func newLoadScenario(option Option) (*Scenario, time.Duration, error) {
+	scenario := &Scenario{Option: option}
+	loadDuration := LoadDuration
+
+	if option.LoadProfile != "" {
+		profile, err := LoadLoadProfile(option.LoadProfile)
+		if err != nil {
+			return nil, 0, err
+		}
+		scenario.LoadProfile = profile
+		loadDuration = profile.Duration()
+	}
+
+	if option.SessionScript != "" {
+		script, err := LoadSessionScript(option.SessionScript)
+		if err != nil {
+			return nil, 0, err
+		}
+		scenario.SessionScript = script
+	}
+
+	return scenario, loadDuration, nil
+}
+
+// スコアを計算して表示し、終了コードを返す
+func reportScore(option Option, profile *ScoringProfile, result *isucandar.BenchmarkResult) int {
+	summary := profile.Calculate(result)
+	if summary.Failed {
+		ContestantLogger.Printf("fail: %s", summary.Reason)
+	}
+	AdminLogger.Info(fmt.Sprintf("addition: %d, deduction: %d", summary.Addition, summary.Deduction), "addition", summary.Addition, "deduction", summary.Deduction)
+	score := summary.Total
+	ContestantLogger.Info(fmt.Sprintf("score: %d", score), "score", score)
 
 	// 0点以下(fail)ならエラーで終了
 	if option.ExitErrorOnFail && score <= 0 {
-		os.Exit(1)
+		return ExitCodeFail
 	}
+
+	return ExitCodeOK
 }
 
-func SumScore(result *isucandar.BenchmarkResult) int64 {
-	score := result.Score
-	// 各タグに倍率を設定
-	score.Set(ScoreGETRoot, 1)
-	score.Set(ScoreGETLogin, 1)
-	score.Set(ScorePOSTLogin, 2)
-	score.Set(ScorePOSTRoot, 5)
+// オプションに従って ContestantLogger と AdminLogger を設定
+// 返した関数で開いたログファイルを閉じる
+func setupLoggers(option Option) (func(), error) {
+	level, err := ParseLogLevel(option.LogLevel)
+	if err != nil {
+		return nil, err
+	}
 
-	// 加点分の合算
-	addition := score.Sum()
+	files := []*os.File{}
+	closeLogs := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
 
-	// エラーは1つ1点減点
-	deduction := len(result.Errors.All())
+	for _, l := range []struct {
+		logger *Logger
+		path   string
+	}{
+		{ContestantLogger, option.ContestantLog},
+		{AdminLogger, option.AdminLog},
+	} {
+		if err := l.logger.SetFormat(option.LogFormat); err != nil {
+			closeLogs()
+			return nil, err
+		}
 
-	// 合計(0を下回ったら0点にする)
-	sum := addition - int64(deduction)
-	if sum < 0 {
-		sum = 0
+		if l.path == "" {
+			continue
+		}
+		f, err := os.Create(l.path)
+		if err != nil {
+			closeLogs()
+			return nil, err
+		}
+		files = append(files, f)
+		l.logger.SetOutput(f)
 	}
 
-	return sum
+	// 競技者向けのスコアやエラーの出力はポータルが解析するので、レベルで絞るのは大会運営向けだけにする
+	AdminLogger.SetLevel(level)
+
+	return closeLogs, nil
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 負荷走行で実行するシナリオの名前
+const (
+	// ログインして画像を投稿する
+	ScenarioPostImage = "post-image"
+	// 誤ったパスワードでログインに失敗する
+	ScenarioLoginFailure = "login-failure"
+	// トップページの並び順を検証する
+	ScenarioOrderedIndex = "ordered-index"
+)
+
+// シナリオの区切り文字と重みの区切り文字
+const (
+	scenarioMixDelim       = ","
+	scenarioMixWeightDelim = ":"
+)
+
+// 各シナリオのデフォルトの重み
+// 重みはそのシナリオを実行するワーカーの並列数になる
+var DefaultScenarioWeights = map[string]int{
+	ScenarioPostImage:    4,
+	ScenarioLoginFailure: 2,
+	ScenarioOrderedIndex: 2,
+	ScenarioSession:      4,
+}
+
+// --scenarios を指定しなかった場合に実行するシナリオ
+// セッションは思考時間と組み合わせて使うものなので、明示した場合だけ実行する
+const DefaultScenarioMix = "post-image,login-failure,ordered-index"
+
+// 負荷走行で実行するシナリオと重みの組み合わせ
+// 含まれないシナリオは実行しない
+type ScenarioMix map[string]int
+
+// --scenarios の値から ScenarioMix を生成
+// name[:weight] をカンマで区切って並べる。重みを省略するとデフォルトの重みになる
+// 空文字列なら DefaultScenarioMix を実行する
+func ParseScenarioMix(spec string) (ScenarioMix, error) {
+	mix := ScenarioMix{}
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultScenarioMix
+	}
+
+	for _, entry := range strings.Split(spec, scenarioMixDelim) {
+		params := strings.SplitN(strings.TrimSpace(entry), scenarioMixWeightDelim, 2)
+		name := params[0]
+
+		weight, ok := DefaultScenarioWeights[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown scenario %q: available scenarios are %s", name, strings.Join(scenarioNames(), ", "))
+		}
+		if _, ok := mix[name]; ok {
+			return nil, fmt.Errorf("scenario %q is specified more than once", name)
+		}
+
+		if len(params) == 2 {
+			w, err := strconv.Atoi(params[1])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight of scenario %q: %s", name, params[1])
+			}
+			weight = w
+		}
+
+		mix[name] = weight
+	}
+
+	return mix, nil
+}
+
+// シナリオの重みを返す。実行しないシナリオは 0
+func (m ScenarioMix) Weight(name string) int {
+	return m[name]
+}
+
+// 実行するシナリオがあるか
+func (m ScenarioMix) Enabled(name string) bool {
+	return m.Weight(name) > 0
+}
+
+// fmt.Stringer インターフェースを実装
+func (m ScenarioMix) String() string {
+	entries := []string{}
+	for _, name := range scenarioNames() {
+		if m.Enabled(name) {
+			entries = append(entries, fmt.Sprintf("%s%s%d", name, scenarioMixWeightDelim, m.Weight(name)))
+		}
+	}
+
+	return strings.Join(entries, scenarioMixDelim)
+}
+
+// シナリオ名の一覧
+func scenarioNames() []string {
+	names := make([]string, 0, len(DefaultScenarioWeights))
+	for name := range DefaultScenarioWeights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScenarioMix(t *testing.T) {
+	mix, err := ParseScenarioMix("")
+	require.NoError(t, err)
+	assert.Equal(t, "login-failure:2,ordered-index:2,post-image:4", mix.String())
+
+	mix, err = ParseScenarioMix("post-image, ordered-index:8")
+	require.NoError(t, err)
+	assert.Equal(t, 4, mix.Weight(ScenarioPostImage))
+	assert.Equal(t, 8, mix.Weight(ScenarioOrderedIndex))
+	assert.False(t, mix.Enabled(ScenarioLoginFailure))
+
+	// 重み 0 で無効化できる
+	mix, err = ParseScenarioMix("ordered-index,post-image:0")
+	require.NoError(t, err)
+	assert.False(t, mix.Enabled(ScenarioPostImage))
+	assert.Equal(t, "ordered-index:2", mix.String())
+
+	for _, spec := range []string{"unknown", "post-image:-1", "post-image:x", "post-image,post-image"} {
+		_, err := ParseScenarioMix(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -20,7 +20,7 @@ type User struct {
 	CreatedAt   time.Time `json:"created_at"`
 
 	csrfToken string
-	Agent     *agent.Agent
+	Agent     *agent.Agent `json:"-"`
 }
 
 // Model.GetID の実装
@@ -41,6 +41,23 @@ func (m *User) GetCreatedAt() time.Time {
 	return m.CreatedAt
 }
 
+// 削除済み(BAN 済み)のユーザーか
+func (m *User) IsDeleted() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.DeleteFlag != 0
+}
+
+// 削除フラグのセット
+// ベンチマーク中に BAN されたユーザーを反映するのに使う
+func (m *User) SetDeleteFlag(flag int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.DeleteFlag = flag
+}
+
 // User に紐づく agent.Agent
 func (m *User) GetAgent(o Option) (*agent.Agent, error) {
 	m.mu.RLock()
@@ -54,7 +71,7 @@ func (m *User) GetAgent(o Option) (*agent.Agent, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	a, err := o.NewAgent(false)
+	a, err := o.NewUserAgent(m.AccountName)
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +80,22 @@ func (m *User) GetAgent(o Option) (*agent.Agent, error) {
 	return a, nil
 }
 
+// agent.Agent と CSRF トークンを共有しないユーザーのコピーを返す
+// ログアウトのようにサーバー側のセッションを壊す操作が、同じユーザーを選んだ他のワーカーに影響しないようにする
+func (m *User) Detach() *User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return &User{
+		ID:          m.ID,
+		AccountName: m.AccountName,
+		Password:    m.Password,
+		Authority:   m.Authority,
+		DeleteFlag:  m.DeleteFlag,
+		CreatedAt:   m.CreatedAt,
+	}
+}
+
 // ユーザーの agent.Agent を初期化
 func (m *User) ClearAgent() {
 	m.mu.Lock()
@@ -0,0 +1,30 @@
+package main
+
+// User を論理削除するメソッド
+// User の削除フラグを立て、その User の Post と、その Post への Comment 、その User の Comment を
+// 期待される結果から除いて Scenario.HiddenPosts と Scenario.HiddenComments に移す
+// 削除した User は Prepare で設定した ActiveUserPicker が以後選ばなくなる
+func (s *Scenario) SoftDeleteUser(user *User) {
+	user.SetDeleteFlag(1)
+	s.Users.Update(user)
+
+	// 削除対象はスナップショットから集めるので、ループ中に Set を変更してよい
+	s.Posts.ByUserID(user.ID).ForEach(func(_ int, post *Post) {
+		s.hideComments(s.Comments.ByPostID(post.ID))
+
+		if _, ok := s.Posts.Remove(post.ID); ok {
+			s.HiddenPosts.Add(post)
+		}
+	})
+
+	s.hideComments(s.Comments.ByUserID(user.ID))
+}
+
+// Comment を期待される結果から除いて Scenario.HiddenComments に移す
+func (s *Scenario) hideComments(comments SetSnapshot[*Comment]) {
+	comments.ForEach(func(_ int, comment *Comment) {
+		if _, ok := s.Comments.Remove(comment.ID); ok {
+			s.HiddenComments.Add(comment)
+		}
+	})
+}
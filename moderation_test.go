@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftDeleteUser(t *testing.T) {
+	s := &Scenario{}
+	now := time.Now()
+
+	banned := &User{ID: 1, AccountName: "banned", CreatedAt: now}
+	other := &User{ID: 2, AccountName: "other", CreatedAt: now}
+	s.Users.Add(banned)
+	s.Users.Add(other)
+
+	s.Posts.Add(&Post{ID: 10, UserID: banned.ID, CreatedAt: now})
+	s.Posts.Add(&Post{ID: 20, UserID: other.ID, CreatedAt: now})
+
+	// 削除されるユーザーの Post への Comment
+	s.Comments.Add(&Comment{ID: 100, PostID: 10, UserID: other.ID, CreatedAt: now})
+	// 削除されるユーザーによる Comment
+	s.Comments.Add(&Comment{ID: 200, PostID: 20, UserID: banned.ID, CreatedAt: now})
+	// 無関係な Comment
+	s.Comments.Add(&Comment{ID: 300, PostID: 20, UserID: other.ID, CreatedAt: now})
+
+	// Prepare と同じく削除前のユーザーから選ぶ
+	s.UserPicker = NewActiveUserPicker(NewUniformUserPicker(activeUsers(&s.Users)))
+
+	s.SoftDeleteUser(banned)
+
+	// 削除したユーザーは選ばれない
+	rnd := NewRandom(42)
+	for i := 0; i < 100; i++ {
+		user, ok := s.UserPicker.Pick(rnd)
+		if ok {
+			assert.Equal(t, other, user)
+		}
+	}
+
+	assert.True(t, banned.IsDeleted())
+	assert.False(t, other.IsDeleted())
+	assert.Equal(t, []*User{other}, activeUsers(&s.Users))
+
+	assert.Equal(t, 1, s.Posts.Len())
+	assert.Equal(t, 0, s.Posts.ByUserID(banned.ID).Len())
+	_, ok := s.HiddenPosts.Get(10)
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, s.Comments.Len())
+	_, ok = s.Comments.Get(300)
+	assert.True(t, ok)
+	assert.Equal(t, 2, s.HiddenComments.Len())
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+)
+
+// 到着率の指定で開始と終了を区切る文字列
+const arrivalRateRangeDelim = ".."
+
+// 開始の間隔がこれより長い間は、この間隔で到着率を確認し直す
+const arrivalRateIdleInterval = 10 * time.Millisecond
+
+// 負荷走行の開始からの経過時間に応じた到着率(回/秒)
+type RateSchedule interface {
+	Rate(elapsed time.Duration) float64
+}
+
+// 一定の到着率
+type ConstantRate float64
+
+// RateSchedule.Rate の実装
+func (r ConstantRate) Rate(time.Duration) float64 {
+	return float64(r)
+}
+
+// From から To まで Duration をかけて直線的に変化する到着率
+// Duration を過ぎた後は To のまま
+type LinearRate struct {
+	From     float64
+	To       float64
+	Duration time.Duration
+}
+
+// RateSchedule.Rate の実装
+func (r LinearRate) Rate(elapsed time.Duration) float64 {
+	if r.Duration <= 0 || elapsed >= r.Duration {
+		return r.To
+	}
+	if elapsed < 0 {
+		return r.From
+	}
+
+	return r.From + (r.To-r.From)*float64(elapsed)/float64(r.Duration)
+}
+
+// --arrival-rate の値から RateSchedule を生成
+// rate なら一定、 from..to なら duration をかけて from から to へ変化する
+func ParseArrivalRate(spec string, duration time.Duration) (RateSchedule, error) {
+	parseRate := func(s string) (float64, error) {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || rate < 0 {
+			return 0, fmt.Errorf("invalid arrival rate %q", spec)
+		}
+		return rate, nil
+	}
+
+	if from, to, ok := strings.Cut(spec, arrivalRateRangeDelim); ok {
+		fromRate, err := parseRate(from)
+		if err != nil {
+			return nil, err
+		}
+		toRate, err := parseRate(to)
+		if err != nil {
+			return nil, err
+		}
+		if fromRate == 0 && toRate == 0 {
+			return nil, fmt.Errorf("invalid arrival rate %q: rate must be positive", spec)
+		}
+		return LinearRate{From: fromRate, To: toRate, Duration: duration}, nil
+	}
+
+	rate, err := parseRate(spec)
+	if err != nil {
+		return nil, err
+	}
+	if rate == 0 {
+		return nil, fmt.Errorf("invalid arrival rate %q: rate must be positive", spec)
+	}
+	return ConstantRate(rate), nil
+}
+
+// 開始の予定時刻を RateSchedule に従って刻む
+// 到着率が低く間隔が長い間も到着率の変化に追従できるよう、一定の間隔ごとに到着率を積算する
+type arrivalClock struct {
+	schedule RateSchedule
+	start    time.Time
+	next     time.Time
+	// 前回の開始から積算した到着数
+	credit float64
+}
+
+// 時刻を進めて、進めた後の時刻を返す
+// 開始の予定時刻に達した場合は ok が true になる
+func (c *arrivalClock) tick() (time.Time, bool) {
+	at := c.next
+	rate := c.schedule.Rate(at.Sub(c.start))
+	if rate > 0 {
+		wait := time.Duration((1 - c.credit) / rate * float64(time.Second))
+		if wait <= arrivalRateIdleInterval {
+			c.credit = 0
+			c.next = at.Add(wait)
+			return c.next, true
+		}
+	}
+
+	c.credit += rate * arrivalRateIdleInterval.Seconds()
+	c.next = at.Add(arrivalRateIdleInterval)
+	return c.next, false
+}
+
+// 重みに従ってワーカーを選ぶ
+type weightedWorkers struct {
+	workers    []loadWorker
+	cumulative []int
+}
+
+func newWeightedWorkers(workers []loadWorker, mix ScenarioMix) *weightedWorkers {
+	w := &weightedWorkers{}
+	sum := 0
+	for _, worker := range workers {
+		if !mix.Enabled(worker.scenario) {
+			continue
+		}
+		sum += mix.Weight(worker.scenario)
+		w.workers = append(w.workers, worker)
+		w.cumulative = append(w.cumulative, sum)
+	}
+
+	return w
+}
+
+func (w *weightedWorkers) pick(rnd *Random) (loadWorker, bool) {
+	if len(w.workers) == 0 {
+		return loadWorker{}, false
+	}
+
+	x := rnd.Intn(w.cumulative[len(w.cumulative)-1])
+	idx := sort.SearchInts(w.cumulative, x+1)
+	return w.workers[idx], true
+}
+
+// 到着率の実行結果
+type OpenLoopReport struct {
+	// 予定どおりに開始したシナリオの回数
+	Started int64
+	// 同時実行数の上限に達したため開始できなかった回数
+	Dropped int64
+}
+
+// 実行中に読んでもよいよう、件数を atomic に読んだコピーを返す
+func (r *OpenLoopReport) Snapshot() OpenLoopReport {
+	return OpenLoopReport{
+		Started: atomic.LoadInt64(&r.Started),
+		Dropped: atomic.LoadInt64(&r.Dropped),
+	}
+}
+
+// fmt.Stringer インターフェースを実装
+func (r *OpenLoopReport) String() string {
+	return fmt.Sprintf("started: %d, dropped: %d", atomic.LoadInt64(&r.Started), atomic.LoadInt64(&r.Dropped))
+}
+
+// 前の実行の完了を待たずに、到着率に従ってシナリオを開始する負荷走行
+// 所要時間は予定した開始時刻から計るので、サーバーが遅れて開始が遅れた分も含まれる
+func (s *Scenario) LoadOpenLoop(ctx context.Context, step *isucandar.BenchmarkStep, mix ScenarioMix, schedule RateSchedule) error {
+	workers := newWeightedWorkers(s.loadWorkers(step), mix)
+	if len(workers.workers) == 0 {
+		return failure.NewError(ErrInvalidOption, errors.New("no scenarios to run"))
+	}
+
+	// シナリオの乱数生成器は並列に実行されても再現できるよう、クローズドループと同じ名前と開始の通し番号から導出する
+	sequence := int64(0)
+	pickRandom := s.Random.Derive("open-loop")
+
+	// 同時に実行中のシナリオ数の上限
+	var inFlight chan struct{}
+	if s.Option.MaxInFlight > 0 {
+		inFlight = make(chan struct{}, s.Option.MaxInFlight)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	now := time.Now()
+	clock := &arrivalClock{schedule: schedule, start: now, next: now}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		intendedAt, ok := clock.tick()
+
+		// 予定時刻まで待つ。遅れている場合は待たずに開始して遅れを取り戻す
+		if wait := time.Until(intendedAt); wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return nil
+		}
+
+		if !ok {
+			continue
+		}
+
+		w, _ := workers.pick(pickRandom)
+		sequence++
+		rnd := s.Random.Derive(fmt.Sprintf("%s-%d", w.random, sequence))
+		if inFlight != nil {
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				atomic.AddInt64(&s.OpenLoop.Dropped, 1)
+				s.recordDropped(w.scenario, intendedAt)
+				continue
+			}
+		}
+		atomic.AddInt64(&s.OpenLoop.Started, 1)
+
+		wg.Add(1)
+		go func(w loadWorker, rnd *Random, intendedAt time.Time) {
+			defer wg.Done()
+			if inFlight != nil {
+				defer func() { <-inFlight }()
+			}
+
+			user, ok := s.UserPicker.Pick(rnd)
+			if !ok {
+				return
+			}
+
+			startedAt := time.Now()
+			w.work(ctx, user, rnd)
+			// 終了時刻で打ち切られた実行は所要時間に含めない
+			if ctx.Err() == nil {
+				s.recordLatency(w.scenario, intendedAt, startedAt, time.Now())
+			}
+		}(w, rnd, intendedAt)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArrivalRate(t *testing.T) {
+	schedule, err := ParseArrivalRate("50", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, ConstantRate(50), schedule)
+
+	schedule, err = ParseArrivalRate("10..100", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, schedule.Rate(0))
+	assert.Equal(t, 55.0, schedule.Rate(30*time.Second))
+	assert.Equal(t, 100.0, schedule.Rate(2*time.Minute))
+
+	for _, spec := range []string{"", "0", "-1", "fast", "0..0", "1..x"} {
+		_, err := ParseArrivalRate(spec, time.Minute)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestArrivalClock(t *testing.T) {
+	start := time.Now()
+	clock := &arrivalClock{
+		schedule: LinearRate{From: 0, To: 10, Duration: time.Second},
+		start:    start,
+		next:     start,
+	}
+
+	// 到着率が 0 の間は開始しない
+	at, ok := clock.tick()
+	assert.False(t, ok)
+	assert.Equal(t, start.Add(arrivalRateIdleInterval), at)
+
+	ticks := 0
+	for {
+		at, ok := clock.tick()
+		if at.Sub(start) > 2*time.Second {
+			break
+		}
+		if ok {
+			ticks++
+		}
+	}
+	// 1秒かけて 10 回/秒まで上がり、その後 1 秒は 10 回/秒
+	assert.InDelta(t, 15, ticks, 3)
+}
+
+func TestWeightedWorkers(t *testing.T) {
+	mix, err := ParseScenarioMix("post-image:3,ordered-index:1")
+	require.NoError(t, err)
+
+	workers := newWeightedWorkers((&Scenario{}).loadWorkers(nil), mix)
+	require.Len(t, workers.workers, 2)
+
+	rnd := NewRandom(42)
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		w, ok := workers.pick(rnd)
+		require.True(t, ok)
+		counts[w.scenario]++
+	}
+	assert.Zero(t, counts[ScenarioLoginFailure])
+	assert.InDelta(t, 3000, counts[ScenarioPostImage], 150)
+	assert.InDelta(t, 1000, counts[ScenarioOrderedIndex], 150)
+}
+
+func TestLoadOpenLoop(t *testing.T) {
+	// 応答の遅いサーバー
+	requests := int64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	s := &Scenario{
+		Option: Option{
+			TargetHost:     strings.TrimPrefix(server.URL, "http://"),
+			RequestTimeout: 3 * time.Second,
+			ArrivalRate:    "50",
+			MaxInFlight:    2,
+		},
+		Random: NewRandom(42),
+	}
+	s.Users.Add(&User{ID: 1, AccountName: "mary", CreatedAt: time.Now()})
+	s.UserPicker = NewUniformUserPicker(activeUsers(&s.Users))
+	mix, err := ParseScenarioMix(ScenarioOrderedIndex)
+	require.NoError(t, err)
+
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover(), isucandar.WithLoadTimeout(time.Second))
+	require.NoError(t, err)
+	benchmark.Load(func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		return s.LoadOpenLoop(ctx, step, mix, ConstantRate(50))
+	})
+	benchmark.Start(context.Background())
+
+	// 応答を待たずに開始するので、同時実行数の上限を超えた分は開始できない
+	// isucandar は Load の終了を待たずに返るので、件数は atomic に読む
+	report := s.OpenLoop.Snapshot()
+	assert.Greater(t, report.Dropped, int64(0))
+	assert.Greater(t, report.Started, int64(0))
+	assert.LessOrEqual(t, report.Started+report.Dropped, int64(51))
+	assert.Greater(t, s.Latency.Latency(ScenarioOrderedIndex).Count(), int64(0))
+	assert.GreaterOrEqual(t, s.Latency.Latency(ScenarioOrderedIndex).Quantile(0.5), 100*time.Millisecond)
+	// 開始できなかった分は所要時間と並べて出せるよう記録しておく
+	assert.Greater(t, s.Latency.Dropped(ScenarioOrderedIndex), int64(0))
+}
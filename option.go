@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -14,6 +15,45 @@ type Option struct {
 	RequestTimeout           time.Duration
 	InitializeRequestTimeout time.Duration
 	ExitErrorOnFail          bool
+	TimelineGracePeriod      time.Duration
+	Seed                     int64
+	UserDistribution         string
+	StateFile                string
+	Continue                 bool
+	PersistencePhase         string
+	PersistenceWrites        int
+	ScoringProfile           string
+	ErrorExamples            int
+	ErrorGroups              int
+	ErrorLog                 string
+	LogFormat                string
+	LogLevel                 string
+	ContestantLog            string
+	AdminLog                 string
+	DumpDir                  string
+	ValidatePosts            int
+	Scenarios                string
+	ArrivalRate              string
+	MaxInFlight              int
+	LoadProfile              string
+	ThinkTime                string
+	SessionScript            string
+	TargetDistribution       string
+	Team                     string
+	Store                    string
+	ResultFile               string
+
+	// 分散実行でコーディネーターが設定する項目
+	// ユーザーを Partitions 個に分けたうちの Partition 番目だけを使い、初期化はコーディネーターが行う
+	Partition      int
+	Partitions     int
+	SkipInitialize bool
+
+	// TargetHost と TargetDistribution から生成した対象の一覧
+	// nil なら TargetHost をそのまま1台の対象として使う
+	Targets *TargetSet `json:"-"`
+	// エンドポイントごとの所要時間の記録。 nil なら記録しない
+	Endpoints *EndpointLatency `json:"-"`
 }
 
 // fmt.Stringer インターフェースを実装
@@ -25,16 +65,77 @@ func (o Option) String() string {
 		fmt.Sprintf("--request-timeout=%s", o.RequestTimeout.String()),
 		fmt.Sprintf("--initialize-request-timeout=%s", o.InitializeRequestTimeout.String()),
 		fmt.Sprintf("--exit-error-on-fail=%v", o.ExitErrorOnFail),
+		fmt.Sprintf("--timeline-grace-period=%s", o.TimelineGracePeriod.String()),
+		fmt.Sprintf("--seed=%d", o.Seed),
+		fmt.Sprintf("--user-distribution=%s", o.UserDistribution),
+		fmt.Sprintf("--state-file=%s", o.StateFile),
+		fmt.Sprintf("--continue=%v", o.Continue),
+		fmt.Sprintf("--persistence-phase=%s", o.PersistencePhase),
+		fmt.Sprintf("--persistence-writes=%d", o.PersistenceWrites),
+		fmt.Sprintf("--scoring-profile=%s", o.ScoringProfile),
+		fmt.Sprintf("--error-examples=%d", o.ErrorExamples),
+		fmt.Sprintf("--error-groups=%d", o.ErrorGroups),
+		fmt.Sprintf("--error-log=%s", o.ErrorLog),
+		fmt.Sprintf("--log-format=%s", o.LogFormat),
+		fmt.Sprintf("--log-level=%s", o.LogLevel),
+		fmt.Sprintf("--contestant-log=%s", o.ContestantLog),
+		fmt.Sprintf("--admin-log=%s", o.AdminLog),
+		fmt.Sprintf("--dump-dir=%s", o.DumpDir),
+		fmt.Sprintf("--validate-posts=%d", o.ValidatePosts),
+		fmt.Sprintf("--scenarios=%s", o.Scenarios),
+		fmt.Sprintf("--arrival-rate=%s", o.ArrivalRate),
+		fmt.Sprintf("--max-in-flight=%d", o.MaxInFlight),
+		fmt.Sprintf("--load-profile=%s", o.LoadProfile),
+		fmt.Sprintf("--think-time=%s", o.ThinkTime),
+		fmt.Sprintf("--session-script=%s", o.SessionScript),
+		fmt.Sprintf("--target-distribution=%s", o.TargetDistribution),
+		fmt.Sprintf("--team=%s", o.Team),
+		fmt.Sprintf("--store=%s", o.Store),
+		fmt.Sprintf("--result-file=%s", o.ResultFile),
 	}
 
 	return strings.Join(args, " ")
 }
 
+// ダンプファイルのパスを返す
+// Option.DumpDir が空ならデフォルトのディレクトリを使う
+func (o Option) DumpFile(name string) string {
+	dir := o.DumpDir
+	if dir == "" {
+		dir = DefaultDumpDir
+	}
+
+	return filepath.Join(dir, name)
+}
+
 // Option の内容に沿った agent.Agent を生成
+// 対象が複数ある場合、initialize 用は最初の対象、それ以外は振り分け方に従って選ぶ
 func (o Option) NewAgent(forInitialize bool) (*agent.Agent, error) {
+	return o.newAgent(o.pickTarget("", forInitialize), forInitialize)
+}
+
+// ユーザーのための agent.Agent を生成
+// sticky ではアカウント名から対象を選ぶ
+func (o Option) NewUserAgent(accountName string) (*agent.Agent, error) {
+	return o.newAgent(o.pickTarget(accountName, false), false)
+}
+
+// agent.Agent を送る対象を選ぶ
+func (o Option) pickTarget(key string, forInitialize bool) *Target {
+	if o.Targets == nil {
+		return &Target{Host: o.TargetHost}
+	}
+	if forInitialize {
+		return o.Targets.First()
+	}
+	return o.Targets.Pick(key)
+}
+
+// target に送る agent.Agent を生成
+func (o Option) newAgent(target *Target, forInitialize bool) (*agent.Agent, error) {
 	agentOptions := []agent.AgentOption{
-		// リクエストのベース URL は Option.TargetHost かつ HTTP
-		agent.WithBaseURL(fmt.Sprintf("http://%s/", o.TargetHost)),
+		// リクエストのベース URL は対象の host:port かつ HTTP
+		agent.WithBaseURL(fmt.Sprintf("http://%s/", target.Host)),
 		// agent.DefaultTransport を都度クローンして利用
 		agent.WithCloneTransport(agent.DefaultTransport),
 	}
@@ -47,5 +148,20 @@ func (o Option) NewAgent(forInitialize bool) (*agent.Agent, error) {
 	}
 
 	// オプションに従って agent.Agent を生成
-	return agent.NewAgent(agentOptions...)
+	a, err := agent.NewAgent(agentOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 対象ごとのリクエストを記録する
+	if target.Metrics != nil {
+		a.HttpClient.Transport = &targetTransport{base: a.HttpClient.Transport, metrics: target.Metrics}
+	}
+
+	// 負荷走行のリクエストをエンドポイントごとに記録する
+	if o.Endpoints != nil && !forInitialize {
+		a.HttpClient.Transport = &endpointTransport{base: a.HttpClient.Transport, latency: o.Endpoints}
+	}
+
+	return a, nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/worker"
+)
+
+// 永続化検証のフェーズ
+// write で書き込んだ内容を --state-file に保存し、対象を再起動した後に verify で残っていることを検証する
+const (
+	PersistencePhaseWrite  = "write"
+	PersistencePhaseVerify = "verify"
+)
+
+// 永続化の検証結果
+// 複数のワーカーから更新されるので sync/atomic で操作する
+type PersistenceReport struct {
+	Posts        int64
+	LostPosts    int64
+	Comments     int64
+	LostComments int64
+}
+
+// fmt.Stringer インターフェースを実装
+func (r *PersistenceReport) String() string {
+	return fmt.Sprintf(
+		"lost posts: %d/%d, lost comments: %d/%d",
+		atomic.LoadInt64(&r.LostPosts),
+		atomic.LoadInt64(&r.Posts),
+		atomic.LoadInt64(&r.LostComments),
+		atomic.LoadInt64(&r.Comments),
+	)
+}
+
+// 永続化検証の書き込みフェーズで Post と Comment を書き込む
+func (s *Scenario) LoadPersistenceWrite(ctx context.Context, step *isucandar.BenchmarkStep) error {
+	writeCase, err := worker.NewWorker(func(ctx context.Context, i int) {
+		// 並列に実行されるので、実行順によらず再現できるよう1回ごとに乱数生成器を派生させる
+		rnd := s.Random.Derive(fmt.Sprintf("persistence-%d", i))
+		if user, ok := s.UserPicker.Pick(rnd); ok {
+			s.PersistenceWrite(ctx, step, user, rnd)
+			user.ClearAgent()
+		}
+	},
+		// Option.PersistenceWrites 回繰り返す
+		worker.WithLoopCount(int32(s.Option.PersistenceWrites)),
+		// 4並列で実行
+		worker.WithMaxParallelism(4),
+	)
+	if err != nil {
+		return err
+	}
+
+	writeCase.Process(ctx)
+
+	return nil
+}
+
+// ログインして画像を投稿し、その Post にコメントするシナリオ
+func (s *Scenario) PersistenceWrite(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random) bool {
+	if !s.LoginSuccess(ctx, step, user, rnd) {
+		return false
+	}
+	// ID が分からず記録できなかった Post は検証できないのでコメントしない
+	post, ok := s.PostImage(ctx, step, user, rnd)
+	if !ok || post == nil {
+		return false
+	}
+
+	return s.PostComment(ctx, step, user, post, rnd)
+}
+
+// 永続化検証の検証フェーズで、前回書き込んだ Post と Comment がすべて残っていることを検証する
+func (s *Scenario) VerifyPersistence(ctx context.Context, step *isucandar.BenchmarkStep) error {
+	posts := s.PostWrites.Records()
+
+	// Comment を Post ごとにまとめる
+	comments := map[int][]*Comment{}
+	for _, record := range s.CommentWrites.Records() {
+		comment := record.Model
+		comments[comment.PostID] = append(comments[comment.PostID], comment)
+	}
+
+	verifyCase, err := worker.NewWorker(func(ctx context.Context, i int) {
+		post := posts[i].Model
+		s.VerifyPersistedPost(ctx, step, post, comments[post.ID])
+	},
+		// 書き込んだ Post の数だけ繰り返す
+		worker.WithLoopCount(int32(len(posts))),
+		// 4並列で実行
+		worker.WithMaxParallelism(4),
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(posts) > 0 {
+		verifyCase.Process(ctx)
+	}
+
+	return nil
+}
+
+// Post とその Post への Comment が残っていることを検証するシナリオ
+func (s *Scenario) VerifyPersistedPost(ctx context.Context, step *isucandar.BenchmarkStep, post *Post, comments []*Comment) bool {
+	atomic.AddInt64(&s.Persistence.Posts, 1)
+	atomic.AddInt64(&s.Persistence.Comments, int64(len(comments)))
+
+	// ログインしていないユーザーエージェントで確認する
+	ag, err := s.Option.NewAgent(false)
+	if err != nil {
+		step.AddError(failure.NewError(ErrCannotNewAgent, err))
+		return false
+	}
+
+	// Post のページへのリクエストを実行
+	res, err := GetPostAction(ctx, ag, post.ID)
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return false
+	}
+	defer res.Body.Close()
+
+	// 404 なら Post ごと失われている
+	if res.StatusCode == http.StatusNotFound {
+		atomic.AddInt64(&s.Persistence.LostPosts, 1)
+		atomic.AddInt64(&s.Persistence.LostComments, int64(len(comments)))
+		step.AddError(failure.NewError(
+			ErrLostPost,
+			fmt.Errorf("%s %s : post %d is lost", res.Request.Method, res.Request.URL.Path, post.ID),
+		))
+		return false
+	}
+
+	// レスポンスを検証
+	statusValidation := ValidateResponse(
+		res,
+		// ステータスコードは 200
+		WithStatusCode(200),
+	)
+	if !statusValidation.IsEmpty() {
+		// 失われたかどうか判断できないので、損失としては数えない
+		statusValidation.Add(step)
+		return false
+	}
+
+	postValidation := ValidateResponse(
+		res,
+		// Post が表示されていること
+		WithPersistedPost(post),
+	)
+	if !postValidation.IsEmpty() {
+		atomic.AddInt64(&s.Persistence.LostPosts, 1)
+		atomic.AddInt64(&s.Persistence.LostComments, int64(len(comments)))
+		postValidation.Add(step)
+		return false
+	}
+
+	commentValidation := ValidateResponse(
+		res,
+		// Comment がすべて表示されていること
+		WithPersistedComments(comments),
+	)
+	commentValidation.Add(step)
+	atomic.AddInt64(&s.Persistence.LostComments, int64(commentValidation.Count(ErrLostComment)))
+
+	// すべて残っていれば true を返す
+	return commentValidation.IsEmpty()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/stretchr/testify/assert"
+)
+
+// 再起動後の対象の代わりに、残っている Post と Comment だけを返すサーバー
+func newTestPersistenceServer(posts map[int][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/posts/"))
+		comments, ok := posts[id]
+		if err != nil || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, `<html><body><div class="isu-post" id="pid_%d"><div class="isu-post-comments">`, id)
+		for _, comment := range comments {
+			fmt.Fprintf(w, `<div class="isu-comment"><span class="isu-comment-text">%s</span></div>`, html.EscapeString(comment))
+		}
+		fmt.Fprint(w, `</div></div></body></html>`)
+	}))
+}
+
+func TestVerifyPersistence(t *testing.T) {
+	server := newTestPersistenceServer(map[int][]string{
+		// Comment が1つ失われている
+		10001: {"Hello, World #1"},
+		// Post 10002 は失われている
+		10003: {},
+	})
+	defer server.Close()
+
+	s := &Scenario{
+		Option: Option{
+			TargetHost:     strings.TrimPrefix(server.URL, "http://"),
+			RequestTimeout: 3 * time.Second,
+		},
+	}
+	now := time.Now()
+	for _, id := range []int{10001, 10002, 10003} {
+		s.PostWrites.Add(&Post{ID: id, CreatedAt: now}, now)
+	}
+	s.CommentWrites.Add(&Comment{PostID: 10001, Comment: "Hello, World #1"}, now)
+	s.CommentWrites.Add(&Comment{PostID: 10001, Comment: "Hi, Baby #2"}, now)
+	s.CommentWrites.Add(&Comment{PostID: 10002, Comment: "Oh, Image #3"}, now)
+
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover())
+	assert.NoError(t, err)
+	benchmark.Load(s.VerifyPersistence)
+
+	result := benchmark.Start(context.Background())
+
+	assert.Equal(t, int64(3), s.Persistence.Posts)
+	assert.Equal(t, int64(1), s.Persistence.LostPosts)
+	assert.Equal(t, int64(3), s.Persistence.Comments)
+	assert.Equal(t, int64(2), s.Persistence.LostComments)
+	assert.Equal(t, "lost posts: 1/3, lost comments: 2/3", s.Persistence.String())
+
+	counts := result.Errors.Count()
+	assert.Equal(t, int64(1), counts[string(ErrLostPost)])
+	assert.Equal(t, int64(1), counts[string(ErrLostComment)])
+}
+
+func TestPreparePersistenceOption(t *testing.T) {
+	option := Option{PersistencePhase: PersistencePhaseWrite, StateFile: "state.json", PersistenceWrites: DefaultPersistenceWrites}
+	assert.NoError(t, preparePersistenceOption(&option))
+
+	// 回数が 1 未満だと書き込みが終わらない
+	for _, writes := range []int{0, -1} {
+		option.PersistenceWrites = writes
+		assert.Error(t, preparePersistenceOption(&option))
+	}
+
+	option = Option{PersistencePhase: PersistencePhaseVerify}
+	assert.NoError(t, preparePersistenceOption(&option))
+	assert.True(t, option.Continue)
+}
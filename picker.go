@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ユーザーの選び方の指定
+const (
+	UserDistributionUniform = "uniform"
+	UserDistributionZipf    = "zipf"
+	UserDistributionHotSet  = "hotset"
+)
+
+// 各分布のパラメータのデフォルト値
+const (
+	DefaultZipfExponent        = 1.1
+	DefaultHotSetRatio         = 0.1
+	DefaultHotSetProbability   = 0.9
+	userDistributionParamDelim = ":"
+)
+
+// シナリオを実行するユーザーを選ぶインターフェース
+type UserPicker interface {
+	Pick(rnd *Random) (*User, bool)
+}
+
+// 有効なユーザーの中から一様にユーザーを選ぶ構造体
+type UniformUserPicker struct {
+	users []*User
+}
+
+// 有効なユーザーから UniformUserPicker を生成
+func NewUniformUserPicker(users []*User) *UniformUserPicker {
+	return &UniformUserPicker{
+		users: users,
+	}
+}
+
+// UserPicker.Pick の実装
+func (p *UniformUserPicker) Pick(rnd *Random) (*User, bool) {
+	if len(p.users) == 0 {
+		return nil, false
+	}
+
+	return p.users[rnd.Intn(len(p.users))], true
+}
+
+// 先頭のユーザーほど選ばれやすい Zipf 分布でユーザーを選ぶ構造体
+// 一部の人気ユーザーにアクセスが集中する状況を再現する
+type ZipfUserPicker struct {
+	users []*User
+	// 先頭から i 番目までのユーザーが選ばれる累積確率
+	cumulative []float64
+}
+
+// 有効なユーザーと指数から ZipfUserPicker を生成
+// 先頭から k 番目(0 始まり)のユーザーは 1/(k+1)^exponent に比例した確率で選ばれる
+func NewZipfUserPicker(users []*User, exponent float64) *ZipfUserPicker {
+	cumulative := make([]float64, len(users))
+
+	sum := 0.0
+	for k := range users {
+		sum += 1 / math.Pow(float64(k+1), exponent)
+		cumulative[k] = sum
+	}
+	for k := range cumulative {
+		cumulative[k] /= sum
+	}
+
+	return &ZipfUserPicker{
+		users:      users,
+		cumulative: cumulative,
+	}
+}
+
+// UserPicker.Pick の実装
+func (p *ZipfUserPicker) Pick(rnd *Random) (*User, bool) {
+	if len(p.users) == 0 {
+		return nil, false
+	}
+
+	x := rnd.Float64()
+	idx := sort.SearchFloat64s(p.cumulative, x)
+	if idx >= len(p.users) {
+		idx = len(p.users) - 1
+	}
+
+	return p.users[idx], true
+}
+
+// 先頭の一部のユーザー(ホットセット)に一定の割合でアクセスを集中させる構造体
+type HotSetUserPicker struct {
+	hot         []*User
+	cold        []*User
+	probability float64
+}
+
+// 有効なユーザーから HotSetUserPicker を生成
+// 先頭から ratio の割合のユーザーがホットセットになり、 probability の確率でホットセットから選ばれる
+func NewHotSetUserPicker(users []*User, ratio float64, probability float64) *HotSetUserPicker {
+	hotSize := int(math.Ceil(float64(len(users)) * ratio))
+	if hotSize > len(users) {
+		hotSize = len(users)
+	}
+
+	return &HotSetUserPicker{
+		hot:         users[:hotSize],
+		cold:        users[hotSize:],
+		probability: probability,
+	}
+}
+
+// UserPicker.Pick の実装
+func (p *HotSetUserPicker) Pick(rnd *Random) (*User, bool) {
+	users := p.cold
+	if len(p.cold) == 0 || (len(p.hot) > 0 && rnd.Float64() < p.probability) {
+		users = p.hot
+	}
+
+	if len(users) == 0 {
+		return nil, false
+	}
+
+	return users[rnd.Intn(len(users))], true
+}
+
+// 論理削除されたユーザーを引いたときに選び直す上限
+const activeUserPickerRetries = 10
+
+// ベンチマーク中に論理削除されたユーザーを選ばないよう、別の UserPicker を包む構造体
+// 元の分布を保ったまま、削除されたユーザーを引いたら選び直す
+type ActiveUserPicker struct {
+	picker UserPicker
+}
+
+// UserPicker を包んで ActiveUserPicker を生成
+func NewActiveUserPicker(picker UserPicker) *ActiveUserPicker {
+	return &ActiveUserPicker{
+		picker: picker,
+	}
+}
+
+// UserPicker.Pick の実装
+func (p *ActiveUserPicker) Pick(rnd *Random) (*User, bool) {
+	for i := 0; i < activeUserPickerRetries; i++ {
+		user, ok := p.picker.Pick(rnd)
+		if !ok {
+			return nil, false
+		}
+		if !user.IsDeleted() {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+// UserSet から削除されていないユーザーだけを Set の並び順で取り出す
+func activeUsers(set *UserSet) []*User {
+	users := []*User{}
+	set.ForEach(func(_ int, user *User) {
+		if !user.IsDeleted() {
+			users = append(users, user)
+		}
+	})
+
+	return users
+}
+
+// ユーザーを n 個に分けたうちの i 番目を返す
+// n が 1 以下なら分けずにそのまま返す
+func partitionUsers(users []*User, i int, n int) []*User {
+	if n <= 1 {
+		return users
+	}
+
+	partition := []*User{}
+	for idx, user := range users {
+		if idx%n == i {
+			partition = append(partition, user)
+		}
+	}
+
+	return partition
+}
+
+// --user-distribution の値から UserPicker を生成
+// uniform, zipf[:exponent], hotset[:ratio[:probability]] の形式を受け付ける
+func NewUserPicker(distribution string, users []*User) (UserPicker, error) {
+	params := strings.Split(distribution, userDistributionParamDelim)
+	name := params[0]
+	values := make([]float64, 0, len(params)-1)
+	for _, param := range params[1:] {
+		value, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user distribution parameter %q: %v", distribution, err)
+		}
+		values = append(values, value)
+	}
+
+	switch name {
+	case UserDistributionUniform:
+		if len(values) != 0 {
+			return nil, fmt.Errorf("invalid user distribution %q: uniform takes no parameters", distribution)
+		}
+		return NewUniformUserPicker(users), nil
+	case UserDistributionZipf:
+		exponent := DefaultZipfExponent
+		switch len(values) {
+		case 0:
+		case 1:
+			exponent = values[0]
+		default:
+			return nil, fmt.Errorf("invalid user distribution %q: zipf takes at most 1 parameter", distribution)
+		}
+		if exponent <= 0 {
+			return nil, fmt.Errorf("invalid user distribution %q: exponent must be positive", distribution)
+		}
+		return NewZipfUserPicker(users, exponent), nil
+	case UserDistributionHotSet:
+		ratio, probability := DefaultHotSetRatio, DefaultHotSetProbability
+		switch len(values) {
+		case 0:
+		case 1:
+			ratio = values[0]
+		case 2:
+			ratio, probability = values[0], values[1]
+		default:
+			return nil, fmt.Errorf("invalid user distribution %q: hotset takes at most 2 parameters", distribution)
+		}
+		if ratio <= 0 || ratio > 1 || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("invalid user distribution %q: ratio must be in (0, 1] and probability in [0, 1]", distribution)
+		}
+		return NewHotSetUserPicker(users, ratio, probability), nil
+	}
+
+	return nil, fmt.Errorf("unknown user distribution %q", distribution)
+}
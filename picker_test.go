@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func generateTestUsers(count int) []*User {
+	users := make([]*User, 0, count)
+	for i := 1; i <= count; i++ {
+		users = append(users, &User{ID: i})
+	}
+	return users
+}
+
+func countPicks(picker UserPicker, times int) map[int]int {
+	rnd := NewRandom(1)
+	counts := map[int]int{}
+	for i := 0; i < times; i++ {
+		user, ok := picker.Pick(rnd)
+		if ok {
+			counts[user.ID]++
+		}
+	}
+	return counts
+}
+
+func TestActiveUsers(t *testing.T) {
+	set := &UserSet{}
+	for _, user := range generateTestUsers(3) {
+		set.Add(user)
+	}
+	deleted, _ := set.Get(2)
+	deleted.DeleteFlag = 1
+
+	users := activeUsers(set)
+	assert.Len(t, users, 2)
+	for _, user := range users {
+		assert.NotEqual(t, 2, user.ID)
+	}
+}
+
+func TestUniformUserPicker(t *testing.T) {
+	counts := countPicks(NewUniformUserPicker(generateTestUsers(5)), 5000)
+
+	// 最後のユーザーも含めてすべてのユーザーが選ばれる
+	assert.Len(t, counts, 5)
+	for id := 1; id <= 5; id++ {
+		assert.InDelta(t, 1000, counts[id], 150)
+	}
+
+	_, ok := NewUniformUserPicker([]*User{}).Pick(NewRandom(1))
+	assert.False(t, ok)
+}
+
+func TestZipfUserPicker(t *testing.T) {
+	counts := countPicks(NewZipfUserPicker(generateTestUsers(100), 1.1), 10000)
+
+	// 先頭のユーザーほど多く選ばれる
+	assert.Greater(t, counts[1], counts[2])
+	assert.Greater(t, counts[2], counts[10])
+	assert.Greater(t, counts[1], 10000/100*5)
+}
+
+func TestHotSetUserPicker(t *testing.T) {
+	counts := countPicks(NewHotSetUserPicker(generateTestUsers(100), 0.1, 0.9), 10000)
+
+	hot := 0
+	for id := 1; id <= 10; id++ {
+		hot += counts[id]
+	}
+	assert.InDelta(t, 9000, hot, 300)
+}
+
+func TestNewUserPicker(t *testing.T) {
+	users := generateTestUsers(10)
+
+	for _, distribution := range []string{"uniform", "zipf", "zipf:1.5", "hotset", "hotset:0.2", "hotset:0.2:0.5"} {
+		picker, err := NewUserPicker(distribution, users)
+		assert.NoError(t, err, distribution)
+		assert.NotNil(t, picker, distribution)
+	}
+
+	for _, distribution := range []string{"", "unknown", "uniform:1", "zipf:0", "zipf:a", "hotset:0", "hotset:0.1:2", "hotset:0.1:0.1:0.1"} {
+		_, err := NewUserPicker(distribution, users)
+		assert.Error(t, err, distribution)
+	}
+}
@@ -2,25 +2,84 @@ package main
 
 import (
 	"bytes"
+	"hash/fnv"
 	"image"
 	"image/color"
 	"image/png"
 	"math/rand"
+	"sync"
 )
 
-func randomColor() color.RGBA {
-	c := uint8(rand.Intn(255))
+// シードから決定的に値を生成する乱数生成器
+// math/rand.Rand は goroutine セーフではないためロックで保護する
+type Random struct {
+	mu   sync.Mutex
+	seed int64
+	rand *rand.Rand
+}
+
+// シードを指定して Random を生成
+func NewRandom(seed int64) *Random {
+	return &Random{
+		seed: seed,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Random の生成に使ったシードを返す
+func (r *Random) Seed() int64 {
+	return r.seed
+}
+
+// 名前ごとに独立した Random を派生させる
+// 同じシードと名前からは常に同じ系列の Random が得られるので、ワーカーごとに使い分ける
+func (r *Random) Derive(name string) *Random {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+
+	return NewRandom(r.seed ^ int64(hash.Sum64()))
+}
+
+// [0, n) の乱数を返す
+func (r *Random) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rand.Intn(n)
+}
+
+// 非負の int64 の乱数を返す
+func (r *Random) Int63() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rand.Int63()
+}
+
+// [0.0, 1.0) の乱数を返す
+func (r *Random) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rand.Float64()
+}
+
+func randomColor(rnd *rand.Rand) color.RGBA {
+	c := uint8(rnd.Intn(255))
 	return color.RGBA{c, c, c, 255}
 }
 
 // ランダムな画像の生成
-func randomImage() ([]byte, error) {
+func randomImage(r *Random) ([]byte, error) {
+	// ピクセルごとにロックを取らないよう、画像1枚分の乱数生成器を派生させる
+	rnd := rand.New(rand.NewSource(r.Int63()))
+
 	size := image.Rect(0, 0, 640, 480)
 	img := image.NewRGBA(size)
 
 	for x := 0; x < size.Dx(); x++ {
 		for y := 0; y < size.Dy(); y++ {
-			img.SetRGBA(x, y, randomColor())
+			img.SetRGBA(x, y, randomColor(rnd))
 		}
 	}
 
@@ -49,9 +108,9 @@ var (
 	}
 )
 
-func randomText() string {
-	prefix := randomStringPrefixes[rand.Intn(len(randomStringPrefixes))]
-	suffix := randomStringSuffixes[rand.Intn(len(randomStringSuffixes))]
+func randomText(r *Random) string {
+	prefix := randomStringPrefixes[r.Intn(len(randomStringPrefixes))]
+	suffix := randomStringSuffixes[r.Intn(len(randomStringSuffixes))]
 
 	return prefix + ", " + suffix
 }
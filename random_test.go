@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomDeterministic(t *testing.T) {
+	a := NewRandom(42).Derive("success")
+	b := NewRandom(42).Derive("success")
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, a.Intn(1000), b.Intn(1000))
+		assert.Equal(t, randomText(a), randomText(b))
+	}
+
+	imgA, err := randomImage(a)
+	assert.NoError(t, err)
+	imgB, err := randomImage(b)
+	assert.NoError(t, err)
+	assert.Equal(t, imgA, imgB)
+}
+
+func TestRandomDerive(t *testing.T) {
+	root := NewRandom(42)
+
+	// 名前が違えば別の系列になる
+	assert.NotEqual(t, root.Derive("success").Seed(), root.Derive("failure").Seed())
+	// シードが違えば別の系列になる
+	assert.NotEqual(t, root.Derive("success").Seed(), NewRandom(43).Derive("success").Seed())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+)
+
+// リクエスト自体が失敗したときのエラーの分類
+// ErrInvalidRequest の内側にいずれかのコードを付けて、分類ごとに数えたり減点を変えたりできるようにする
+const (
+	ErrRequestTimeout  failure.StringCode = "request-timeout"
+	ErrConnection      failure.StringCode = "connection"
+	ErrRequestCanceled failure.StringCode = "request-canceled"
+	ErrProtocol        failure.StringCode = "protocol"
+)
+
+// リクエストエラーの分類の一覧
+var RequestErrorClasses = []failure.StringCode{
+	ErrRequestTimeout,
+	ErrConnection,
+	ErrRequestCanceled,
+	ErrProtocol,
+}
+
+// リクエストのエラーを分類して、分類のコードを付けたエラーを返す
+func ClassifyRequestError(err error) error {
+	return failure.NewError(requestErrorClass(err), err)
+}
+
+func requestErrorClass(err error) failure.StringCode {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrRequestCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrRequestTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrRequestTimeout
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrConnection
+	}
+
+	// 名前解決や接続の確立に失敗したもの
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ErrConnection
+	}
+
+	// それ以外は不正な HTTP レスポンスなど
+	return ErrProtocol
+}
+
+// リクエストのエラーを分類して step に追加する
+// ベンチマーク自身が負荷試験を終了したことで中断されたリクエストのエラーは無視する
+func AddRequestError(ctx context.Context, step *isucandar.BenchmarkStep, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	step.AddError(failure.NewError(ErrInvalidRequest, ClassifyRequestError(err)))
+}
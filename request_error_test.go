@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/agent"
+	"github.com/isucon/isucandar/failure"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAgent(t *testing.T, baseURL string, timeout time.Duration) *agent.Agent {
+	ag, err := agent.NewAgent(
+		agent.WithBaseURL(baseURL),
+		agent.WithCloneTransport(agent.DefaultTransport),
+		agent.WithTimeout(timeout),
+	)
+	assert.NoError(t, err)
+	return ag
+}
+
+func TestClassifyRequestErrorTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	_, err := GetRootAction(context.Background(), newTestAgent(t, server.URL, 10*time.Millisecond))
+	assert.True(t, failure.IsCode(ClassifyRequestError(err), ErrRequestTimeout))
+}
+
+func TestClassifyRequestErrorConnection(t *testing.T) {
+	// 使われていないポートを確保してすぐに閉じる
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = GetRootAction(context.Background(), newTestAgent(t, "http://"+addr, time.Second))
+	assert.True(t, failure.IsCode(ClassifyRequestError(err), ErrConnection))
+}
+
+func TestClassifyRequestErrorProtocol(t *testing.T) {
+	// HTTP ではない応答を返すサーバー
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			conn.Read(buf)
+			conn.Write([]byte(strings.Repeat("NOT HTTP\r\n", 4)))
+			conn.Close()
+		}
+	}()
+
+	_, err = GetRootAction(context.Background(), newTestAgent(t, "http://"+listener.Addr().String(), time.Second))
+	assert.True(t, failure.IsCode(ClassifyRequestError(err), ErrProtocol))
+}
+
+func TestClassifyRequestErrorCanceled(t *testing.T) {
+	err := ClassifyRequestError(&net.OpError{Op: "dial", Err: context.Canceled})
+	assert.True(t, failure.IsCode(err, ErrRequestCanceled))
+}
+
+func TestAddRequestErrorIgnoresShutdown(t *testing.T) {
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover())
+	assert.NoError(t, err)
+
+	benchmark.Load(func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		AddRequestError(ctx, step, errors.New("unexpected response"))
+
+		// 負荷試験の終了後に中断されたリクエスト
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		AddRequestError(canceled, step, context.Canceled)
+		return nil
+	})
+
+	result := benchmark.Start(context.Background())
+	counts := result.Errors.Count()
+	assert.Equal(t, int64(1), counts[string(ErrInvalidRequest)])
+	assert.Equal(t, int64(1), counts[string(ErrProtocol)])
+	assert.Equal(t, int64(0), counts[string(ErrRequestCanceled)])
+}
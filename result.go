@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/score"
+)
+
+// 負荷走行の途中経過を通知する間隔
+const ProgressInterval = 1 * time.Second
+
+// 負荷走行の途中経過
+type Progress struct {
+	// 負荷走行を始めてからの秒数
+	Elapsed float64          `json:"elapsed"`
+	Scores  score.ScoreTable `json:"scores"`
+	Errors  int              `json:"errors"`
+}
+
+// ctx が終了するまで ProgressInterval ごとに途中経過を通知する
+func reportProgress(ctx context.Context, startedAt time.Time, result *isucandar.BenchmarkResult, notify func(Progress)) {
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		notify(Progress{
+			Elapsed: time.Since(startedAt).Seconds(),
+			Scores:  result.Score.Breakdown(),
+			Errors:  len(result.Errors.All()),
+		})
+	}
+}
+
+// ベンチマーク1回分の結果
+// 標準出力を解析しなくても扱えるよう JSON にする
+type RunResult struct {
+	// 保存先で採番する ID
+	ID string `json:"id,omitempty"`
+	// 実行したチームと対象
+	// 対象は TargetSet.Key の形にそろえるので、指定した順や重みによらず同じ組み合わせなら同じ値になる
+	Team   string `json:"team,omitempty"`
+	Target string `json:"target"`
+	// 実行したときのオプション
+	Option     string    `json:"option"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	Score     ScoreSummary     `json:"score"`
+	Breakdown score.ScoreTable `json:"breakdown"`
+	Errors    *ErrorSummary    `json:"errors"`
+	Latency   *LatencyRecorder `json:"latency"`
+	Endpoints *EndpointLatency `json:"endpoints,omitempty"`
+}
+
+// ベンチマーク結果からスコアを計算して RunResult を生成
+func NewRunResult(option Option, profile *ScoringProfile, result *isucandar.BenchmarkResult, latency *LatencyRecorder, startedAt time.Time) *RunResult {
+	target := option.TargetHost
+	if option.Targets != nil {
+		target = option.Targets.Key()
+	}
+
+	return &RunResult{
+		Team:       option.Team,
+		Target:     target,
+		Option:     option.String(),
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+		Score:      profile.Calculate(result),
+		Breakdown:  result.Score.Breakdown(),
+		Errors:     SummarizeErrors(result.Errors.All(), option.ErrorExamples),
+		Latency:    latency,
+		Endpoints:  option.Endpoints,
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
-	"math/rand"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/isucon/isucandar"
 	"github.com/isucon/isucandar/failure"
@@ -14,17 +19,21 @@ import (
 // シナリオレベルで発生するエラーコードの定義
 const (
 	ErrFailedLoadJSON  failure.StringCode = "load-json"
+	ErrFailedLoadState failure.StringCode = "load-state"
 	ErrCannotNewAgent  failure.StringCode = "agent"
 	ErrInvalidRequest  failure.StringCode = "request"
 	ErrInvalidResponse failure.StringCode = "response"
+	ErrInvalidOption   failure.StringCode = "option"
 )
 
 // シナリオで発生するスコアのタグ
 const (
-	ScoreGETLogin  score.ScoreTag = "GET /login"
-	ScorePOSTLogin score.ScoreTag = "POST /login"
-	ScoreGETRoot   score.ScoreTag = "GET /"
-	ScorePOSTRoot  score.ScoreTag = "POST /"
+	ScoreGETLogin    score.ScoreTag = "GET /login"
+	ScorePOSTLogin   score.ScoreTag = "POST /login"
+	ScoreGETRoot     score.ScoreTag = "GET /"
+	ScorePOSTRoot    score.ScoreTag = "POST /"
+	ScoreGETPost     score.ScoreTag = "GET /posts/:id"
+	ScorePOSTComment score.ScoreTag = "POST /comment"
 )
 
 // オプションと全データを持つシナリオ構造体
@@ -33,54 +42,209 @@ type Scenario struct {
 	Users    UserSet
 	Posts    PostSet
 	Comments CommentSet
+
+	// ベンチマーカーが投稿した Post と Comment の記録
+	PostWrites    WriteLog[*Post]
+	CommentWrites WriteLog[*Comment]
+
+	// 永続化の検証結果
+	Persistence PersistenceReport
+
+	// シナリオごとの所要時間
+	Latency LatencyRecorder
+	// 到着率を指定した負荷走行の実行結果
+	OpenLoop OpenLoopReport
+
+	// 時間とともに負荷を変える場合の設定と、フェーズごとの結果
+	LoadProfile *LoadProfile
+	Phases      *PhaseRecorder
+
+	// 操作の間に挟む思考時間。 nil なら待たない
+	ThinkTime ThinkTime
+	// セッションのシナリオで実行する操作。 nil なら DefaultSessionScript
+	SessionScript *SessionScript
+
+	// 負荷走行の途中経過を受け取る関数。 nil なら通知しない
+	Progress func(Progress)
+
+	// 分散実行で負荷走行を揃えて始める時刻
+	// ゼロ値なら Prepare の後すぐに始める
+	StartAt time.Time
+	// Prepare が StartAt を過ぎてから終わった場合の遅れ
+	LateStart time.Duration
+
+	// Option.Seed から生成した乱数生成器
+	// ワーカーごとに Random.Derive して使う
+	Random *Random
+
+	// シナリオを実行するユーザーを選ぶ
+	UserPicker UserPicker
+
+	// 論理削除されたユーザーの Post と Comment
+	// 期待される結果からは除くが、データとしては保持しておく
+	HiddenPosts    PostSet
+	HiddenComments CommentSet
 }
 
 // isucandar.PrepeareScenario を満たすメソッド
 // isucandar.Benchmark の Prepare ステップで実行される
 func (s *Scenario) Prepare(ctx context.Context, step *isucandar.BenchmarkStep) error {
-	// User のダンプデータをロード
-	if err := s.Users.LoadJSON("./dump/users.json"); err != nil {
-		return failure.NewError(ErrFailedLoadJSON, err)
+	// シードから乱数生成器を生成
+	if s.Random == nil {
+		s.Random = NewRandom(s.Option.Seed)
+		// 分散実行では同じシードからプロセスごとに別の乱数を使う
+		if s.Option.Partitions > 1 {
+			s.Random = s.Random.Derive(fmt.Sprintf("partition-%d", s.Option.Partition))
+		}
+	}
+
+	if s.Option.Continue {
+		// 前回の実行で保存した状態から再開
+		if err := s.LoadState(s.Option.StateFile); err != nil {
+			return failure.NewError(ErrFailedLoadState, err)
+		}
+	} else {
+		// User のダンプデータをロード
+		if err := s.Users.LoadJSON(s.Option.DumpFile("users.json")); err != nil {
+			return failure.NewError(ErrFailedLoadJSON, err)
+		}
+
+		// Post のダンプデータをロード
+		if err := s.Posts.LoadJSON(s.Option.DumpFile("posts.json")); err != nil {
+			return failure.NewError(ErrFailedLoadJSON, err)
+		}
+
+		// Comment のダンプデータをロード
+		if err := s.Comments.LoadJSON(s.Option.DumpFile("comments.json")); err != nil {
+			return failure.NewError(ErrFailedLoadJSON, err)
+		}
+	}
+
+	// 削除されていないユーザーから Option.UserDistribution に従って選ぶ
+	// 分散実行では他のプロセスとユーザーが重ならないよう自分の分だけを使う
+	// ベンチマーク中に削除されたユーザーは ActiveUserPicker が選び直す
+	users := partitionUsers(activeUsers(&s.Users), s.Option.Partition, s.Option.Partitions)
+	picker, err := NewUserPicker(s.Option.UserDistribution, users)
+	if err != nil {
+		return failure.NewError(ErrInvalidOption, err)
 	}
+	s.UserPicker = NewActiveUserPicker(picker)
 
-	// Post のダンプデータをロード
-	if err := s.Posts.LoadJSON("./dump/posts.json"); err != nil {
-		return failure.NewError(ErrFailedLoadJSON, err)
+	// 操作の間に挟む思考時間
+	thinkTime, err := ParseThinkTime(s.Option.ThinkTime)
+	if err != nil {
+		return failure.NewError(ErrInvalidOption, err)
 	}
+	s.ThinkTime = thinkTime
 
-	// Comment のダンプデータをロード
-	if err := s.Comments.LoadJSON("./dump/comments.json"); err != nil {
-		return failure.NewError(ErrFailedLoadJSON, err)
+	// 再開時は前回の書き込みが残っていることを検証したいので初期化しない
+	// 分散実行ではコーディネーターが初期化済み
+	if !s.Option.Continue && !s.Option.SkipInitialize {
+		validation, err := initializeTarget(ctx, s.Option)
+		if err != nil {
+			return err
+		}
+		validation.Add(step)
+	}
+
+	// 開始時刻が決まっていればそれまで待つ
+	// 準備が間に合わなかった場合は遅れを記録してすぐに始める
+	if late := time.Since(s.StartAt); !s.StartAt.IsZero() && late > 0 {
+		s.LateStart = late
+		AdminLogger.Warn(fmt.Sprintf("prepared %s after the start time", late), "late", late)
+	} else if !s.StartAt.IsZero() {
+		timer := time.NewTimer(time.Until(s.StartAt))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
 
+	return nil
+}
+
+// GET /initialize で対象を初期化し、レスポンスの検証結果を返す
+func initializeTarget(ctx context.Context, option Option) (ValidationError, error) {
 	// GET /initialize 用ユーザーエージェントの生成
-	ag, err := s.Option.NewAgent(true)
+	ag, err := option.NewAgent(true)
 	if err != nil {
-		return failure.NewError(ErrCannotNewAgent, err)
+		return ValidationError{}, failure.NewError(ErrCannotNewAgent, err)
 	}
 
 	// GET /initialize へのリクエストを実行
 	res, err := GetInitializeAction(ctx, ag)
 	if err != nil {
-		return failure.NewError(ErrInvalidRequest, err)
+		return ValidationError{}, failure.NewError(ErrInvalidRequest, ClassifyRequestError(err))
 	}
 	// レスポンスの Body は必ず Close
 	defer res.Body.Close()
 
 	// レスポンスを検証
-	ValidateResponse(
+	return ValidateResponse(
 		res,
 		// ステータスコードが 200 であることを検証
 		WithStatusCode(200),
-	).Add(step)
-
-	return nil
+	), nil
 }
 
 // isucandar.PrepeareScenario を満たすメソッド
 // isucandar.Benchmark の Load ステップで実行される
 func (s *Scenario) Load(ctx context.Context, step *isucandar.BenchmarkStep) error {
+	// 永続化の検証では専用のシナリオだけを実行する
+	switch s.Option.PersistencePhase {
+	case PersistencePhaseWrite:
+		return s.LoadPersistenceWrite(ctx, step)
+	case PersistencePhaseVerify:
+		return s.VerifyPersistence(ctx, step)
+	}
+
+	// 実行するシナリオと重み
+	mix, err := ParseScenarioMix(s.Option.Scenarios)
+	if err != nil {
+		return failure.NewError(ErrInvalidOption, err)
+	}
+
+	// 到着率の指定があれば一定の到着率でシナリオを開始する
+	var schedule RateSchedule
+	if s.Option.ArrivalRate != "" {
+		schedule, err = ParseArrivalRate(s.Option.ArrivalRate, LoadDuration)
+		if err != nil {
+			return failure.NewError(ErrInvalidOption, err)
+		}
+	}
+	if s.LoadProfile != nil && s.LoadProfile.Mode == LoadProfileModeArrivalRate {
+		schedule = s.LoadProfile
+	}
+
 	wg := &sync.WaitGroup{}
+	startedAt := time.Now()
+
+	// シナリオの実行が終わるまで動かす処理のための context.Context
+	loadCtx, cancelLoad := context.WithCancel(ctx)
+	defer cancelLoad()
+
+	// 負荷プロファイルのフェーズごとに結果を区切る
+	if s.LoadProfile != nil {
+		s.Phases = NewPhaseRecorder(s.LoadProfile, startedAt)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.Phases.Run(loadCtx, step.Result())
+		}()
+	}
+
+	// 途中経過を通知する
+	if s.Progress != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reportProgress(loadCtx, startedAt, step.Result(), s.Progress)
+		}()
+	}
 
 	// 10秒おきにベンチマーク実行中であることを大会運営向けロガーに出力
 	// wg.Add(1)
@@ -96,93 +260,156 @@ func (s *Scenario) Load(ctx context.Context, step *isucandar.BenchmarkStep) erro
 	// 	}
 	// }()
 
-	// 成功ケースのシナリオ
-	successCase, err := worker.NewWorker(func(ctx context.Context, _ int) {
-		if user, ok := s.Users.Get(rand.Intn(s.Users.Len())); ok {
-			// 削除済みのユーザーを引いたらもう一回
-			if user.DeleteFlag != 0 {
-				return
-			}
-
-			// ログインに成功したら画像を投稿
-			if s.LoginSuccess(ctx, step, user) {
-				s.PostImage(ctx, step, user)
-			}
-			user.ClearAgent()
-		}
-	},
-		// 無限回繰り返す
-		worker.WithInfinityLoop(),
-		// 4並列で実行
-		worker.WithMaxParallelism(4),
-	)
-	if err != nil {
+	if schedule != nil {
+		err := s.LoadOpenLoop(ctx, step, mix, schedule)
+		cancelLoad()
+		wg.Wait()
 		return err
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	workerWg := &sync.WaitGroup{}
+	workers := map[string]*worker.Worker{}
+	for _, w := range s.loadWorkers(step) {
+		// 重みが 0 のシナリオは実行しない
+		if !mix.Enabled(w.scenario) {
+			continue
+		}
 
-		successCase.Process(ctx)
-	}()
+		work := w.work
+		name := w.random
+		// 並列に実行されるので、実行順によらず同じシードで再現できるよう1回ごとに乱数生成器を派生させる
+		iteration := int64(0)
+		loop := worker.WithInfinityLoop()
+		if w.loopCount > 0 {
+			loop = worker.WithLoopCount(w.loopCount)
+		}
 
-	// 失敗ケースのシナリオ
-	failureCase, err := worker.NewWorker(func(ctx context.Context, _ int) {
-		if user, ok := s.Users.Get(rand.Intn(s.Users.Len())); ok {
-			// 削除済みのユーザーを引いたらもう一回
-			if user.DeleteFlag != 0 {
-				return
+		scenario := w.scenario
+		scenarioCase, err := worker.NewWorker(func(ctx context.Context, _ int) {
+			rnd := s.Random.Derive(fmt.Sprintf("%s-%d", name, atomic.AddInt64(&iteration, 1)))
+			if user, ok := s.UserPicker.Pick(rnd); ok {
+				startedAt := time.Now()
+				work(ctx, user, rnd)
+				// 終了時刻で打ち切られた実行は所要時間に含めない
+				if ctx.Err() == nil {
+					s.recordLatency(scenario, startedAt, startedAt, time.Now())
+				}
 			}
-
-			// ログインに失敗するだけ
-			s.LoginFailure(ctx, step, user)
+		},
+			loop,
+			// 重みの数だけ並列で実行
+			worker.WithMaxParallelism(int32(mix.Weight(w.scenario))),
+		)
+		if err != nil {
+			return err
 		}
-	},
-		// 20回繰り返す
-		worker.WithLoopCount(20),
-		// 2並列で実行
-		worker.WithMaxParallelism(2),
-	)
-	if err != nil {
-		return err
+		workers[scenario] = scenarioCase
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		failureCase.Process(ctx)
-	}()
+	// 負荷プロファイルに従って並列数を変える
+	if s.LoadProfile != nil && s.LoadProfile.Mode == LoadProfileModeParallelism {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-	// トップページの並び順検証シナリオ
-	orderedCase, err := worker.NewWorker(func(ctx context.Context, _ int) {
-		if user, ok := s.Users.Get(rand.Intn(s.Users.Len())); ok {
-			// トップページの並び順を検証
-			s.OrderedIndex(ctx, step, user)
-		}
-	},
-		// 無限回繰り返す
-		worker.WithInfinityLoop(),
-		// 2並列で実行
-		worker.WithMaxParallelism(2),
-	)
-	if err != nil {
-		return err
+			s.controlParallelism(loadCtx, startedAt, mix, workers)
+		}()
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	for _, scenarioCase := range workers {
+		scenarioCase := scenarioCase
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
 
-		orderedCase.Process(ctx)
-	}()
+			scenarioCase.Process(ctx)
+		}()
+	}
 
+	workerWg.Wait()
+	cancelLoad()
 	wg.Wait()
 
 	return nil
 }
 
+// シナリオの1回の実行の所要時間を記録
+func (s *Scenario) recordLatency(scenario string, intendedAt, startedAt, finishedAt time.Time) {
+	s.Latency.Record(scenario, intendedAt, startedAt, finishedAt)
+	if s.Phases != nil {
+		s.Phases.RecordLatency(scenario, intendedAt, startedAt, finishedAt)
+	}
+}
+
+// intendedAt に予定したシナリオを開始できなかったことを記録
+func (s *Scenario) recordDropped(scenario string, intendedAt time.Time) {
+	s.Latency.RecordDropped(scenario)
+	if s.Phases != nil {
+		s.Phases.RecordDropped(scenario, intendedAt)
+	}
+}
+
+// 負荷走行で実行するシナリオごとのワーカーの定義
+type loadWorker struct {
+	scenario string
+	// 乱数生成器の導出に使う名前
+	// シナリオ名と別にしておくことで、同じシードなら以前と同じ乱数列になる
+	random string
+	work   func(ctx context.Context, user *User, rnd *Random)
+	// 無限回ではなく決まった回数だけ繰り返す場合の回数
+	loopCount int32
+}
+
+// 負荷走行で実行するワーカーの一覧
+func (s *Scenario) loadWorkers(step *isucandar.BenchmarkStep) []loadWorker {
+	return []loadWorker{
+		// 成功ケースのシナリオ
+		{
+			scenario: ScenarioPostImage,
+			random:   "success",
+			work: func(ctx context.Context, user *User, rnd *Random) {
+				// ログインに成功したら画像を投稿
+				if s.LoginSuccess(ctx, step, user, rnd) {
+					s.PostImage(ctx, step, user, rnd)
+				}
+				user.ClearAgent()
+			},
+		},
+		// 失敗ケースのシナリオ
+		{
+			scenario: ScenarioLoginFailure,
+			random:   "failure",
+			work: func(ctx context.Context, user *User, rnd *Random) {
+				// ログインに失敗するだけ
+				s.LoginFailure(ctx, step, user, rnd)
+			},
+			// 20回繰り返す
+			loopCount: 20,
+		},
+		// ログインしてから帰るまでの一連の操作
+		{
+			scenario: ScenarioSession,
+			random:   "session",
+			work: func(ctx context.Context, user *User, rnd *Random) {
+				script := s.SessionScript
+				if script == nil {
+					script = DefaultSessionScript()
+				}
+				s.Session(ctx, step, user, rnd, script)
+			},
+		},
+		// トップページの並び順検証シナリオ
+		{
+			scenario: ScenarioOrderedIndex,
+			random:   "ordered",
+			work: func(ctx context.Context, user *User, rnd *Random) {
+				// トップページの並び順を検証
+				s.OrderedIndex(ctx, step, user)
+			},
+		},
+	}
+}
+
 // isucandar.PrepeareScenario を満たすメソッド
 // isucandar.Benchmark の Validation ステップで実行される
 func (s *Scenario) Validation(ctx context.Context, step *isucandar.BenchmarkStep) error {
@@ -190,18 +417,19 @@ func (s *Scenario) Validation(ctx context.Context, step *isucandar.BenchmarkStep
 }
 
 // 成功するログインを実行するシナリオ
-func (s *Scenario) LoginSuccess(ctx context.Context, step *isucandar.BenchmarkStep, user *User) bool {
+func (s *Scenario) LoginSuccess(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random) bool {
 	// User に紐づくユーザーエージェントを取得
 	ag, err := user.GetAgent(s.Option)
 	if err != nil {
 		step.AddError(failure.NewError(ErrCannotNewAgent, err))
 		return false
 	}
+	ctx = withAccountName(ctx, user.AccountName)
 
 	// ログインページへのリクエストを実行
 	getRes, err := GetLoginAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer getRes.Body.Close()
@@ -224,17 +452,16 @@ func (s *Scenario) LoginSuccess(ctx context.Context, step *isucandar.BenchmarkSt
 		return false
 	}
 
-	// ここで context が終了している可能性があるのでチェックして終了していたら中断
-	select {
-	case <-ctx.Done():
+	// フォームを送信する前に思考時間を待つ
+	// その間に context が終了していたら中断
+	if !s.think(ctx, rnd) {
 		return false
-	default:
 	}
 
 	// ログインするリクエストを実行
 	postRes, err := PostLoginAction(ctx, ag, user.AccountName, user.Password)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer postRes.Body.Close()
@@ -261,18 +488,19 @@ func (s *Scenario) LoginSuccess(ctx context.Context, step *isucandar.BenchmarkSt
 }
 
 // 失敗するログインを実行するシナリオ
-func (s *Scenario) LoginFailure(ctx context.Context, step *isucandar.BenchmarkStep, user *User) bool {
+func (s *Scenario) LoginFailure(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random) bool {
 	// User に紐づくユーザーエージェントを取得
 	ag, err := user.GetAgent(s.Option)
 	if err != nil {
 		step.AddError(failure.NewError(ErrCannotNewAgent, err))
 		return false
 	}
+	ctx = withAccountName(ctx, user.AccountName)
 
 	// ログインページへのリクエストを実行
 	getRes, err := GetLoginAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer getRes.Body.Close()
@@ -295,18 +523,17 @@ func (s *Scenario) LoginFailure(ctx context.Context, step *isucandar.BenchmarkSt
 		return false
 	}
 
-	// ここで context が終了している可能性があるのでチェックして終了していたら中断
-	select {
-	case <-ctx.Done():
+	// フォームを送信する前に思考時間を待つ
+	// その間に context が終了していたら中断
+	if !s.think(ctx, rnd) {
 		return false
-	default:
 	}
 
 	// ログインするリクエストを実行
 	// 本来のパスワードに間違った文字列を後付して間違ったパスワードにする
 	postRes, err := PostLoginAction(ctx, ag, user.AccountName, user.Password+".invalid")
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer postRes.Body.Close()
@@ -338,7 +565,7 @@ func (s *Scenario) LoginFailure(ctx context.Context, step *isucandar.BenchmarkSt
 	// リダイレクト先となるログインページの取得
 	redirectRes, err := GetLoginAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer getRes.Body.Close()
@@ -365,19 +592,21 @@ func (s *Scenario) LoginFailure(ctx context.Context, step *isucandar.BenchmarkSt
 }
 
 // 画像を投稿するシナリオ
-func (s *Scenario) PostImage(ctx context.Context, step *isucandar.BenchmarkStep, user *User) bool {
+// 投稿内容は rnd から生成する。投稿した Post の ID が分かれば、その Post も返す
+func (s *Scenario) PostImage(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random) (*Post, bool) {
 	// User に紐づくユーザーエージェントを取得
 	ag, err := user.GetAgent(s.Option)
 	if err != nil {
 		step.AddError(failure.NewError(ErrCannotNewAgent, err))
-		return false
+		return nil, false
 	}
+	ctx = withAccountName(ctx, user.AccountName)
 
 	// トップページへのリクエストを実行
 	getRes, err := GetRootAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
-		return false
+		AddRequestError(ctx, step, err)
+		return nil, false
 	}
 	defer getRes.Body.Close()
 
@@ -396,26 +625,30 @@ func (s *Scenario) PostImage(ctx context.Context, step *isucandar.BenchmarkStep,
 		step.AddScore(ScoreGETRoot)
 	} else {
 		// エラーがあればここでシナリオは停止
-		return false
+		return nil, false
 	}
 
-	// ここで context が終了している可能性があるのでチェックして終了していたら中断
-	select {
-	case <-ctx.Done():
-		return false
-	default:
+	// フォームを送信する前に思考時間を待つ
+	// その間に context が終了していたら中断
+	if !s.think(ctx, rnd) {
+		return nil, false
 	}
 
 	// 画像を投稿
 	post := &Post{
 		Mime:   "image/png",
-		Body:   randomText(),
+		Body:   randomText(rnd),
 		UserID: user.ID,
 	}
-	postRes, err := PostRootAction(ctx, ag, post, user.GetCSRFToken())
+	img, err := randomImage(rnd)
 	if err != nil {
 		step.AddError(failure.NewError(ErrInvalidRequest, err))
-		return false
+		return nil, false
+	}
+	postRes, err := PostRootAction(ctx, ag, post, img, user.GetCSRFToken())
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return nil, false
 	}
 	defer postRes.Body.Close()
 
@@ -431,21 +664,33 @@ func (s *Scenario) PostImage(ctx context.Context, step *isucandar.BenchmarkStep,
 		// 検証結果のエラーが空ならスコアを追加
 		step.AddScore(ScorePOSTRoot)
 	} else {
-		return false
+		return nil, false
+	}
+
+	// リダイレクト先から投稿された Post の ID を取得して書き込みを記録
+	// ID が分からなければ記録せず、呼び出し元にも返さない
+	var created *Post
+	if id, ok := postIDFromLocation(postRes); ok {
+		writtenAt := time.Now()
+		post.ID = id
+		post.CreatedAt = writtenAt
+		s.Posts.Add(post)
+		s.PostWrites.Add(post, writtenAt)
+		created = post
 	}
 
 	// ここで context が終了している可能性があるのでチェックして終了していたら中断
 	select {
 	case <-ctx.Done():
-		return false
+		return nil, false
 	default:
 	}
 
 	// トップページへ
 	redirectRes, err := GetRootAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
-		return false
+		AddRequestError(ctx, step, err)
+		return nil, false
 	}
 	defer getRes.Body.Close()
 
@@ -462,11 +707,11 @@ func (s *Scenario) PostImage(ctx context.Context, step *isucandar.BenchmarkStep,
 		// 検証結果のエラーが空ならスコアを追加
 		step.AddScore(ScoreGETRoot)
 	} else {
-		return false
+		return nil, false
 	}
 
 	// 画像の投稿に成功したら true を返す
-	return true
+	return created, true
 }
 
 // トップページの並び順を検証するシナリオ
@@ -477,11 +722,14 @@ func (s *Scenario) OrderedIndex(ctx context.Context, step *isucandar.BenchmarkSt
 		step.AddError(failure.NewError(ErrCannotNewAgent, err))
 		return false
 	}
+	ctx = withAccountName(ctx, user.AccountName)
 
 	// トップページへのリクエストを実行
+	// 鮮度の検証のためにリクエスト直前の時刻を記録しておく
+	requestedAt := time.Now()
 	getRes, err := GetRootAction(ctx, ag)
 	if err != nil {
-		step.AddError(failure.NewError(ErrInvalidRequest, err))
+		AddRequestError(ctx, step, err)
 		return false
 	}
 	defer getRes.Body.Close()
@@ -493,6 +741,8 @@ func (s *Scenario) OrderedIndex(ctx context.Context, step *isucandar.BenchmarkSt
 		WithStatusCode(200),
 		// Post の並び順を検証
 		WithOrderedPosts(),
+		// ベンチマーカーの投稿が猶予時間内にタイムラインへ反映されていることを検証
+		WithFreshTimeline(&s.PostWrites, s.Option.TimelineGracePeriod, requestedAt),
 	)
 	getValidation.Add(step)
 
@@ -507,3 +757,101 @@ func (s *Scenario) OrderedIndex(ctx context.Context, step *isucandar.BenchmarkSt
 	// 不備がなければ true を返す
 	return true
 }
+
+// Post にコメントするシナリオ
+// コメント内容は rnd から生成する
+func (s *Scenario) PostComment(ctx context.Context, step *isucandar.BenchmarkStep, user *User, post *Post, rnd *Random) bool {
+	// User に紐づくユーザーエージェントを取得
+	ag, err := user.GetAgent(s.Option)
+	if err != nil {
+		step.AddError(failure.NewError(ErrCannotNewAgent, err))
+		return false
+	}
+	ctx = withAccountName(ctx, user.AccountName)
+
+	// Post のページへのリクエストを実行
+	getRes, err := GetPostAction(ctx, ag, post.ID)
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return false
+	}
+	defer getRes.Body.Close()
+
+	// レスポンスを検証
+	getValidation := ValidateResponse(
+		getRes,
+		// ステータスコードは 200
+		WithStatusCode(200),
+		// CSRFToken を取得
+		WithCSRFToken(user),
+	)
+	getValidation.Add(step)
+
+	if getValidation.IsEmpty() {
+		// 検証結果のエラーが空ならスコアを追加
+		step.AddScore(ScoreGETPost)
+	} else {
+		// エラーがあればここでシナリオは停止
+		return false
+	}
+
+	// フォームを送信する前に思考時間を待つ
+	// その間に context が終了していたら中断
+	if !s.think(ctx, rnd) {
+		return false
+	}
+
+	// コメントを投稿
+	// 後から検証できるよう、本文に乱数を付けて一意にする
+	comment := &Comment{
+		Comment: fmt.Sprintf("%s #%d", randomText(rnd), rnd.Int63()),
+		PostID:  post.ID,
+		UserID:  user.ID,
+	}
+	postRes, err := PostCommentAction(ctx, ag, comment, user.GetCSRFToken())
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return false
+	}
+	defer postRes.Body.Close()
+
+	// レスポンスを検証
+	postValidation := ValidateResponse(
+		postRes,
+		// ステータスコードは 302
+		WithStatusCode(302),
+		// リダイレクト先はコメントした Post のページ
+		WithLocation(fmt.Sprintf("/posts/%d", post.ID)),
+	)
+	postValidation.Add(step)
+
+	if postValidation.IsEmpty() {
+		// 検証結果のエラーが空ならスコアを追加
+		step.AddScore(ScorePOSTComment)
+	} else {
+		return false
+	}
+
+	// コメントの ID はレスポンスから分からないので、書き込みの記録にだけ残す
+	writtenAt := time.Now()
+	comment.CreatedAt = writtenAt
+	s.CommentWrites.Add(comment, writtenAt)
+
+	// コメントに成功したら true を返す
+	return true
+}
+
+// POST / のリダイレクト先 /posts/:id から Post の ID を取り出す
+func postIDFromLocation(res *http.Response) (int, bool) {
+	location, err := res.Location()
+	if err != nil {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(location.Path, "/posts/"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+
+	return id, true
+}
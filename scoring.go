@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/score"
+)
+
+// スコア計算の設定
+// --scoring-profile で JSON ファイルを指定すると、書かれた項目だけがデフォルト値から上書きされる
+//
+//	{
+//	  "weights": {"POST /": 10},
+//	  "penalties": {"status-code": 2, "asset": 0},
+//	  "default_penalty": 1,
+//	  "max_deduction": 100,
+//	  "min_success_rate": 0.9
+//	}
+type ScoringProfile struct {
+	// スコアのタグごとの倍率
+	Weights map[score.ScoreTag]int64 `json:"weights"`
+	// エラーコードごとの減点
+	// 1つのエラーが複数のコードを持つ場合は最も内側(具体的)なコードの設定を使う
+	Penalties map[string]int64 `json:"penalties"`
+	// Penalties にないエラーの減点
+	DefaultPenalty int64 `json:"default_penalty"`
+	// 減点の上限(0 以下なら上限なし)
+	MaxDeduction int64 `json:"max_deduction"`
+	// 成功したリクエストの割合がこれを下回ったら fail にする(0 なら判定しない)
+	MinSuccessRate float64 `json:"min_success_rate"`
+}
+
+// スコアの計算結果
+type ScoreSummary struct {
+	Addition  int64  `json:"addition"`
+	Deduction int64  `json:"deduction"`
+	Total     int64  `json:"total"`
+	Failed    bool   `json:"failed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// これまでの固定の倍率と同じ設定を返す
+func DefaultScoringProfile() *ScoringProfile {
+	return &ScoringProfile{
+		Weights: map[score.ScoreTag]int64{
+			ScoreGETRoot:     1,
+			ScoreGETLogin:    1,
+			ScorePOSTLogin:   2,
+			ScorePOSTRoot:    5,
+			ScoreGETPost:     1,
+			ScorePOSTComment: 2,
+		},
+		Penalties: map[string]int64{
+			// 中断されたリクエストは減点しない
+			string(ErrRequestCanceled): 0,
+		},
+		// エラーは1つ1点減点
+		DefaultPenalty: 1,
+	}
+}
+
+// JSON ファイルからスコア計算の設定をロード
+func LoadScoringProfile(path string) (*ScoringProfile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profile := DefaultScoringProfile()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(profile); err != nil {
+		return nil, fmt.Errorf("invalid scoring profile %s: %v", path, err)
+	}
+
+	if profile.MinSuccessRate < 0 || profile.MinSuccessRate > 1 {
+		return nil, fmt.Errorf("invalid scoring profile %s: min_success_rate must be in [0, 1]", path)
+	}
+
+	return profile, nil
+}
+
+// エラー1つあたりの減点を返す
+func (p *ScoringProfile) Penalty(err error) int64 {
+	codes := failure.GetErrorCodes(err)
+	for i := len(codes) - 1; i >= 0; i-- {
+		if penalty, ok := p.Penalties[codes[i]]; ok {
+			return penalty
+		}
+	}
+
+	return p.DefaultPenalty
+}
+
+// ベンチマーク結果からスコアを計算
+func (p *ScoringProfile) Calculate(result *isucandar.BenchmarkResult) ScoreSummary {
+	s := result.Score
+	// 各タグに倍率を設定
+	for tag, weight := range p.Weights {
+		s.Set(tag, weight)
+	}
+
+	// 加点分の合算
+	addition := s.Sum()
+
+	// エラーごとに減点
+	errs := result.Errors.All()
+	deduction := int64(0)
+	for _, err := range errs {
+		deduction += p.Penalty(err)
+	}
+	if p.MaxDeduction > 0 && deduction > p.MaxDeduction {
+		deduction = p.MaxDeduction
+	}
+
+	// 合計(0を下回ったら0点にする)
+	summary := ScoreSummary{
+		Addition:  addition,
+		Deduction: deduction,
+		Total:     addition - deduction,
+	}
+	if summary.Total < 0 {
+		summary.Total = 0
+	}
+
+	// 成功したリクエストの割合が基準を下回ったら fail
+	if p.MinSuccessRate > 0 {
+		successes := int64(0)
+		for _, count := range s.Breakdown() {
+			successes += count
+		}
+		attempts := successes + int64(len(errs))
+		if attempts > 0 {
+			rate := float64(successes) / float64(attempts)
+			if rate < p.MinSuccessRate {
+				summary.Failed = true
+				summary.Reason = fmt.Sprintf("success rate %.3f is below %.3f", rate, p.MinSuccessRate)
+				summary.Total = 0
+			}
+		}
+	}
+
+	return summary
+}
+
+// 結果から合計スコアを計算
+func SumScore(result *isucandar.BenchmarkResult, profile *ScoringProfile) int64 {
+	return profile.Calculate(result).Total
+}
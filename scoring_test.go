@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+	"github.com/isucon/isucandar/score"
+	"github.com/stretchr/testify/assert"
+)
+
+// スコアとエラーを記録したベンチマーク結果を生成
+func newTestBenchmarkResult(t *testing.T, scores map[score.ScoreTag]int, errs []error) *isucandar.BenchmarkResult {
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover())
+	assert.NoError(t, err)
+
+	benchmark.Load(func(_ context.Context, step *isucandar.BenchmarkStep) error {
+		for tag, count := range scores {
+			for i := 0; i < count; i++ {
+				step.AddScore(tag)
+			}
+		}
+		for _, err := range errs {
+			step.AddError(err)
+		}
+		return nil
+	})
+
+	return benchmark.Start(context.Background())
+}
+
+func TestDefaultScoringProfile(t *testing.T) {
+	result := newTestBenchmarkResult(t,
+		map[score.ScoreTag]int{ScoreGETRoot: 10, ScorePOSTRoot: 2},
+		[]error{failure.NewError(ErrInvalidStatusCode, errors.New("status"))},
+	)
+
+	summary := DefaultScoringProfile().Calculate(result)
+	assert.Equal(t, int64(20), summary.Addition)
+	assert.Equal(t, int64(1), summary.Deduction)
+	assert.Equal(t, int64(19), summary.Total)
+	assert.False(t, summary.Failed)
+}
+
+func TestScoringProfilePenalties(t *testing.T) {
+	result := newTestBenchmarkResult(t,
+		map[score.ScoreTag]int{ScoreGETRoot: 10},
+		[]error{
+			failure.NewError(ErrInvalidStatusCode, errors.New("status")),
+			failure.NewError(ErrInvalidStatusCode, errors.New("status")),
+			failure.NewError(ErrInvalidAsset, errors.New("asset")),
+			failure.NewError(ErrNotFound, errors.New("not found")),
+		},
+	)
+
+	profile := DefaultScoringProfile()
+	profile.Weights[ScoreGETRoot] = 3
+	profile.Penalties[string(ErrInvalidStatusCode)] = 5
+	profile.Penalties[string(ErrInvalidAsset)] = 0
+	profile.DefaultPenalty = 2
+
+	summary := profile.Calculate(result)
+	assert.Equal(t, int64(30), summary.Addition)
+	assert.Equal(t, int64(12), summary.Deduction)
+	assert.Equal(t, int64(18), summary.Total)
+
+	// 減点の上限
+	profile.MaxDeduction = 4
+	assert.Equal(t, int64(26), profile.Calculate(result).Total)
+
+	// 成功率の下限 (10 / 14)
+	profile.MinSuccessRate = 0.8
+	summary = profile.Calculate(result)
+	assert.True(t, summary.Failed)
+	assert.Equal(t, int64(0), summary.Total)
+}
+
+func TestLoadScoringProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scoring.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"weights": {"POST /": 10}, "penalties": {"timeout": 0}, "max_deduction": 50}`), 0644))
+
+	profile, err := LoadScoringProfile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), profile.Weights[ScorePOSTRoot])
+	// 書かれていない項目はデフォルト値のまま
+	assert.Equal(t, int64(1), profile.Weights[ScoreGETRoot])
+	assert.Equal(t, int64(1), profile.DefaultPenalty)
+	assert.Equal(t, int64(0), profile.Penalties["timeout"])
+	assert.Equal(t, int64(50), profile.MaxDeduction)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"unknown": 1}`), 0644))
+	_, err = LoadScoringProfile(path)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"min_success_rate": 2}`), 0644))
+	_, err = LoadScoringProfile(path)
+	assert.Error(t, err)
+}
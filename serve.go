@@ -0,0 +1,673 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve に関するオプションのデフォルト値
+const (
+	// 認証なしでジョブを受け付けるので、既定ではループバックだけで待ち受ける
+	DefaultServeListen = "127.0.0.1:9200"
+	DefaultServeToken  = ""
+	// 終了したジョブを保持しておく数
+	DefaultJobHistory = 100
+)
+
+// ジョブの状態
+const (
+	JobStatusQueued   = "queued"
+	JobStatusRunning  = "running"
+	JobStatusFinished = "finished"
+	JobStatusFailed   = "failed"
+	JobStatusCanceled = "canceled"
+)
+
+// ジョブの状態の変化以外に通知するイベント
+const JobEventProgress = "progress"
+
+// ジョブの API のパス
+const jobsPath = "/jobs"
+
+// ジョブの引数では受け付けないフラグ
+// API からサーバーのファイルを読み書きさせないよう、ファイルのパスを取るものと状態の保存や再開を拒否する
+var jobRejectedFlags = []string{
+	"state-file",
+	"continue",
+	"persistence-phase",
+	"dump-dir",
+	"load-profile",
+	"session-script",
+	"scoring-profile",
+	"error-log",
+}
+
+// ジョブのイベント
+// Type は状態の変化なら新しい状態、途中経過なら JobEventProgress
+type JobEvent struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// キューに入れたベンチマーク1回分
+type Job struct {
+	ID string
+	// run サブコマンドと同じ形式の引数
+	Args []string
+	// すべての対象の host:port を並べ替えてカンマで繋いだもの
+	Target string
+	// 対象の host:port の一覧。いずれかを使うジョブが実行中なら待つ
+	hosts []string
+
+	option Option
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	status     string
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	err        string
+	result     *RunResult
+	events     []JobEvent
+	// イベントが追加されるたびに close して作り直す
+	changed chan struct{}
+}
+
+// API で返すジョブの内容
+type JobView struct {
+	ID         string     `json:"id"`
+	Args       []string   `json:"args"`
+	Target     string     `json:"target"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Result     *RunResult `json:"result,omitempty"`
+}
+
+// run と同じ形式の引数からジョブを生成
+// ログと結果の保存先はサーバーのものを使うので、それらのフラグは受け付けない
+// ファイルはサーバーの既定のものだけを使う
+func NewJob(id string, args []string) (*Job, error) {
+	option := Option{}
+
+	fs := newFlagSet("job")
+	fs.SetOutput(io.Discard)
+	addTargetFlags(fs, &option)
+	addPersistenceFlags(fs, &option)
+	addLoadFlags(fs, &option)
+	addTeamFlag(fs, &option)
+	addErrorFlags(fs, &option)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	rejected := []string{}
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range jobRejectedFlags {
+			if f.Name == name {
+				rejected = append(rejected, "--"+name)
+			}
+		}
+	})
+	if len(rejected) > 0 {
+		return nil, fmt.Errorf("%s cannot be used in jobs", strings.Join(rejected, ", "))
+	}
+
+	if err := prepareTargetOption(&option); err != nil {
+		return nil, err
+	}
+	if err := validateLoadOption(option); err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for _, target := range option.Targets.Targets() {
+		hosts = append(hosts, target.Host)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        id,
+		Args:      args,
+		Target:    option.Targets.Key(),
+		hosts:     hosts,
+		option:    option,
+		ctx:       ctx,
+		cancel:    cancel,
+		createdAt: time.Now(),
+		changed:   make(chan struct{}),
+	}
+	job.setStatus(JobStatusQueued, nil)
+
+	return job, nil
+}
+
+// 状態を変えてイベントを追加
+func (j *Job) setStatus(status string, data interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.setStatusLocked(status, data)
+}
+
+// 待機中なら実行中にする
+// キャンセルされていたら false を返す
+func (j *Job) start() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != JobStatusQueued {
+		return false
+	}
+	j.setStatusLocked(JobStatusRunning, nil)
+	return true
+}
+
+// 状態を変えてイベントを追加
+// j.mu を取得した状態で呼ぶ
+func (j *Job) setStatusLocked(status string, data interface{}) {
+	now := time.Now()
+	j.status = status
+	switch status {
+	case JobStatusRunning:
+		j.startedAt = now
+	case JobStatusFinished, JobStatusFailed, JobStatusCanceled:
+		j.finishedAt = now
+	}
+	j.addEvent(JobEvent{Type: status, Time: now, Data: data})
+}
+
+// 途中経過のイベントを追加
+func (j *Job) notifyProgress(progress Progress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.addEvent(JobEvent{Type: JobEventProgress, Time: time.Now(), Data: progress})
+}
+
+// イベントを追加して待っている購読者に知らせる
+// j.mu を取得した状態で呼ぶ
+func (j *Job) addEvent(event JobEvent) {
+	j.events = append(j.events, event)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// 実行を終えた結果を設定
+func (j *Job) finish(result *RunResult, err error) {
+	j.mu.Lock()
+	j.result = result
+	if err != nil {
+		j.err = err.Error()
+	}
+	j.mu.Unlock()
+
+	switch {
+	case err != nil:
+		j.setStatus(JobStatusFailed, map[string]string{"error": err.Error()})
+	case j.ctx.Err() != nil:
+		j.setStatus(JobStatusCanceled, result)
+	default:
+		j.setStatus(JobStatusFinished, result)
+	}
+}
+
+// 現在の状態
+func (j *Job) Status() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status
+}
+
+// 終了しているか
+func (j *Job) Done() bool {
+	return jobStatusDone(j.Status())
+}
+
+// 終了した状態か
+func jobStatusDone(status string) bool {
+	switch status {
+	case JobStatusFinished, JobStatusFailed, JobStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// from 番目以降のイベントと、次のイベントが追加されたら close される channel、ジョブが終了しているかを返す
+func (j *Job) Events(from int) ([]JobEvent, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if from > len(j.events) {
+		from = len(j.events)
+	}
+	events := make([]JobEvent, len(j.events)-from)
+	copy(events, j.events[from:])
+
+	return events, j.changed, jobStatusDone(j.status)
+}
+
+// API で返す内容
+func (j *Job) View() JobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	view := JobView{
+		ID:        j.ID,
+		Args:      j.Args,
+		Target:    j.Target,
+		Status:    j.status,
+		CreatedAt: j.createdAt,
+		Error:     j.err,
+		Result:    j.result,
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		view.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		view.FinishedAt = &finishedAt
+	}
+
+	return view
+}
+
+// ジョブのオプションでベンチマークを実行する
+func runJob(job *Job) (*RunResult, error) {
+	option := job.option
+
+	scoringProfile, err := loadScoringProfile(option)
+	if err != nil {
+		return nil, err
+	}
+	scenario, loadDuration, err := newLoadScenario(option)
+	if err != nil {
+		return nil, err
+	}
+	scenario.Progress = job.notifyProgress
+
+	startedAt := time.Now()
+	result, err := startBenchmark(job.ctx, scenario, loadDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRunResult(option, scoringProfile, result, &scenario.Latency, startedAt), nil
+}
+
+// ジョブを受け付けて、対象が重なるジョブは同時に実行しないよう順番に実行する HTTP API
+//
+//	POST   /jobs             {"args": ["--target-host=..."]} でジョブを追加
+//	GET    /jobs             ジョブの一覧
+//	GET    /jobs/:id         ジョブの状態と、終了していれば結果
+//	GET    /jobs/:id/events  状態の変化と途中経過を Server-Sent Events で配信
+//	DELETE /jobs/:id         待機中または実行中のジョブをキャンセル
+type JobServer struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []*Job
+	// 開始を待っているジョブを追加した順に並べたもの
+	pending []*Job
+	// ジョブを実行中の対象の host:port
+	running map[string]bool
+	nextID  int64
+	// 終了したジョブを保持しておく数
+	history int
+	// 結果の保存先。 nil なら保存しない
+	store ResultStore
+	// 空でなければ Authorization ヘッダーに同じトークンを持つリクエストだけを受け付ける
+	Token string
+
+	// ジョブを実行する関数
+	run func(*Job) (*RunResult, error)
+}
+
+// 空の JobServer を生成
+// store を指定すると、キャンセルされずに結果の出たジョブを保存する
+func NewJobServer(history int, store ResultStore) *JobServer {
+	return &JobServer{
+		jobs:    map[string]*Job{},
+		running: map[string]bool{},
+		history: history,
+		store:   store,
+		run:     runJob,
+	}
+}
+
+// ジョブをキューに追加する
+// 対象のいずれかを使うジョブが実行中か先に待っていれば、それらの終了を待ってから実行する
+func (s *JobServer) Submit(args []string) (*Job, error) {
+	s.mu.Lock()
+	s.nextID++
+	id := fmt.Sprintf("%s-%d", time.Now().Format("20060102150405"), s.nextID)
+	s.mu.Unlock()
+
+	job, err := NewJob(id, args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job)
+	s.pending = append(s.pending, job)
+	s.schedule()
+	s.prune()
+
+	return job, nil
+}
+
+// 待っているジョブのうち、対象がすべて空いているものを追加した順に開始する
+// 開始できなかったジョブの対象は後のジョブにも使わせないので、対象ごとには追加した順に実行する
+// s.mu を取得した状態で呼ぶ
+func (s *JobServer) schedule() {
+	reserved := map[string]bool{}
+	pending := s.pending[:0]
+	for _, job := range s.pending {
+		// 待っている間にキャンセルされたジョブは実行しない
+		if job.Status() != JobStatusQueued {
+			continue
+		}
+
+		free := true
+		for _, host := range job.hosts {
+			if s.running[host] || reserved[host] {
+				free = false
+			}
+		}
+		if !free {
+			for _, host := range job.hosts {
+				reserved[host] = true
+			}
+			pending = append(pending, job)
+			continue
+		}
+		if !job.start() {
+			continue
+		}
+
+		for _, host := range job.hosts {
+			s.running[host] = true
+		}
+		go s.execute(job)
+	}
+	s.pending = pending
+}
+
+// 開始したジョブを実行し、終わったら対象を空けて次のジョブを開始する
+func (s *JobServer) execute(job *Job) {
+	AdminLogger.Info(fmt.Sprintf("job %s started", job.ID), "job", job.ID, "target", job.Target)
+	result, err := s.run(job)
+	// 中断したジョブの途中までの結果は履歴や比較を歪めるので保存しない
+	if result != nil && job.ctx.Err() == nil {
+		saveRunResult(s.store, result)
+	}
+	job.finish(result, err)
+	AdminLogger.Info(fmt.Sprintf("job %s %s", job.ID, job.Status()), "job", job.ID, "status", job.Status())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range job.hosts {
+		delete(s.running, host)
+	}
+	s.schedule()
+}
+
+// 終了したジョブを古いものから捨てて history 件に収める
+// s.mu を取得した状態で呼ぶ
+func (s *JobServer) prune() {
+	finished := 0
+	for _, job := range s.order {
+		if job.Done() {
+			finished++
+		}
+	}
+
+	kept := s.order[:0]
+	for _, job := range s.order {
+		if finished > s.history && job.Done() {
+			delete(s.jobs, job.ID)
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	s.order = kept
+}
+
+// ID のジョブを返す
+func (s *JobServer) Get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// 追加した順のジョブの一覧
+func (s *JobServer) List() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]*Job, len(s.order))
+	copy(jobs, s.order)
+	return jobs
+}
+
+// ジョブをキャンセルする
+// 待機中ならそのまま終了し、実行中なら負荷走行を中断して途中までの結果で終了する
+// 待機中のジョブを取り消すと後に待っているジョブを開始できることがあるので、開始し直す
+func (s *JobServer) Cancel(job *Job) {
+	job.cancel()
+
+	job.mu.Lock()
+	queued := job.status == JobStatusQueued
+	if queued {
+		job.setStatusLocked(JobStatusCanceled, nil)
+	}
+	job.mu.Unlock()
+
+	if queued {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.schedule()
+	}
+}
+
+// http.Handler インターフェースを実装
+func (s *JobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, s.Token) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == jobsPath {
+		switch r.Method {
+		case http.MethodGet:
+			views := []JobView{}
+			for _, job := range s.List() {
+				view := job.View()
+				// 一覧では結果の詳細を省く
+				view.Result = nil
+				views = append(views, view)
+			}
+			writeJSON(w, http.StatusOK, views)
+		case http.MethodPost:
+			req := struct {
+				Args []string `json:"args"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+				return
+			}
+			job, err := s.Submit(req.Args)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			w.Header().Set("Location", jobsPath+"/"+job.ID)
+			writeJSON(w, http.StatusAccepted, job.View())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(path, jobsPath+"/"), "/")
+	job, ok := s.Get(id)
+	if !strings.HasPrefix(path, jobsPath+"/") || !ok {
+		writeJSONError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, job.View())
+	case sub == "" && r.Method == http.MethodDelete:
+		if job.Done() {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("job is already %s", job.Status()))
+			return
+		}
+		s.Cancel(job)
+		writeJSON(w, http.StatusAccepted, job.View())
+	case sub == "events" && r.Method == http.MethodGet:
+		s.streamEvents(w, r, job)
+	default:
+		writeJSONError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// ジョブのイベントを Server-Sent Events で配信する
+// これまでのイベントを送った後、ジョブが終了するまで新しいイベントを送り続ける
+func (s *JobServer) streamEvents(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sent := 0
+	for {
+		events, changed, done := job.Events(sent)
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		sent += len(events)
+		flusher.Flush()
+
+		if done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// v を JSON で書き出す
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// エラーを {"error": "..."} の形で書き出す
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// serve サブコマンド
+// HTTP API でベンチマークのジョブを受け付けて実行する
+func ServeCommand(args []string) int {
+	option := Option{}
+	listen := DefaultServeListen
+	token := DefaultServeToken
+	history := DefaultJobHistory
+
+	fs := newFlagSet("serve")
+	fs.StringVar(&listen, "listen", DefaultServeListen, "Address to serve the job API")
+	fs.StringVar(&token, "token", DefaultServeToken, "Token required in the Authorization: Bearer header (recommended when listening on a non-loopback address)")
+	fs.IntVar(&history, "job-history", DefaultJobHistory, "Number of finished jobs kept in memory")
+	fs.StringVar(&option.Store, "store", DefaultStore, "Save the result of every job to this store: file:<dir> or sqlite:<path> (sqlite requires -tags sqlite)")
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := openOptionStore(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	jobs := NewJobServer(history, store)
+	jobs.Token = token
+	server := &http.Server{Addr: listen, Handler: jobs}
+	go func() {
+		<-ctx.Done()
+		// 実行中のジョブを中断してから停止する
+		for _, job := range jobs.List() {
+			if !job.Done() {
+				jobs.Cancel(job)
+			}
+		}
+		server.Shutdown(context.Background())
+	}()
+
+	AdminLogger.Printf("serving job API on %s", listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	return ExitCodeOK
+}
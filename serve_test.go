@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ベンチマークの代わりに対象ごとの release か、キャンセルされるまで待つ JobServer
+func newTestJobServer(t *testing.T, targets ...string) (*JobServer, map[string]chan struct{}) {
+	releases := map[string]chan struct{}{}
+	for _, target := range targets {
+		releases[target] = make(chan struct{})
+	}
+
+	s := NewJobServer(DefaultJobHistory, nil)
+	s.run = func(job *Job) (*RunResult, error) {
+		job.notifyProgress(Progress{Elapsed: 1})
+		select {
+		case <-releases[job.Target]:
+		case <-job.ctx.Done():
+		}
+		return &RunResult{Score: ScoreSummary{Total: 42}}, nil
+	}
+
+	return s, releases
+}
+
+// ジョブが status になるまで待つ
+func waitJobStatus(t *testing.T, job *Job, status string) {
+	require.Eventually(t, func() bool { return job.Status() == status }, time.Second, 5*time.Millisecond)
+}
+
+func TestJobServerSerializesTarget(t *testing.T) {
+	s, releases := newTestJobServer(t, "app1:8080,app2:8080", "app1:8080", "app3:8080")
+
+	first, err := s.Submit([]string{"--target-host=app1:8080,app2:8080"})
+	require.NoError(t, err)
+	second, err := s.Submit([]string{"--target-host=app2:8080,app1:8080"})
+	require.NoError(t, err)
+	overlap, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	other, err := s.Submit([]string{"--target-host=app3:8080"})
+	require.NoError(t, err)
+	assert.Equal(t, first.Target, second.Target)
+
+	// 対象が1つでも重なるジョブは、前のジョブが終わるまで追加した順に待つ
+	waitJobStatus(t, first, JobStatusRunning)
+	waitJobStatus(t, other, JobStatusRunning)
+	assert.Equal(t, JobStatusQueued, second.Status())
+	assert.Equal(t, JobStatusQueued, overlap.Status())
+
+	releases["app1:8080,app2:8080"] <- struct{}{}
+	waitJobStatus(t, second, JobStatusRunning)
+	assert.Equal(t, JobStatusQueued, overlap.Status())
+
+	releases["app1:8080,app2:8080"] <- struct{}{}
+	waitJobStatus(t, overlap, JobStatusRunning)
+	assert.Equal(t, JobStatusRunning, other.Status())
+
+	close(releases["app1:8080"])
+	close(releases["app3:8080"])
+	waitJobStatus(t, overlap, JobStatusFinished)
+	waitJobStatus(t, other, JobStatusFinished)
+	assert.Equal(t, int64(42), first.View().Result.Score.Total)
+}
+
+func TestJobServerCancelQueuedUnblocks(t *testing.T) {
+	s, releases := newTestJobServer(t, "app1:8080", "app1:8080,app2:8080", "app2:8080")
+
+	running, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	blocked, err := s.Submit([]string{"--target-host=app1:8080,app2:8080"})
+	require.NoError(t, err)
+	later, err := s.Submit([]string{"--target-host=app2:8080"})
+	require.NoError(t, err)
+	waitJobStatus(t, running, JobStatusRunning)
+
+	// 先に待っているジョブが app2 を使うので、後のジョブは待つ
+	assert.Equal(t, JobStatusQueued, later.Status())
+
+	// 待っているジョブを取り消すと後のジョブが始まる
+	s.Cancel(blocked)
+	waitJobStatus(t, later, JobStatusRunning)
+
+	close(releases["app1:8080"])
+	close(releases["app2:8080"])
+	waitJobStatus(t, running, JobStatusFinished)
+	waitJobStatus(t, later, JobStatusFinished)
+}
+
+func TestJobServerCancel(t *testing.T) {
+	s, _ := newTestJobServer(t, "app1:8080")
+
+	running, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	queued, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	waitJobStatus(t, running, JobStatusRunning)
+
+	s.Cancel(queued)
+	assert.Equal(t, JobStatusCanceled, queued.Status())
+
+	// 実行中のジョブは中断して途中までの結果で終わる
+	s.Cancel(running)
+	waitJobStatus(t, running, JobStatusCanceled)
+	assert.NotNil(t, running.View().Result)
+	assert.Nil(t, queued.View().StartedAt)
+}
+
+func TestJobServerSkipsCanceledResult(t *testing.T) {
+	s, releases := newTestJobServer(t, "app1:8080")
+	store, err := OpenFileResultStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	s.store = store
+
+	canceled, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	waitJobStatus(t, canceled, JobStatusRunning)
+	s.Cancel(canceled)
+	waitJobStatus(t, canceled, JobStatusCanceled)
+
+	finished, err := s.Submit([]string{"--target-host=app1:8080"})
+	require.NoError(t, err)
+	close(releases["app1:8080"])
+	waitJobStatus(t, finished, JobStatusFinished)
+
+	// 中断したジョブの結果は保存しない
+	results, err := store.List(ResultFilter{})
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func TestJobServerHTTP(t *testing.T) {
+	s, releases := newTestJobServer(t, "app1:8080")
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/jobs", "application/json", strings.NewReader(`{"args": ["--scenarios=unknown"]}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// サーバーのファイルを読み書きする引数は受け付けない
+	for _, arg := range []string{"--state-file=/tmp/state.json", "--continue", "--persistence-phase=write", "--dump-dir=/etc", "--load-profile=/etc/passwd", "--error-log=/tmp/error.log"} {
+		res, err := http.Post(server.URL+"/jobs", "application/json", strings.NewReader(`{"args": ["`+arg+`"]}`))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, arg)
+	}
+
+	res, err = http.Post(server.URL+"/jobs", "application/json", strings.NewReader(`{"args": ["--target-host=app1:8080"]}`))
+	require.NoError(t, err)
+	view := JobView{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&view))
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.Equal(t, "/jobs/"+view.ID, res.Header.Get("Location"))
+	assert.Equal(t, "app1:8080", view.Target)
+
+	// イベントを購読しながらジョブを終わらせる
+	events, err := http.Get(server.URL + "/jobs/" + view.ID + "/events")
+	require.NoError(t, err)
+	defer events.Body.Close()
+	assert.Equal(t, "text/event-stream", events.Header.Get("Content-Type"))
+	close(releases["app1:8080"])
+
+	types := []string{}
+	scanner := bufio.NewScanner(events.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+			types = append(types, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	assert.Equal(t, []string{JobStatusQueued, JobStatusRunning, JobEventProgress, JobStatusFinished}, types)
+
+	res, err = http.Get(server.URL + "/jobs/" + view.ID)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&view))
+	res.Body.Close()
+	assert.Equal(t, JobStatusFinished, view.Status)
+	assert.Equal(t, int64(42), view.Result.Score.Total)
+
+	// 終了したジョブはキャンセルできない
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/jobs/"+view.ID, nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, err = http.Get(server.URL + "/jobs/unknown")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	list := []JobView{}
+	res, err = http.Get(server.URL + "/jobs")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	res.Body.Close()
+	require.Len(t, list, 1)
+	assert.Nil(t, list[0].Result)
+}
+
+func TestJobServerToken(t *testing.T) {
+	s, _ := newTestJobServer(t)
+	s.Token = "secret"
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/jobs")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/jobs", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+)
+
+// 負荷走行でセッションを実行するシナリオの名前
+const ScenarioSession = "session"
+
+// セッションの操作
+const (
+	SessionActionLogin   = "login"
+	SessionActionBrowse  = "browse"
+	SessionActionPost    = "post"
+	SessionActionComment = "comment"
+	SessionActionLogout  = "logout"
+)
+
+// コメント先を選ぶ新しい Post の数
+const sessionCommentCandidates = 20
+
+// セッションの1つの操作
+type SessionStep struct {
+	Action string `json:"action"`
+	// 操作を行う確率。省略すると必ず行う
+	Probability *float64 `json:"probability,omitempty"`
+	// browse で見るページ数の範囲
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+}
+
+// 1人の訪問者がログインしてから帰るまでの一連の操作
+// --session-script で JSON ファイルを指定する
+//
+//	{
+//	  "steps": [
+//	    {"action": "login"},
+//	    {"action": "browse", "min": 1, "max": 5},
+//	    {"action": "post", "probability": 0.3},
+//	    {"action": "comment", "probability": 0.5},
+//	    {"action": "logout"}
+//	  ]
+//	}
+type SessionScript struct {
+	Steps []*SessionStep `json:"steps"`
+}
+
+// ログインして数ページ見て、ときどき投稿やコメントをしてログアウトする
+func DefaultSessionScript() *SessionScript {
+	probability := func(p float64) *float64 { return &p }
+
+	return &SessionScript{
+		Steps: []*SessionStep{
+			{Action: SessionActionLogin},
+			{Action: SessionActionBrowse, Min: 1, Max: 5},
+			{Action: SessionActionPost, Probability: probability(0.3)},
+			{Action: SessionActionComment, Probability: probability(0.5)},
+			{Action: SessionActionLogout},
+		},
+	}
+}
+
+// JSON ファイルからセッションをロード
+func LoadSessionScript(path string) (*SessionScript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	script := &SessionScript{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(script); err != nil {
+		return nil, fmt.Errorf("invalid session script %s: %v", path, err)
+	}
+	if err := script.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid session script %s: %v", path, err)
+	}
+
+	return script, nil
+}
+
+// 設定の妥当性を検証
+// 投稿、コメント、ログアウトは必ず行うログインの後にしか置けない
+func (s *SessionScript) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("no steps")
+	}
+
+	loggedIn := false
+	for i, step := range s.Steps {
+		if step.Probability != nil && (*step.Probability < 0 || *step.Probability > 1) {
+			return fmt.Errorf("step %d: probability must be in [0, 1]", i+1)
+		}
+
+		switch step.Action {
+		case SessionActionLogin:
+			if step.Probability == nil || *step.Probability == 1 {
+				loggedIn = true
+			}
+		case SessionActionBrowse:
+			if step.Min < 1 || step.Max < step.Min {
+				return fmt.Errorf("step %d: browse requires 1 <= min <= max", i+1)
+			}
+		case SessionActionPost, SessionActionComment, SessionActionLogout:
+			if !loggedIn {
+				return fmt.Errorf("step %d: %s requires a login step before it", i+1, step.Action)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i+1, step.Action)
+		}
+	}
+
+	return nil
+}
+
+// セッションを最初から最後まで実行するシナリオ
+// 操作の間には思考時間を挟み、どこかで失敗したらそこで終了する
+// ログアウトで他のワーカーのセッションを壊さないよう、ユーザーの agent.Agent は共有せずに専用のものを使う
+func (s *Scenario) Session(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random, script *SessionScript) bool {
+	user = user.Detach()
+
+	executed := 0
+	for _, st := range script.Steps {
+		// 確率で飛ばす操作では思考時間も待たない
+		if st.Probability != nil && rnd.Float64() >= *st.Probability {
+			continue
+		}
+
+		// 操作の間に思考時間を待つ
+		// ログイン、投稿、コメントはフォームを送信する前に待つので、ここでは待たない
+		switch st.Action {
+		case SessionActionLogin, SessionActionPost, SessionActionComment:
+		default:
+			if executed > 0 && !s.think(ctx, rnd) {
+				return false
+			}
+		}
+		executed++
+
+		ok := true
+		switch st.Action {
+		case SessionActionLogin:
+			ok = s.LoginSuccess(ctx, step, user, rnd)
+		case SessionActionBrowse:
+			ok = s.Browse(ctx, step, user, rnd, st.Min+rnd.Intn(st.Max-st.Min+1))
+		case SessionActionPost:
+			_, ok = s.PostImage(ctx, step, user, rnd)
+		case SessionActionComment:
+			// 新しい Post の中からコメント先を選ぶ
+			candidates := s.visiblePosts(sessionCommentCandidates)
+			if candidates.Len() == 0 {
+				continue
+			}
+			ok = s.PostComment(ctx, step, user, candidates.At(rnd.Intn(candidates.Len())), rnd)
+		case SessionActionLogout:
+			ok = s.Logout(ctx, step, user)
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pages ページを順に見るシナリオ
+// 最初にトップページを見て、その後は新しい Post のページを見る
+func (s *Scenario) Browse(ctx context.Context, step *isucandar.BenchmarkStep, user *User, rnd *Random, pages int) bool {
+	for i := 0; i < pages; i++ {
+		if i > 0 && !s.think(ctx, rnd) {
+			return false
+		}
+
+		if i == 0 {
+			if !s.OrderedIndex(ctx, step, user) {
+				return false
+			}
+			continue
+		}
+
+		posts := s.visiblePosts(sessionCommentCandidates)
+		if posts.Len() == 0 {
+			return true
+		}
+		if !s.ViewPost(ctx, step, user, posts.At(rnd.Intn(posts.Len()))) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 削除されていないユーザーの Post を新しい順に limit 件まで返す
+// 削除されたユーザーの Post は表示されず、ページも 404 になるので除く
+func (s *Scenario) visiblePosts(limit int) SetSnapshot[*Post] {
+	return s.Posts.Snapshot().Filter(func(post *Post) bool {
+		user, ok := s.Users.Get(post.UserID)
+		return ok && !user.IsDeleted()
+	}, limit)
+}
+
+// Post のページを見るシナリオ
+func (s *Scenario) ViewPost(ctx context.Context, step *isucandar.BenchmarkStep, user *User, post *Post) bool {
+	// User に紐づくユーザーエージェントを取得
+	ag, err := user.GetAgent(s.Option)
+	if err != nil {
+		step.AddError(failure.NewError(ErrCannotNewAgent, err))
+		return false
+	}
+	ctx = withAccountName(ctx, user.AccountName)
+
+	// Post のページへのリクエストを実行
+	res, err := GetPostAction(ctx, ag, post.ID)
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return false
+	}
+	defer res.Body.Close()
+
+	// レスポンスを検証
+	validation := ValidateResponse(
+		res,
+		// ステータスコードは 200
+		WithStatusCode(200),
+		// 見ようとした Post が表示されている
+		WithSelector(fmt.Sprintf("#pid_%d", post.ID)),
+	)
+	validation.Add(step)
+
+	if validation.IsEmpty() {
+		// 検証結果のエラーが空ならスコアを追加
+		step.AddScore(ScoreGETPost)
+	} else {
+		return false
+	}
+
+	return true
+}
+
+// ログアウトするシナリオ
+func (s *Scenario) Logout(ctx context.Context, step *isucandar.BenchmarkStep, user *User) bool {
+	// User に紐づくユーザーエージェントを取得
+	ag, err := user.GetAgent(s.Option)
+	if err != nil {
+		step.AddError(failure.NewError(ErrCannotNewAgent, err))
+		return false
+	}
+	ctx = withAccountName(ctx, user.AccountName)
+
+	// ログアウトするリクエストを実行
+	res, err := GetLogoutAction(ctx, ag)
+	if err != nil {
+		AddRequestError(ctx, step, err)
+		return false
+	}
+	defer res.Body.Close()
+
+	// レスポンスを検証
+	validation := ValidateResponse(
+		res,
+		// ステータスコードは 302
+		WithStatusCode(302),
+		// リダイレクト先はトップページ
+		WithLocation("/"),
+	)
+	validation.Add(step)
+
+	return validation.IsEmpty()
+}
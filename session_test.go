@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionScriptValidate(t *testing.T) {
+	assert.NoError(t, DefaultSessionScript().Validate())
+
+	path := filepath.Join(t.TempDir(), "session.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"steps": [{"action": "browse", "min": 2, "max": 3}]}`), 0644))
+	script, err := LoadSessionScript(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, script.Steps[0].Max)
+
+	for _, body := range []string{
+		`{"steps": []}`,
+		`{"steps": [{"action": "dance"}]}`,
+		`{"steps": [{"action": "browse", "min": 3, "max": 2}]}`,
+		`{"steps": [{"action": "login", "probability": 1.5}]}`,
+		// ログインしていないと投稿できない
+		`{"steps": [{"action": "post"}]}`,
+		`{"steps": [{"action": "login", "probability": 0.5}, {"action": "comment"}]}`,
+		`{"steps": [{"action": "login", "wait": "1s"}]}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(body), 0644))
+		_, err := LoadSessionScript(path)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestSessionBrowseAndLogout(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/logout":
+			// 本来の実装と同じく絶対 URL でリダイレクトする
+			http.Redirect(w, r, "http://"+r.Host+"/", http.StatusFound)
+		case "/", "/posts/1":
+			fmt.Fprint(w, `<html><body><div class="isu-post" id="pid_1"></div></body></html>`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s := &Scenario{
+		Option: Option{
+			TargetHost:     strings.TrimPrefix(server.URL, "http://"),
+			RequestTimeout: 3 * time.Second,
+		},
+		ThinkTime: FixedThinkTime(time.Millisecond),
+	}
+	user := &User{ID: 1, AccountName: "mary", CreatedAt: time.Now()}
+	s.Users.Add(user)
+	s.Posts.Add(&Post{ID: 1, UserID: user.ID, CreatedAt: time.Now()})
+	// 削除されたユーザーの Post のページは 404 になるので見ない
+	deleted := &User{ID: 2, AccountName: "deleted", CreatedAt: time.Now()}
+	deleted.SetDeleteFlag(1)
+	s.Users.Add(deleted)
+	s.Posts.Add(&Post{ID: 2, UserID: deleted.ID, CreatedAt: time.Now().Add(time.Second)})
+
+	script := &SessionScript{Steps: []*SessionStep{{Action: SessionActionBrowse, Min: 3, Max: 3}}}
+	require.NoError(t, script.Validate())
+
+	var ok, loggedOut bool
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover())
+	require.NoError(t, err)
+	benchmark.Load(func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		ok = s.Session(ctx, step, user, NewRandom(42), script)
+		loggedOut = s.Logout(ctx, step, user)
+		return nil
+	})
+	result := benchmark.Start(context.Background())
+
+	assert.Empty(t, result.Errors.All())
+	assert.True(t, ok)
+	assert.True(t, loggedOut)
+	// 最初にトップページ、その後は Post のページを見る
+	assert.Equal(t, []string{"/", "/posts/1", "/posts/1", "/logout"}, paths)
+	assert.Equal(t, int64(2), result.Score.Breakdown()[ScoreGETPost])
+}
+
+func TestSessionSkipsThinkTime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body></body></html>`)
+	}))
+	defer server.Close()
+
+	s := &Scenario{
+		Option: Option{
+			TargetHost:     strings.TrimPrefix(server.URL, "http://"),
+			RequestTimeout: 3 * time.Second,
+		},
+		ThinkTime: FixedThinkTime(time.Hour),
+	}
+	user := &User{ID: 1, AccountName: "mary", CreatedAt: time.Now()}
+
+	// 飛ばした操作の前では思考時間を待たない
+	never := 0.0
+	script := &SessionScript{Steps: []*SessionStep{
+		{Action: SessionActionBrowse, Min: 1, Max: 1},
+		{Action: SessionActionBrowse, Min: 1, Max: 1, Probability: &never},
+	}}
+	require.NoError(t, script.Validate())
+
+	var ok bool
+	benchmark, err := isucandar.NewBenchmark(isucandar.WithoutPanicRecover(), isucandar.WithLoadTimeout(3*time.Second))
+	require.NoError(t, err)
+	benchmark.Load(func(ctx context.Context, step *isucandar.BenchmarkStep) error {
+		ok = s.Session(ctx, step, user, NewRandom(42), script)
+		return nil
+	})
+	startedAt := time.Now()
+	benchmark.Start(context.Background())
+
+	assert.True(t, ok)
+	assert.Less(t, time.Since(startedAt), 3*time.Second)
+	// セッションは専用の agent.Agent を使う
+	assert.Nil(t, user.Agent)
+}
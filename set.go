@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -15,10 +16,175 @@ type Model interface {
 // Set.Get(id) で ID からモデルを取る
 // Set.At(index) で先頭から index 番目のモデルを取る
 // Set.Add(model) で集合にモデルを追加
+// Set.Update(model) で変更したモデルの並び順とインデックスを更新
+// Set.Remove(id) で集合からモデルを削除
+//
+// モデルは CreatedAt の降順、 CreatedAt が同一なら ID の昇順に並ぶ
+// 並びは部分木のサイズを持つ永続 Treap で管理しているため、追加と At は O(log n) で済み、
+// 読み取り側はロックを取らずにある時点のスナップショットを辿れる
 type Set[T Model] struct {
-	mu   sync.RWMutex
-	list []T
-	dict map[int]T
+	mu      sync.RWMutex
+	root    *setNode[T]
+	dict    map[int]*setNode[T]
+	indexes []setIndexer[T]
+}
+
+// Treap のノード
+// 一度作ったノードは書き換えず、更新時は経路上のノードを複製する
+type setNode[T Model] struct {
+	model     T
+	id        int
+	createdAt time.Time
+	priority  uint64
+	size      int
+	left      *setNode[T]
+	right     *setNode[T]
+}
+
+func newSetNode[T Model](model T) *setNode[T] {
+	id := model.GetID()
+
+	return &setNode[T]{
+		model:     model,
+		id:        id,
+		createdAt: model.GetCreatedAt(),
+		priority:  setNodePriority(id),
+		size:      1,
+	}
+}
+
+// ID から決まる疑似乱数を Treap の優先度にする
+// 連番の ID でも偏らないよう splitmix64 で撹拌する
+func setNodePriority(id int) uint64 {
+	z := uint64(id) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (n *setNode[T]) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// 子を持たないノードの複製を返す
+// 同じモデルを別の木に入れるときに使う
+func (n *setNode[T]) detached() *setNode[T] {
+	return n.with(nil, nil)
+}
+
+// 子を差し替えたノードの複製を返す
+func (n *setNode[T]) with(left, right *setNode[T]) *setNode[T] {
+	c := *n
+	c.left = left
+	c.right = right
+	c.size = left.len() + right.len() + 1
+	return &c
+}
+
+// n が (createdAt, id) のモデルより前に並ぶか
+func (n *setNode[T]) before(createdAt time.Time, id int) bool {
+	if n.createdAt.Equal(createdAt) {
+		return n.id < id
+	}
+	return n.createdAt.After(createdAt)
+}
+
+// (createdAt, id) より前に並ぶノードとそれ以外に分割する
+func splitSetNode[T Model](n *setNode[T], createdAt time.Time, id int) (*setNode[T], *setNode[T]) {
+	if n == nil {
+		return nil, nil
+	}
+
+	if n.before(createdAt, id) {
+		l, r := splitSetNode(n.right, createdAt, id)
+		return n.with(n.left, l), r
+	}
+
+	l, r := splitSetNode(n.left, createdAt, id)
+	return l, n.with(r, n.right)
+}
+
+// 並び順で l のすべてが r より前にある2つの木を結合する
+func mergeSetNode[T Model](l, r *setNode[T]) *setNode[T] {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+
+	if l.priority > r.priority {
+		return l.with(l.left, mergeSetNode(l.right, r))
+	}
+	return r.with(mergeSetNode(l, r.left), r.right)
+}
+
+// 先頭から count 個のノードとそれ以外に分割する
+func splitSetNodeAt[T Model](n *setNode[T], count int) (*setNode[T], *setNode[T]) {
+	if n == nil {
+		return nil, nil
+	}
+
+	leftSize := n.left.len()
+	if count <= leftSize {
+		l, r := splitSetNodeAt(n.left, count)
+		return l, n.with(r, n.right)
+	}
+
+	l, r := splitSetNodeAt(n.right, count-leftSize-1)
+	return n.with(n.left, l), r
+}
+
+// 並び順を保ったまま node を挿入した木を返す
+func insertSetNode[T Model](root *setNode[T], node *setNode[T]) *setNode[T] {
+	l, r := splitSetNode(root, node.createdAt, node.id)
+	return mergeSetNode(mergeSetNode(l, node), r)
+}
+
+// node と同じキーのノードを取り除いた木を返す
+func removeSetNode[T Model](root *setNode[T], node *setNode[T]) *setNode[T] {
+	l, r := splitSetNode(root, node.createdAt, node.id)
+	// r の先頭が node と同じキーのノード
+	if first := r.at(0); first != nil && first.id == node.id && first.createdAt.Equal(node.createdAt) {
+		_, r = splitSetNodeAt(r, 1)
+	}
+	return mergeSetNode(l, r)
+}
+
+// 先頭から index 番目のノードを返す
+func (n *setNode[T]) at(index int) *setNode[T] {
+	for n != nil {
+		leftSize := n.left.len()
+		switch {
+		case index < leftSize:
+			n = n.left
+		case index == leftSize:
+			return n
+		default:
+			index -= leftSize + 1
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// 先頭から順にモデルを f に渡す
+// f が false を返したら打ち切り、そのときは false を返す
+func (n *setNode[T]) each(offset int, f func(idx int, model T) bool) bool {
+	if n == nil {
+		return true
+	}
+	if !n.left.each(offset, f) {
+		return false
+	}
+	offset += n.left.len()
+	if !f(offset, n.model) {
+		return false
+	}
+	return n.right.each(offset+1, f)
 }
 
 // 集合に含まれるモデルの個数を返す
@@ -26,7 +192,7 @@ func (s *Set[T]) Len() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return len(s.list)
+	return s.root.len()
 }
 
 // 先頭から index 番目のモデルを取るメソッド
@@ -35,14 +201,15 @@ func (s *Set[T]) At(index int) T {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Set.list が未初期化ならゼロ値を返す
+	// 範囲外ならゼロ値を返す
 	// *new(T) は T のゼロ値を返す
 	// Set[*User] なら nil を返す
-	if s.list == nil {
+	node := s.root.at(index)
+	if node == nil {
 		return *new(T)
 	}
 
-	return s.list[index]
+	return node.model
 }
 
 // ID からモデルを取るメソッド
@@ -56,84 +223,214 @@ func (s *Set[T]) Get(id int) (T, bool) {
 		return *new(T), false
 	}
 
-	model, ok := s.dict[id]
-	return model, ok
+	node, ok := s.dict[id]
+	if !ok {
+		return *new(T), false
+	}
+
+	return node.model, true
 }
 
 // Set にモデルを追加するメソッド
 // 追加時に CreatedAt でソート済みの位置に追加
 // CreatedAt が重複したら ID で昇順
+// ID が 0 か、既に同じ ID のモデルがあれば追加せずに false を返す
 func (s *Set[T]) Add(model T) bool {
+	id := model.GetID()
+	if id == 0 {
+		return false
+	}
+
+	// ロックの外でノードを作っておく
+	node := newSetNode(model)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	id := model.GetID()
-	if id == 0 {
+	if _, exists := s.dict[id]; exists {
 		return false
 	}
 
-	if len(s.list) == 0 {
-		// Set.list が空ならそのまま追加
-		s.list = []T{model}
-	} else {
-		pos := 0
-
-		// 先頭から順に探査していく
-		for i := 0; i < len(s.list)-1; i++ {
-			m := s.list[i]
-			pos = i
-
-			// 追加しようとしているモデルより CreatedAt が古ければその前に追加
-			if m.GetCreatedAt().Before(model.GetCreatedAt()) {
-				break
-			}
-
-			// CreatedAt が同一で
-			if m.GetCreatedAt().Equal(model.GetCreatedAt()) {
-				// 追加しようとしているモデルより ID が大きければその前に追加
-				if m.GetID() > model.GetID() {
-					break
-				}
-			}
-		}
+	s.insert(node)
+
+	return true
+}
 
-		s.list = append(s.list[:pos+1], s.list[pos:]...)
-		s.list[pos] = model
+// ロックを取った状態でノードを木と二次インデックスに追加する
+func (s *Set[T]) insert(node *setNode[T]) {
+	s.root = insertSetNode(s.root, node)
+
+	// 二次インデックスも更新
+	for _, index := range s.indexes {
+		index.insert(node)
 	}
 
 	// Set.dict が未初期化なら初期化
 	if s.dict == nil {
-		s.dict = make(map[int]T, 0)
+		s.dict = make(map[int]*setNode[T], 0)
 	}
 	// ID で対応するマップに保存
-	s.dict[id] = model
-
-	return true
+	s.dict[node.id] = node
 }
 
-// User の Set
-type UserSet struct {
-	Set[*User]
+// ロックを取った状態でノードを木と二次インデックスから取り除く
+func (s *Set[T]) remove(node *setNode[T]) {
+	s.root = removeSetNode(s.root, node)
+
+	for _, index := range s.indexes {
+		index.remove(node)
+	}
+
+	delete(s.dict, node.id)
 }
 
-// Post の Set
-type PostSet struct {
-	Set[*Post]
+// ID に対応するモデルを Set から削除するメソッド
+// 削除したモデルと、モデルが存在したかを返す
+func (s *Set[T]) Remove(id int) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, ok := s.dict[id]
+	if !ok {
+		return *new(T), false
+	}
+	s.remove(node)
+
+	return node.model, true
 }
 
-// Comment の Set
-type CommentSet struct {
-	Set[*Comment]
+// 同じ ID のモデルを model で置き換え、並び順と二次インデックスを更新するメソッド
+// CreatedAt やインデックスのキーとなるフィールドを書き換えたモデルを渡せば付け直される
+// 同じ ID のモデルがなければ false を返す
+func (s *Set[T]) Update(model T) bool {
+	node := newSetNode(model)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.dict[node.id]
+	if !ok {
+		return false
+	}
+	s.remove(old)
+	s.insert(node)
+
+	return true
 }
 
 type SetForEachFunc[T Model] func(idx int, model T)
 
+// 先頭から順にすべてのモデルを f に渡す
+// 呼び出した時点のスナップショットを辿るので、 f の中から Set を変更してもよい
 func (s *Set[T]) ForEach(f SetForEachFunc[T]) {
+	s.Snapshot().ForEach(f)
+}
+
+// 現時点の Set の内容を読み取り専用のスナップショットとして返す
+// 木は書き換えられないので O(1) で取得でき、以降の変更の影響を受けない
+func (s *Set[T]) Snapshot() SetSnapshot[T] {
 	s.mu.RLock()
-	list := s.list[:]
-	s.mu.RUnlock()
+	defer s.mu.RUnlock()
+
+	return SetSnapshot[T]{root: s.root}
+}
 
-	for idx, model := range list {
+// ある時点の Set の内容を表す読み取り専用の構造体
+// ロックを取らないので複数の goroutine から自由に使える
+type SetSnapshot[T Model] struct {
+	root *setNode[T]
+}
+
+// スナップショットに含まれるモデルの個数を返す
+func (s SetSnapshot[T]) Len() int {
+	return s.root.len()
+}
+
+// 先頭から index 番目のモデルを返す
+// 範囲外ならゼロ値を返す
+func (s SetSnapshot[T]) At(index int) T {
+	node := s.root.at(index)
+	if node == nil {
+		return *new(T)
+	}
+
+	return node.model
+}
+
+// 先頭から順にすべてのモデルを f に渡す
+func (s SetSnapshot[T]) ForEach(f SetForEachFunc[T]) {
+	s.root.each(0, func(idx int, model T) bool {
 		f(idx, model)
+		return true
+	})
+}
+
+// 先頭から順にモデルを f に渡し、 f が false を返したらそこで打ち切る
+func (s SetSnapshot[T]) Each(f func(idx int, model T) bool) {
+	s.root.each(0, f)
+}
+
+// スナップショットの内容を並び順のスライスで返す
+func (s SetSnapshot[T]) Slice() []T {
+	models := make([]T, 0, s.Len())
+	s.ForEach(func(_ int, model T) {
+		models = append(models, model)
+	})
+
+	return models
+}
+
+// CreatedAt が t 以前のモデルを新しい順に最大 limit 個返す
+// /posts?max_created_at= のように t ちょうどのモデルも含む
+// limit が 0 以下なら個数を制限しない
+func (s SetSnapshot[T]) Before(t time.Time, limit int) SetSnapshot[T] {
+	// (t, 最小の ID) より前に並ぶのは CreatedAt が t より新しいモデル
+	_, r := splitSetNode(s.root, t, math.MinInt)
+	if limit > 0 {
+		r, _ = splitSetNodeAt(r, limit)
 	}
+
+	return SetSnapshot[T]{root: r}
+}
+
+// CreatedAt が from 以上 to 以下のモデルを新しい順に返す
+func (s SetSnapshot[T]) Range(from, to time.Time) SetSnapshot[T] {
+	_, r := splitSetNode(s.root, to, math.MinInt)
+	// (from, 最大の ID) より前に並ぶのは CreatedAt が from 以降のモデル
+	l, _ := splitSetNode(r, from, math.MaxInt)
+
+	return SetSnapshot[T]{root: l}
+}
+
+// 先頭から順に pred を満たすモデルを最大 limit 個集めたスナップショットを返す
+// limit が 0 以下なら個数を制限しない
+func (s SetSnapshot[T]) Filter(pred func(T) bool, limit int) SetSnapshot[T] {
+	var root *setNode[T]
+	s.root.each(0, func(_ int, model T) bool {
+		if limit > 0 && root.len() >= limit {
+			return false
+		}
+		if pred(model) {
+			// 並び順の末尾に追加していくので結合するだけでよい
+			root = mergeSetNode(root, newSetNode(model))
+		}
+		return true
+	})
+
+	return SetSnapshot[T]{root: root}
+}
+
+// Set の現時点の内容から SetSnapshot.Before を返す
+func (s *Set[T]) Before(t time.Time, limit int) SetSnapshot[T] {
+	return s.Snapshot().Before(t, limit)
+}
+
+// Set の現時点の内容から SetSnapshot.Range を返す
+func (s *Set[T]) Range(from, to time.Time) SetSnapshot[T] {
+	return s.Snapshot().Range(from, to)
+}
+
+// Set の現時点の内容から SetSnapshot.Filter を返す
+func (s *Set[T]) Filter(pred func(T) bool, limit int) SetSnapshot[T] {
+	return s.Snapshot().Filter(pred, limit)
 }
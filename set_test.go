@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -101,3 +105,251 @@ func TestSetOrdered(t *testing.T) {
 		assert.Equal(t, actual, m.ID)
 	})
 }
+
+func TestSetLastElementOrdered(t *testing.T) {
+	set := generateTestSet(0)
+
+	now := time.Now()
+	newer := generateTestSetModel(now)
+	older := generateTestSetModel(now.Add(-1 * time.Minute))
+	newest := generateTestSetModel(now.Add(1 * time.Minute))
+
+	set.Add(newer)
+	set.Add(older)
+	set.Add(newest)
+
+	assert.Equal(t, newest, set.At(0))
+	assert.Equal(t, newer, set.At(1))
+	assert.Equal(t, older, set.At(2))
+	assert.Nil(t, set.At(3))
+}
+
+func TestSetRejectDuplicatedID(t *testing.T) {
+	set := generateTestSet(0)
+	model := generateTestSetModel(time.Now())
+
+	assert.True(t, set.Add(model))
+	assert.False(t, set.Add(&TestSetModel{ID: model.ID, CreatedAt: time.Now()}))
+	assert.False(t, set.Add(&TestSetModel{ID: 0, CreatedAt: time.Now()}))
+	assert.Equal(t, 1, set.Len())
+}
+
+// 任意の順で追加しても (CreatedAt 降順, ID 昇順) に並ぶことを検証する
+func TestSetOrderedProperty(t *testing.T) {
+	base := time.Now()
+
+	property := func(offsets []uint8) bool {
+		set := &Set[*TestSetModel]{}
+		models := []*TestSetModel{}
+		for i, offset := range offsets {
+			// offset を小さい範囲に収めて CreatedAt の重複を起こりやすくする
+			model := &TestSetModel{
+				ID:        i + 1,
+				CreatedAt: base.Add(time.Duration(offset%16) * time.Second),
+			}
+			models = append(models, model)
+		}
+		rand.Shuffle(len(models), func(i, j int) { models[i], models[j] = models[j], models[i] })
+		for _, model := range models {
+			if !set.Add(model) {
+				return false
+			}
+		}
+
+		expected := make([]*TestSetModel, len(models))
+		copy(expected, models)
+		sort.Slice(expected, func(i, j int) bool {
+			if expected[i].CreatedAt.Equal(expected[j].CreatedAt) {
+				return expected[i].ID < expected[j].ID
+			}
+			return expected[i].CreatedAt.After(expected[j].CreatedAt)
+		})
+
+		if set.Len() != len(expected) {
+			return false
+		}
+
+		ok := true
+		set.ForEach(func(idx int, model *TestSetModel) {
+			if expected[idx] != model || set.At(idx) != model {
+				ok = false
+			}
+		})
+		for _, model := range expected {
+			if m, found := set.Get(model.ID); !found || m != model {
+				ok = false
+			}
+		}
+
+		return ok
+	}
+
+	assert.NoError(t, quick.Check(property, &quick.Config{MaxCount: 200}))
+}
+
+func TestSetConcurrentAdd(t *testing.T) {
+	set := generateTestSet(0)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				set.Add(generateTestSetModel(time.Now()))
+				set.ForEach(func(_ int, _ *TestSetModel) {})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 800, set.Len())
+	previous := set.At(0)
+	set.ForEach(func(idx int, m *TestSetModel) {
+		if idx == 0 {
+			return
+		}
+		assert.False(t, m.CreatedAt.After(previous.CreatedAt))
+		previous = m
+	})
+}
+
+func BenchmarkSetAdd(b *testing.B) {
+	base := time.Now()
+	set := &Set[*TestSetModel]{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Add(&TestSetModel{
+			ID:        i + 1,
+			CreatedAt: base.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+}
+
+func BenchmarkSetAddParallel(b *testing.B) {
+	set := &Set[*TestSetModel]{}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			set.Add(generateTestSetModel(time.Now()))
+		}
+	})
+}
+
+func BenchmarkSetAt(b *testing.B) {
+	set := generateTestSet(10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.At(i % 10000)
+	}
+}
+
+func BenchmarkSetLoadPosts(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		set := &PostSet{}
+		if err := set.LoadJSON("./dump/posts.json"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func generateTestRangeSet(base time.Time) (*Set[*TestSetModel], []*TestSetModel) {
+	set := &Set[*TestSetModel]{}
+	models := []*TestSetModel{}
+	// 新しい順に 10 秒間隔、同時刻のモデルを 2 つずつ作る
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 2; j++ {
+			model := &TestSetModel{
+				ID:        i*2 + j + 1,
+				CreatedAt: base.Add(-time.Duration(i) * 10 * time.Second),
+			}
+			models = append(models, model)
+			set.Add(model)
+		}
+	}
+
+	return set, models
+}
+
+func TestSetBefore(t *testing.T) {
+	base := time.Now()
+	set, models := generateTestRangeSet(base)
+
+	// t ちょうどのモデルを含む
+	page := set.Before(base.Add(-20*time.Second), 5)
+	assert.Equal(t, models[4:9], page.Slice())
+
+	// limit が 0 以下なら全件
+	assert.Equal(t, models[4:], set.Before(base.Add(-15*time.Second), 0).Slice())
+	assert.Equal(t, models, set.Before(base.Add(time.Hour), 0).Slice())
+	assert.Equal(t, 0, set.Before(base.Add(-time.Hour), 10).Len())
+}
+
+func TestSetRange(t *testing.T) {
+	base := time.Now()
+	set, models := generateTestRangeSet(base)
+
+	page := set.Range(base.Add(-30*time.Second), base.Add(-10*time.Second))
+	assert.Equal(t, models[2:8], page.Slice())
+
+	assert.Equal(t, 0, set.Range(base.Add(-5*time.Second), base.Add(-1*time.Second)).Len())
+}
+
+func TestSetFilter(t *testing.T) {
+	base := time.Now()
+	set, models := generateTestRangeSet(base)
+
+	even := func(m *TestSetModel) bool { return m.ID%2 == 0 }
+	page := set.Filter(even, 3)
+	assert.Equal(t, []*TestSetModel{models[1], models[3], models[5]}, page.Slice())
+	assert.Equal(t, 10, set.Filter(even, 0).Len())
+
+	// スナップショットに対してさらに絞り込める
+	assert.Equal(t, []*TestSetModel{models[5], models[7]}, set.Before(base.Add(-20*time.Second), 0).Filter(even, 2).Slice())
+
+	// スナップショットは以降の追加の影響を受けない
+	set.Add(&TestSetModel{ID: 100, CreatedAt: base.Add(time.Second)})
+	assert.Equal(t, 3, page.Len())
+	assert.Equal(t, 11, set.Filter(even, 0).Len())
+}
+
+func TestSetRemove(t *testing.T) {
+	base := time.Now()
+	set, models := generateTestRangeSet(base)
+
+	removed, ok := set.Remove(models[3].ID)
+	assert.True(t, ok)
+	assert.Equal(t, models[3], removed)
+
+	_, ok = set.Remove(models[3].ID)
+	assert.False(t, ok)
+
+	_, ok = set.Get(models[3].ID)
+	assert.False(t, ok)
+
+	expected := append(append([]*TestSetModel{}, models[:3]...), models[4:]...)
+	assert.Equal(t, expected, set.Snapshot().Slice())
+
+	// 削除した ID は再び追加できる
+	assert.True(t, set.Add(models[3]))
+	assert.Equal(t, models, set.Snapshot().Slice())
+}
+
+func TestSetUpdate(t *testing.T) {
+	base := time.Now()
+	set, models := generateTestRangeSet(base)
+
+	// 最も古いモデルを最も新しくする
+	oldest := models[len(models)-1]
+	oldest.CreatedAt = base.Add(time.Minute)
+	assert.True(t, set.Update(oldest))
+
+	assert.Equal(t, len(models), set.Len())
+	assert.Equal(t, oldest, set.At(0))
+	assert.Equal(t, models[len(models)-2], set.At(len(models)-1))
+
+	assert.False(t, set.Update(&TestSetModel{ID: 1000, CreatedAt: base}))
+}
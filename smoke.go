@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/failure"
+)
+
+// smoke の Load ステップの制限時間
+const SmokeLoadTimeout = 30 * time.Second
+
+// Prepare の後に各シナリオを1回ずつ実行するシナリオ
+// Prepare と Validation は Scenario のものをそのまま使う
+type SmokeScenario struct {
+	*Scenario
+}
+
+// isucandar.LoadScenario を満たすメソッド
+// 負荷をかけずにすべてのシナリオが通ることだけを確認する
+func (s *SmokeScenario) Load(ctx context.Context, step *isucandar.BenchmarkStep) error {
+	rnd := s.Random.Derive("smoke")
+
+	user, ok := s.UserPicker.Pick(rnd)
+	if !ok {
+		return failure.NewError(ErrInvalidOption, errors.New("no active users to run the smoke test"))
+	}
+
+	// 失敗するログイン
+	s.LoginFailure(ctx, step, user, rnd)
+	user.ClearAgent()
+
+	// ログインして画像を投稿し、その Post にコメント
+	// Post の投稿は PersistenceWrite と同じ流れなのでそのまま使う
+	s.PersistenceWrite(ctx, step, user, rnd)
+
+	// トップページの並び順
+	s.OrderedIndex(ctx, step, user)
+	user.ClearAgent()
+
+	return nil
+}
+
+// smoke サブコマンド
+// Prepare と各シナリオの1回ずつの実行で、エラーがなければ成功とする
+func SmokeCommand(args []string) int {
+	option := Option{}
+
+	fs := newFlagSet("smoke")
+	addTargetFlags(fs, &option)
+	addErrorFlags(fs, &option)
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	if err := prepareTargetOption(&option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	AdminLogger.Print(option)
+
+	scenario := &SmokeScenario{
+		Scenario: &Scenario{Option: option},
+	}
+	result, err := startBenchmark(context.Background(), scenario, SmokeLoadTimeout)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	if option.StateFile != "" {
+		if err := scenario.SaveState(option.StateFile); err != nil {
+			AdminLogger.Printf("failed to save state: %v", err)
+		}
+	}
+
+	if err := reportErrors(option, result); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	reportScoreBreakdown(result)
+
+	return reportCheckResult("smoke", result)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 状態ファイルの形式のバージョン
+const StateVersion = 1
+
+// ベンチマーカーが把握しているデータを保存するための構造体
+type State struct {
+	Version        int                `json:"version"`
+	SavedAt        time.Time          `json:"saved_at"`
+	TargetHost     string             `json:"target_host"`
+	Users          []*User            `json:"users"`
+	Posts          []*Post            `json:"posts"`
+	Comments       []*Comment         `json:"comments"`
+	HiddenPosts    []*Post            `json:"hidden_posts"`
+	HiddenComments []*Comment         `json:"hidden_comments"`
+	PostWrites     []StateWriteRecord `json:"post_writes"`
+	// Comment は ID が分からないので内容ごと保存する
+	CommentWrites []WriteRecord[*Comment] `json:"comment_writes"`
+}
+
+// 書き込みの記録は ID だけを保存し、読み込み時に Post と結び付け直す
+type StateWriteRecord struct {
+	ID        int       `json:"id"`
+	WrittenAt time.Time `json:"written_at"`
+}
+
+// 現在の状態を State として取り出す
+func (s *Scenario) State() *State {
+	state := &State{
+		Version:        StateVersion,
+		SavedAt:        time.Now(),
+		TargetHost:     s.Option.TargetHost,
+		Users:          s.Users.Snapshot().Slice(),
+		Posts:          s.Posts.Snapshot().Slice(),
+		Comments:       s.Comments.Snapshot().Slice(),
+		HiddenPosts:    s.HiddenPosts.Snapshot().Slice(),
+		HiddenComments: s.HiddenComments.Snapshot().Slice(),
+		PostWrites:     []StateWriteRecord{},
+		CommentWrites:  s.CommentWrites.Records(),
+	}
+
+	for _, record := range s.PostWrites.Records() {
+		state.PostWrites = append(state.PostWrites, StateWriteRecord{
+			ID:        record.Model.ID,
+			WrittenAt: record.WrittenAt,
+		})
+	}
+
+	return state
+}
+
+// 状態をファイルに保存
+// 書き込み途中で中断しても元のファイルが壊れないよう、一時ファイルに書いてから置き換える
+func (s *Scenario) SaveState(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := json.NewEncoder(file).Encode(s.State()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// ファイルから状態を読み込んで Scenario に反映
+func (s *Scenario) LoadState(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	state := &State{}
+	if err := json.NewDecoder(file).Decode(state); err != nil {
+		return err
+	}
+
+	return s.RestoreState(state)
+}
+
+// State の内容を Scenario に反映
+func (s *Scenario) RestoreState(state *State) error {
+	if state.Version != StateVersion {
+		return fmt.Errorf("unsupported state version: %d", state.Version)
+	}
+	if state.TargetHost != s.Option.TargetHost {
+		AdminLogger.Printf("state was saved for %s, but target is %s", state.TargetHost, s.Option.TargetHost)
+	}
+
+	for _, user := range state.Users {
+		if !s.Users.Add(user) {
+			return fmt.Errorf("Unexpected error on state loading: %v", user)
+		}
+	}
+	for _, post := range state.Posts {
+		if !s.Posts.Add(post) {
+			return fmt.Errorf("Unexpected error on state loading: %v", post)
+		}
+	}
+	for _, comment := range state.Comments {
+		if !s.Comments.Add(comment) {
+			return fmt.Errorf("Unexpected error on state loading: %v", comment)
+		}
+	}
+	for _, post := range state.HiddenPosts {
+		if !s.HiddenPosts.Add(post) {
+			return fmt.Errorf("Unexpected error on state loading: %v", post)
+		}
+	}
+	for _, comment := range state.HiddenComments {
+		if !s.HiddenComments.Add(comment) {
+			return fmt.Errorf("Unexpected error on state loading: %v", comment)
+		}
+	}
+
+	for _, record := range state.PostWrites {
+		post, ok := s.Posts.Get(record.ID)
+		if !ok {
+			post, ok = s.HiddenPosts.Get(record.ID)
+		}
+		if !ok {
+			return fmt.Errorf("Unexpected error on state loading: post %d is not found", record.ID)
+		}
+		s.PostWrites.Add(post, record.WrittenAt)
+	}
+	for _, record := range state.CommentWrites {
+		s.CommentWrites.Add(record.Model, record.WrittenAt)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	saved := &Scenario{Option: Option{TargetHost: "localhost:8080"}}
+
+	saved.Users.Add(&User{ID: 1, AccountName: "mary", Password: "marymary", CreatedAt: now})
+	saved.Users.Add(&User{ID: 2, AccountName: "banned", DeleteFlag: 1, CreatedAt: now})
+	post := &Post{ID: 10001, UserID: 1, Body: "Hello, World", CreatedAt: now}
+	saved.Posts.Add(post)
+	saved.PostWrites.Add(post, now)
+	saved.Comments.Add(&Comment{ID: 1, PostID: 10001, UserID: 1, Comment: "Wow", CreatedAt: now})
+	saved.HiddenPosts.Add(&Post{ID: 3, UserID: 2, CreatedAt: now})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.NoError(t, saved.SaveState(path))
+
+	loaded := &Scenario{Option: Option{TargetHost: "localhost:8080"}}
+	assert.NoError(t, loaded.LoadState(path))
+
+	assert.Equal(t, 2, loaded.Users.Len())
+	user, ok := loaded.Users.ByAccountName("mary")
+	assert.True(t, ok)
+	assert.Equal(t, "marymary", user.Password)
+	banned, _ := loaded.Users.Get(2)
+	assert.True(t, banned.IsDeleted())
+
+	assert.Equal(t, 1, loaded.Posts.Len())
+	assert.Equal(t, "Hello, World", loaded.Posts.At(0).Body)
+	assert.Equal(t, 1, loaded.Comments.ByPostID(10001).Len())
+	assert.Equal(t, 1, loaded.HiddenPosts.Len())
+
+	// 書き込みの記録は読み込んだ Post と結び付いている
+	records := loaded.PostWrites.Records()
+	assert.Len(t, records, 1)
+	restored, _ := loaded.Posts.Get(10001)
+	assert.Same(t, restored, records[0].Model)
+	assert.True(t, now.Equal(records[0].WrittenAt))
+}
+
+func TestLoadStateUnknownVersion(t *testing.T) {
+	s := &Scenario{}
+	assert.Error(t, s.RestoreState(&State{Version: StateVersion + 1}))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 結果の保存先の種類と場所の区切り文字
+const resultStoreDelim = ":"
+
+// 保存先の種類を省略した場合に使う保存先
+const DefaultResultStoreDriver = "file"
+
+// 指定した ID の結果がない
+var ErrResultNotFound = errors.New("result not found")
+
+// ベンチマーク結果の保存先
+type ResultStore interface {
+	// 結果を保存する。 ID が空なら採番して設定する
+	Save(result *RunResult) error
+	// ID の結果を返す。なければ ErrResultNotFound
+	Get(id string) (*RunResult, error)
+	// 条件に合う結果を新しい順に返す
+	List(filter ResultFilter) ([]*RunResult, error)
+	Close() error
+}
+
+// ResultStore.List の条件
+// 空の項目は条件にしない
+type ResultFilter struct {
+	Team   string
+	Target string
+	// 0 以下なら件数を制限しない
+	Limit int
+}
+
+// 結果が条件に合うか
+func (f ResultFilter) Match(result *RunResult) bool {
+	return (f.Team == "" || result.Team == f.Team) && (f.Target == "" || result.Target == f.Target)
+}
+
+// 保存先の種類ごとの生成関数
+// ビルドタグで有効になる保存先は init で登録する
+var resultStoreDrivers = map[string]func(location string) (ResultStore, error){
+	"file": OpenFileResultStore,
+}
+
+// --store の値から ResultStore を開く
+// driver:location の形式で、 driver を省略すると DefaultResultStoreDriver になる
+func OpenResultStore(spec string) (ResultStore, error) {
+	driver, location, ok := strings.Cut(spec, resultStoreDelim)
+	if !ok {
+		driver, location = DefaultResultStoreDriver, spec
+	}
+	if location == "" {
+		return nil, fmt.Errorf("invalid result store %q: location is empty", spec)
+	}
+
+	open, ok := resultStoreDrivers[driver]
+	if !ok {
+		drivers := make([]string, 0, len(resultStoreDrivers))
+		for name := range resultStoreDrivers {
+			drivers = append(drivers, name)
+		}
+		sort.Strings(drivers)
+		return nil, fmt.Errorf("unknown result store %q: available stores are %s", driver, strings.Join(drivers, ", "))
+	}
+
+	return open(location)
+}
+
+// 結果の ID を採番する
+// 開始時刻の順に並ぶよう、開始時刻から作る
+func newResultID(result *RunResult) string {
+	return result.StartedAt.UTC().Format("20060102T150405.000000")
+}
+
+// 新しい順に並べて件数を制限する
+func sortResults(results []*RunResult, limit int) []*RunResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].StartedAt.After(results[j].StartedAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// 1回の結果を1つの JSON ファイルとしてディレクトリに保存する ResultStore
+type FileResultStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// ディレクトリを保存先にする。なければ作る
+func OpenFileResultStore(dir string) (ResultStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileResultStore{dir: dir}, nil
+}
+
+// ID の結果のファイルのパス
+func (s *FileResultStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// ResultStore.Save の実装
+// 同じ ID のファイルがあれば上書きせずにエラーにする
+func (s *FileResultStore) Save(result *RunResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.ID == "" {
+		result.ID = newResultID(result)
+	}
+	if strings.ContainsAny(result.ID, `/\`) {
+		return fmt.Errorf("invalid result id %q", result.ID)
+	}
+
+	file, err := os.OpenFile(s.path(result.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return encodeRunResult(file, result)
+}
+
+// ResultStore.Get の実装
+func (s *FileResultStore) Get(id string) (*RunResult, error) {
+	if strings.ContainsAny(id, `/\`) {
+		return nil, ErrResultNotFound
+	}
+
+	result, err := LoadRunResult(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrResultNotFound
+	}
+	return result, err
+}
+
+// ResultStore.List の実装
+func (s *FileResultStore) List(filter ResultFilter) ([]*RunResult, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*RunResult{}
+	for _, path := range paths {
+		result, err := LoadRunResult(path)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Match(result) {
+			results = append(results, result)
+		}
+	}
+
+	return sortResults(results, filter.Limit), nil
+}
+
+// ResultStore.Close の実装
+func (s *FileResultStore) Close() error {
+	return nil
+}
+
+// JSON ファイルから結果をロード
+func LoadRunResult(path string) (*RunResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := &RunResult{}
+	if err := json.NewDecoder(file).Decode(result); err != nil {
+		return nil, fmt.Errorf("invalid result %s: %v", path, err)
+	}
+
+	return result, nil
+}
+
+// 結果を読みやすいよう字下げした JSON で書き出す
+func encodeRunResult(w io.Writer, result *RunResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// 結果を保存先に保存して ID を大会運営向けロガーに出力する
+// 保存に失敗しても負荷走行の結果は変わらないので、ログに残すだけにする
+func saveRunResult(store ResultStore, result *RunResult) {
+	if store == nil {
+		return
+	}
+
+	if err := store.Save(result); err != nil {
+		AdminLogger.Printf("failed to save result: %v", err)
+		return
+	}
+	AdminLogger.Info(fmt.Sprintf("result saved: %s", result.ID), "id", result.ID)
+}
+
+// --result-file に結果を JSON で書き出す。指定がなければ何もしない
+// 保存先と同じく、書き出しに失敗してもログに残すだけにする
+func writeRunResultFile(path string, result *RunResult) {
+	if path == "" {
+		return
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		AdminLogger.Printf("failed to write result: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if err := encodeRunResult(file, result); err != nil {
+		AdminLogger.Printf("failed to write result: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// cgo が必要なので -tags sqlite でビルドした場合だけ有効にする
+func init() {
+	resultStoreDrivers["sqlite"] = OpenSQLiteResultStore
+}
+
+// 結果を SQLite のデータベースに保存する ResultStore
+// 絞り込みに使う項目は列に、結果全体は JSON で持つ
+type SQLiteResultStore struct {
+	db *sql.DB
+}
+
+// SQLite のデータベースファイルを保存先にする。なければ作る
+func OpenSQLiteResultStore(path string) (ResultStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS results (
+			id TEXT PRIMARY KEY,
+			team TEXT NOT NULL,
+			target TEXT NOT NULL,
+			started_at INTEGER NOT NULL,
+			score INTEGER NOT NULL,
+			data TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS results_team_target ON results (team, target, started_at);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteResultStore{db: db}, nil
+}
+
+// ResultStore.Save の実装
+func (s *SQLiteResultStore) Save(result *RunResult) error {
+	if result.ID == "" {
+		result.ID = newResultID(result)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO results (id, team, target, started_at, score, data) VALUES (?, ?, ?, ?, ?, ?)",
+		result.ID, result.Team, result.Target, result.StartedAt.UnixNano(), result.Score.Total, string(data),
+	)
+	return err
+}
+
+// ResultStore.Get の実装
+func (s *SQLiteResultStore) Get(id string) (*RunResult, error) {
+	data := ""
+	err := s.db.QueryRow("SELECT data FROM results WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrResultNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RunResult{}
+	if err := json.Unmarshal([]byte(data), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ResultStore.List の実装
+func (s *SQLiteResultStore) List(filter ResultFilter) ([]*RunResult, error) {
+	query := "SELECT data FROM results WHERE (? = '' OR team = ?) AND (? = '' OR target = ?) ORDER BY started_at DESC"
+	args := []interface{}{filter.Team, filter.Team, filter.Target, filter.Target}
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*RunResult{}
+	for rows.Next() {
+		data := ""
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		result := &RunResult{}
+		if err := json.Unmarshal([]byte(data), result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// ResultStore.Close の実装
+func (s *SQLiteResultStore) Close() error {
+	return s.db.Close()
+}
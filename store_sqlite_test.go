@@ -0,0 +1,18 @@
+//go:build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteResultStore(t *testing.T) {
+	store, err := OpenResultStore("sqlite:" + filepath.Join(t.TempDir(), "results.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	testResultStore(t, store)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRunResult(team, target string, startedAt time.Time, total int64) *RunResult {
+	latency := &LatencyRecorder{}
+	latency.Record("login", startedAt, startedAt, startedAt.Add(time.Duration(total)*time.Millisecond))
+
+	return &RunResult{
+		Team:       team,
+		Target:     target,
+		StartedAt:  startedAt,
+		FinishedAt: startedAt.Add(time.Minute),
+		Score:      ScoreSummary{Total: total},
+		Errors:     &ErrorSummary{Total: int(total % 3)},
+		Latency:    latency,
+	}
+}
+
+// ResultStore の実装に共通する振る舞いを確かめる
+func testResultStore(t *testing.T, store ResultStore) {
+	base := time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	first := newTestRunResult("team1", "app1:8080", base, 100)
+	require.NoError(t, store.Save(first))
+	assert.Equal(t, "20220401T100000.000000", first.ID)
+	require.Error(t, store.Save(first))
+
+	require.NoError(t, store.Save(newTestRunResult("team1", "app1:8080", base.Add(time.Hour), 200)))
+	require.NoError(t, store.Save(newTestRunResult("team2", "app2:8080", base.Add(2*time.Hour), 300)))
+
+	got, err := store.Get(first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "team1", got.Team)
+	assert.Equal(t, int64(100), got.Score.Total)
+	assert.Equal(t, first.Latency.Latency("login").Count(), got.Latency.Latency("login").Count())
+
+	_, err = store.Get("missing")
+	assert.ErrorIs(t, err, ErrResultNotFound)
+
+	results, err := store.List(ResultFilter{})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, int64(300), results[0].Score.Total)
+	assert.Equal(t, int64(100), results[2].Score.Total)
+
+	results, err = store.List(ResultFilter{Team: "team1"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	results, err = store.List(ResultFilter{Target: "app2:8080"})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "team2", results[0].Team)
+
+	results, err = store.List(ResultFilter{Team: "team1", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, int64(200), results[0].Score.Total)
+}
+
+func TestFileResultStore(t *testing.T) {
+	store, err := OpenResultStore(filepath.Join(t.TempDir(), "results"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	testResultStore(t, store)
+}
+
+func TestOpenResultStore(t *testing.T) {
+	store, err := OpenResultStore("file:" + t.TempDir())
+	require.NoError(t, err)
+	assert.IsType(t, &FileResultStore{}, store)
+
+	_, err = OpenResultStore("file:")
+	assert.Error(t, err)
+	_, err = OpenResultStore("unknown:results")
+	assert.Error(t, err)
+}
+
+func TestNewHistory(t *testing.T) {
+	base := time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)
+	results := []*RunResult{
+		newTestRunResult("team1", "app1:8080", base.Add(2*time.Hour), 150),
+		newTestRunResult("team2", "app1:8080", base, 500),
+		newTestRunResult("team1", "app1:8080", base, 100),
+		newTestRunResult("team1", "app1:8080", base.Add(time.Hour), 200),
+	}
+
+	entries := NewHistory(results)
+	require.Len(t, entries, 4)
+
+	assert.Equal(t, int64(100), entries[0].Score)
+	assert.Nil(t, entries[0].Delta)
+	assert.False(t, entries[0].Best)
+
+	assert.Equal(t, int64(200), entries[1].Score)
+	require.NotNil(t, entries[1].Delta)
+	assert.Equal(t, int64(100), *entries[1].Delta)
+	assert.True(t, entries[1].Best)
+	assert.Equal(t, 200*time.Millisecond, entries[1].WorstP99.Round(10*time.Millisecond))
+
+	require.NotNil(t, entries[2].Delta)
+	assert.Equal(t, int64(-50), *entries[2].Delta)
+	assert.False(t, entries[2].Best)
+
+	assert.Equal(t, "team2", entries[3].Team)
+	assert.Nil(t, entries[3].Delta)
+	assert.True(t, entries[3].Best)
+
+	buf := &bytes.Buffer{}
+	printHistory(buf, entries)
+	assert.Contains(t, buf.String(), "-50")
+	assert.Contains(t, buf.String(), "+100")
+}
+
+func TestRunResultTarget(t *testing.T) {
+	// 指定した順や重みによらず、同じ対象の組み合わせは同じ系列になる
+	option := Option{TargetHost: "app2:8080=2,app1:8080", TargetDistribution: TargetDistributionWeighted}
+	require.NoError(t, prepareTargetOption(&option))
+	result := NewRunResult(option, DefaultScoringProfile(), newTestBenchmarkResult(t, nil, nil), &LatencyRecorder{}, time.Now())
+	assert.Equal(t, "app1:8080,app2:8080", result.Target)
+
+	target, err := NormalizeTargetHost("app2:8080, app1:8080")
+	require.NoError(t, err)
+	assert.Equal(t, result.Target, target)
+	_, err = NormalizeTargetHost("")
+	assert.Error(t, err)
+}
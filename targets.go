@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 複数の対象へのリクエストの振り分け方
+const (
+	// 新しいユーザーエージェントを作るたびに順番に振り分ける
+	TargetDistributionRoundRobin = "round-robin"
+	// ユーザーごとに常に同じ対象に振り分ける
+	TargetDistributionSticky = "sticky"
+	// 重みの比率で順番に振り分ける
+	TargetDistributionWeighted = "weighted"
+)
+
+// --target-host の対象の区切り文字と重みの区切り文字
+const (
+	targetDelim       = ","
+	targetWeightDelim = "="
+)
+
+// ベンチマーク対象の1台
+type Target struct {
+	Host    string
+	Weight  int
+	Metrics *TargetMetrics
+
+	// 重み付きラウンドロビンの現在値
+	current int
+}
+
+// ベンチマーク対象の一覧と振り分け方
+// 振り分けはユーザーエージェントを作るときに行うので、1回のシナリオのリクエストは同じ対象に送られる
+type TargetSet struct {
+	mu           sync.Mutex
+	targets      []*Target
+	distribution string
+	next         int
+}
+
+// --target-host と --target-distribution の値から TargetSet を生成
+// host:port をカンマで区切って並べる。weighted では host:port=weight で重みを指定でき、省略すると 1 になる
+func ParseTargets(spec string, distribution string) (*TargetSet, error) {
+	switch distribution {
+	case "":
+		distribution = TargetDistributionRoundRobin
+	case TargetDistributionRoundRobin, TargetDistributionSticky, TargetDistributionWeighted:
+	default:
+		return nil, fmt.Errorf("unknown target distribution %q: available distributions are %s, %s, %s", distribution, TargetDistributionRoundRobin, TargetDistributionSticky, TargetDistributionWeighted)
+	}
+
+	set := &TargetSet{distribution: distribution}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, targetDelim) {
+		host, weightParam, hasWeight := strings.Cut(strings.TrimSpace(entry), targetWeightDelim)
+		if host == "" {
+			return nil, fmt.Errorf("invalid target host %q", spec)
+		}
+		if seen[host] {
+			return nil, fmt.Errorf("target %q is specified more than once", host)
+		}
+		seen[host] = true
+
+		weight := 1
+		if hasWeight {
+			if distribution != TargetDistributionWeighted {
+				return nil, fmt.Errorf("target weight of %q requires --target-distribution=%s", host, TargetDistributionWeighted)
+			}
+			w, err := strconv.Atoi(weightParam)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight of target %q: %s", host, weightParam)
+			}
+			weight = w
+		}
+
+		set.targets = append(set.targets, &Target{Host: host, Weight: weight, Metrics: NewTargetMetrics()})
+	}
+
+	return set, nil
+}
+
+// 対象の一覧
+func (s *TargetSet) Targets() []*Target {
+	return s.targets
+}
+
+// 対象の host:port を並べ替えてカンマで繋いだもの
+// 指定した順や重みによらず、同じ対象の組み合わせなら同じ値になる
+func (s *TargetSet) Key() string {
+	hosts := make([]string, 0, len(s.targets))
+	for _, t := range s.targets {
+		hosts = append(hosts, t.Host)
+	}
+	sort.Strings(hosts)
+
+	return strings.Join(hosts, targetDelim)
+}
+
+// --target-host の値を TargetSet.Key と同じ形にそろえる
+// 重みは並べ替えに関係しないので、振り分け方によらず指定できるものとして扱う
+func NormalizeTargetHost(spec string) (string, error) {
+	set, err := ParseTargets(spec, TargetDistributionWeighted)
+	if err != nil {
+		return "", err
+	}
+
+	return set.Key(), nil
+}
+
+// 最初に指定した対象
+// 初期化はデータベースを共有している前提で、この対象にだけリクエストする
+func (s *TargetSet) First() *Target {
+	return s.targets[0]
+}
+
+// 次のユーザーエージェントの対象を選ぶ
+// sticky では key(アカウント名)から決まる対象を返し、key が空ならラウンドロビンで選ぶ
+func (s *TargetSet) Pick(key string) *Target {
+	if len(s.targets) == 1 {
+		return s.targets[0]
+	}
+
+	if s.distribution == TargetDistributionSticky && key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return s.targets[h.Sum32()%uint32(len(s.targets))]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.distribution == TargetDistributionWeighted {
+		// 重みの比率を保ちつつ、同じ対象が連続しにくい滑らかな重み付きラウンドロビン
+		total := 0
+		var best *Target
+		for _, t := range s.targets {
+			t.current += t.Weight
+			total += t.Weight
+			if best == nil || t.current > best.current {
+				best = t
+			}
+		}
+		best.current -= total
+		return best
+	}
+
+	t := s.targets[s.next]
+	s.next = (s.next + 1) % len(s.targets)
+	return t
+}
+
+// 対象ごとのリクエストの記録
+// 所要時間はリクエストを送ってからレスポンスヘッダーを受け取るまで
+type TargetMetrics struct {
+	mu       sync.Mutex
+	requests int64
+	errors   int64
+	// ステータスコードの百の位ごとの件数
+	statuses map[int]int64
+	latency  *LatencyHistogram
+}
+
+// 空の記録を生成
+func NewTargetMetrics() *TargetMetrics {
+	return &TargetMetrics{
+		statuses: map[int]int64{},
+		latency:  NewLatencyHistogram(),
+	}
+}
+
+// リクエストを1件記録
+// 負荷走行の終了で中断したリクエストは数えない
+func (m *TargetMetrics) Record(res *http.Response, err error, d time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	m.mu.Lock()
+	m.requests++
+	if err != nil {
+		m.errors++
+	} else {
+		m.statuses[res.StatusCode/100]++
+	}
+	m.mu.Unlock()
+
+	if err == nil {
+		m.latency.Record(d)
+	}
+}
+
+// リクエスト数
+func (m *TargetMetrics) Requests() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+// レスポンスを受け取れなかったリクエスト数
+func (m *TargetMetrics) Errors() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.errors
+}
+
+// ステータスコードが class xx のレスポンス数
+func (m *TargetMetrics) Status(class int) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statuses[class]
+}
+
+// レスポンスまでの所要時間
+func (m *TargetMetrics) Latency() *LatencyHistogram {
+	return m.latency
+}
+
+// 別の記録の内容を足し合わせる
+func (m *TargetMetrics) Merge(other *TargetMetrics) {
+	other.mu.Lock()
+	requests, errs := other.requests, other.errors
+	statuses := make(map[int]int64, len(other.statuses))
+	for class, count := range other.statuses {
+		statuses[class] = count
+	}
+	other.mu.Unlock()
+
+	m.mu.Lock()
+	m.requests += requests
+	m.errors += errs
+	for class, count := range statuses {
+		m.statuses[class] += count
+	}
+	m.mu.Unlock()
+
+	m.latency.Merge(other.latency)
+}
+
+// JSON で受け渡す記録の内容
+type targetMetricsJSON struct {
+	Requests int64             `json:"requests"`
+	Errors   int64             `json:"errors"`
+	Statuses map[int]int64     `json:"statuses"`
+	Latency  *LatencyHistogram `json:"latency"`
+}
+
+// json.Marshaler インターフェースを実装
+func (m *TargetMetrics) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	v := targetMetricsJSON{
+		Requests: m.requests,
+		Errors:   m.errors,
+		Statuses: make(map[int]int64, len(m.statuses)),
+		Latency:  m.latency,
+	}
+	for class, count := range m.statuses {
+		v.Statuses[class] = count
+	}
+	m.mu.Unlock()
+
+	return json.Marshal(v)
+}
+
+// json.Unmarshaler インターフェースを実装
+func (m *TargetMetrics) UnmarshalJSON(data []byte) error {
+	v := targetMetricsJSON{Latency: NewLatencyHistogram()}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Statuses == nil {
+		v.Statuses = map[int]int64{}
+	}
+	if v.Latency == nil {
+		v.Latency = NewLatencyHistogram()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests, m.errors, m.statuses, m.latency = v.Requests, v.Errors, v.Statuses, v.Latency
+
+	return nil
+}
+
+// リクエストごとに TargetMetrics へ記録する http.RoundTripper
+type targetTransport struct {
+	base    http.RoundTripper
+	metrics *TargetMetrics
+}
+
+// http.RoundTripper インターフェースを実装
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	res, err := t.base.RoundTrip(req)
+	t.metrics.Record(res, err, time.Since(startedAt))
+
+	return res, err
+}
+
+// 対象ごとのリクエスト数と所要時間を出力
+// 対象が1つなら出力しない。p99 が最も遅い対象をボトルネックの候補として示す
+func (s *TargetSet) Print(logger *Logger) {
+	if len(s.targets) < 2 {
+		return
+	}
+
+	var total int64
+	for _, t := range s.targets {
+		total += t.Metrics.Requests()
+	}
+
+	for _, t := range s.targets {
+		m := t.Metrics
+		share := 0.0
+		if total > 0 {
+			share = float64(m.Requests()) / float64(total) * 100
+		}
+		logger.Info(
+			fmt.Sprintf(
+				"target %s: requests=%d (%.1f%%) 2xx=%d 3xx=%d 4xx=%d 5xx=%d errors=%d %s",
+				t.Host, m.Requests(), share, m.Status(2), m.Status(3), m.Status(4), m.Status(5), m.Errors(), m.Latency(),
+			),
+			"target", t.Host,
+			"requests", m.Requests(),
+			"5xx", m.Status(5),
+			"errors", m.Errors(),
+			"p50", m.Latency().Quantile(0.5),
+			"p99", m.Latency().Quantile(0.99),
+		)
+	}
+
+	if slowest := s.slowest(); slowest != nil {
+		p99 := slowest.Metrics.Latency().Quantile(0.99)
+		logger.Info(fmt.Sprintf("slowest target: %s (p99=%s)", slowest.Host, p99.Round(time.Microsecond)), "target", slowest.Host, "p99", p99)
+	}
+}
+
+// レスポンスのあった対象のうち p99 が最も遅いもの
+func (s *TargetSet) slowest() *Target {
+	targets := make([]*Target, 0, len(s.targets))
+	for _, t := range s.targets {
+		if t.Metrics.Latency().Count() > 0 {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Metrics.Latency().Quantile(0.99) > targets[j].Metrics.Latency().Quantile(0.99)
+	})
+
+	return targets[0]
+}
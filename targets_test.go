@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTargets(t *testing.T) {
+	set, err := ParseTargets("app1:8080, app2:8080", "")
+	require.NoError(t, err)
+	require.Len(t, set.Targets(), 2)
+	assert.Equal(t, "app1:8080", set.First().Host)
+	assert.Equal(t, "app2:8080", set.Targets()[1].Host)
+
+	set, err = ParseTargets("app1:8080=3,app2:8080", TargetDistributionWeighted)
+	require.NoError(t, err)
+	assert.Equal(t, 3, set.Targets()[0].Weight)
+	assert.Equal(t, 1, set.Targets()[1].Weight)
+
+	// 順や重みによらず同じ組み合わせなら同じ値になる
+	other, err := ParseTargets("app2:8080,app1:8080", "")
+	require.NoError(t, err)
+	assert.Equal(t, "app1:8080,app2:8080", set.Key())
+	assert.Equal(t, set.Key(), other.Key())
+
+	for _, c := range []struct{ spec, distribution string }{
+		{"", ""},
+		{"app1:8080,", ""},
+		{"app1:8080,app1:8080", ""},
+		{"app1:8080=2", TargetDistributionRoundRobin},
+		{"app1:8080=0", TargetDistributionWeighted},
+		{"app1:8080=x", TargetDistributionWeighted},
+		{"app1:8080", "random"},
+	} {
+		_, err := ParseTargets(c.spec, c.distribution)
+		assert.Error(t, err, c.spec)
+	}
+}
+
+func TestTargetSetPick(t *testing.T) {
+	pick := func(set *TargetSet, key string, n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			counts[set.Pick(key).Host]++
+		}
+		return counts
+	}
+
+	set, err := ParseTargets("a,b,c", TargetDistributionRoundRobin)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, pick(set, "mary", 6))
+
+	// 同じユーザーは常に同じ対象に送る
+	set, err = ParseTargets("a,b,c", TargetDistributionSticky)
+	require.NoError(t, err)
+	assert.Len(t, pick(set, "mary", 10), 1)
+	hosts := map[string]bool{}
+	for _, name := range []string{"mary", "john", "alice", "bob", "carol", "dave", "eve", "frank"} {
+		hosts[set.Pick(name).Host] = true
+	}
+	assert.Greater(t, len(hosts), 1)
+
+	// 重みの比率で振り分け、同じ対象が重みを超えて連続しない
+	set, err = ParseTargets("a=3,b=1", TargetDistributionWeighted)
+	require.NoError(t, err)
+	order := []string{}
+	for i := 0; i < 8; i++ {
+		order = append(order, set.Pick("").Host)
+	}
+	assert.Equal(t, []string{"a", "a", "b", "a", "a", "a", "b", "a"}, order)
+}
+
+func TestTargetMetrics(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	option := Option{
+		TargetHost:     strings.TrimPrefix(ok.URL, "http://") + "," + strings.TrimPrefix(broken.URL, "http://"),
+		RequestTimeout: time.Second,
+	}
+	require.NoError(t, prepareTargetOption(&option))
+
+	for i := 0; i < 4; i++ {
+		ag, err := option.NewAgent(false)
+		require.NoError(t, err)
+		res, err := GetRootAction(context.Background(), ag)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+
+	targets := option.Targets.Targets()
+	assert.Equal(t, int64(2), targets[0].Metrics.Requests())
+	assert.Equal(t, int64(2), targets[0].Metrics.Status(2))
+	assert.Equal(t, int64(2), targets[1].Metrics.Status(5))
+	assert.Equal(t, int64(2), targets[1].Metrics.Latency().Count())
+	assert.Zero(t, targets[1].Metrics.Errors())
+
+	// initialize は最初の対象にだけ送る
+	ag, err := option.NewAgent(true)
+	require.NoError(t, err)
+	assert.Equal(t, ok.URL+"/", ag.BaseURL.String())
+
+	// JSON で受け渡した記録を足し合わせる
+	data, err := json.Marshal(targets[1].Metrics)
+	require.NoError(t, err)
+	decoded := NewTargetMetrics()
+	require.NoError(t, json.Unmarshal(data, decoded))
+	decoded.Merge(targets[1].Metrics)
+	assert.Equal(t, int64(4), decoded.Requests())
+	assert.Equal(t, int64(4), decoded.Status(5))
+	assert.Equal(t, int64(4), decoded.Latency().Count())
+}
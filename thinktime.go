@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// 思考時間の分布
+const (
+	ThinkTimeNone        = "none"
+	ThinkTimeFixed       = "fixed"
+	ThinkTimeUniform     = "uniform"
+	ThinkTimeExponential = "exponential"
+	thinkTimeParamDelim  = ":"
+)
+
+// 指数分布の上限を指定しなかった場合の平均に対する倍率
+const DefaultExponentialThinkTimeCap = 10
+
+// 利用者がページを見てから次の操作をするまでの時間
+type ThinkTime interface {
+	Duration(rnd *Random) time.Duration
+}
+
+// 常に同じ時間
+type FixedThinkTime time.Duration
+
+// ThinkTime.Duration の実装
+func (t FixedThinkTime) Duration(*Random) time.Duration {
+	return time.Duration(t)
+}
+
+// Min から Max の一様分布
+type UniformThinkTime struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// ThinkTime.Duration の実装
+func (t UniformThinkTime) Duration(rnd *Random) time.Duration {
+	return t.Min + time.Duration(rnd.Float64()*float64(t.Max-t.Min))
+}
+
+// 平均 Mean の指数分布
+// まれに極端に長くならないよう Max で打ち切る
+type ExponentialThinkTime struct {
+	Mean time.Duration
+	Max  time.Duration
+}
+
+// ThinkTime.Duration の実装
+func (t ExponentialThinkTime) Duration(rnd *Random) time.Duration {
+	d := time.Duration(-math.Log(1-rnd.Float64()) * float64(t.Mean))
+	if d > t.Max {
+		return t.Max
+	}
+	return d
+}
+
+// --think-time の値から ThinkTime を生成
+// none, fixed:duration, uniform:min:max, exponential:mean[:max] の形式を受け付ける
+// 空文字列と none は思考時間なしとして nil を返す
+func ParseThinkTime(spec string) (ThinkTime, error) {
+	if spec == "" || spec == ThinkTimeNone {
+		return nil, nil
+	}
+
+	params := strings.Split(spec, thinkTimeParamDelim)
+	name := params[0]
+	durations := make([]time.Duration, 0, len(params)-1)
+	for _, param := range params[1:] {
+		d, err := time.ParseDuration(param)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid think time parameter %q", spec)
+		}
+		durations = append(durations, d)
+	}
+
+	switch name {
+	case ThinkTimeFixed:
+		if len(durations) != 1 {
+			return nil, fmt.Errorf("invalid think time %q: fixed takes 1 parameter", spec)
+		}
+		return FixedThinkTime(durations[0]), nil
+	case ThinkTimeUniform:
+		if len(durations) != 2 {
+			return nil, fmt.Errorf("invalid think time %q: uniform takes 2 parameters", spec)
+		}
+		if durations[0] > durations[1] {
+			return nil, fmt.Errorf("invalid think time %q: min must not be greater than max", spec)
+		}
+		return UniformThinkTime{Min: durations[0], Max: durations[1]}, nil
+	case ThinkTimeExponential:
+		switch len(durations) {
+		case 1:
+			return ExponentialThinkTime{Mean: durations[0], Max: durations[0] * DefaultExponentialThinkTimeCap}, nil
+		case 2:
+			return ExponentialThinkTime{Mean: durations[0], Max: durations[1]}, nil
+		}
+		return nil, fmt.Errorf("invalid think time %q: exponential takes 1 or 2 parameters", spec)
+	}
+
+	return nil, fmt.Errorf("unknown think time %q", spec)
+}
+
+// 思考時間だけ待つ
+// 時間は実行中のシナリオの rnd から引く。待っている間に context が終了した場合は false を返す
+func (s *Scenario) think(ctx context.Context, rnd *Random) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if s.ThinkTime == nil {
+		return true
+	}
+
+	d := s.ThinkTime.Duration(rnd)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
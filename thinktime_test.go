@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThinkTime(t *testing.T) {
+	for _, spec := range []string{"", "none"} {
+		thinkTime, err := ParseThinkTime(spec)
+		require.NoError(t, err)
+		assert.Nil(t, thinkTime)
+	}
+
+	thinkTime, err := ParseThinkTime("fixed:500ms")
+	require.NoError(t, err)
+	assert.Equal(t, FixedThinkTime(500*time.Millisecond), thinkTime)
+
+	thinkTime, err = ParseThinkTime("uniform:100ms:1s")
+	require.NoError(t, err)
+	assert.Equal(t, UniformThinkTime{Min: 100 * time.Millisecond, Max: time.Second}, thinkTime)
+
+	thinkTime, err = ParseThinkTime("exponential:1s")
+	require.NoError(t, err)
+	assert.Equal(t, ExponentialThinkTime{Mean: time.Second, Max: 10 * time.Second}, thinkTime)
+
+	for _, spec := range []string{"fixed", "fixed:1s:2s", "uniform:2s:1s", "exponential", "exponential:x", "fixed:-1s", "gaussian:1s"} {
+		_, err := ParseThinkTime(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestThinkTimeDistribution(t *testing.T) {
+	rnd := NewRandom(42)
+
+	uniform := UniformThinkTime{Min: 100 * time.Millisecond, Max: 200 * time.Millisecond}
+	exponential := ExponentialThinkTime{Mean: 100 * time.Millisecond, Max: 300 * time.Millisecond}
+	sum := time.Duration(0)
+	for i := 0; i < 10000; i++ {
+		d := uniform.Duration(rnd)
+		assert.True(t, d >= uniform.Min && d <= uniform.Max, d)
+
+		d = exponential.Duration(rnd)
+		assert.True(t, d >= 0 && d <= exponential.Max, d)
+		sum += d
+	}
+	// 打ち切りの分だけ平均より少し短くなる
+	assert.InDelta(t, float64(95*time.Millisecond), float64(sum/10000), float64(5*time.Millisecond))
+}
+
+func TestScenarioThink(t *testing.T) {
+	s := &Scenario{}
+	assert.True(t, s.think(context.Background(), NewRandom(42)))
+
+	s.ThinkTime = FixedThinkTime(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// 待っている間に context が終了したら中断
+	startedAt := time.Now()
+	assert.False(t, s.think(ctx, NewRandom(42)))
+	assert.Less(t, time.Since(startedAt), time.Second)
+}
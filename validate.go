@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/isucon/isucandar"
+	"github.com/isucon/isucandar/worker"
+)
+
+// validate のデフォルト値
+const (
+	DefaultValidatePosts      = 10
+	DefaultValidateInitialize = false
+	ValidateLoadTimeout       = 30 * time.Second
+	validateParallelism       = 4
+)
+
+// Prepare の後に整合性の検証だけを行うシナリオ
+// 書き込みは行わず、 ValidateCommand は --initialize の指定がなければ初期化もしないので、対象の状態を変えずに確認できる
+type ValidateScenario struct {
+	*Scenario
+}
+
+// isucandar.LoadScenario を満たすメソッド
+// トップページの並び順と、新しい Post から Option.ValidatePosts 件の内容を検証する
+func (s *ValidateScenario) Load(ctx context.Context, step *isucandar.BenchmarkStep) error {
+	rnd := s.Random.Derive("validate")
+
+	// トップページの並び順
+	if user, ok := s.UserPicker.Pick(rnd); ok {
+		s.OrderedIndex(ctx, step, user)
+		user.ClearAgent()
+	}
+
+	// 削除されたユーザーの Post は表示されないので除く
+	posts := s.visiblePosts(s.Option.ValidatePosts).Slice()
+
+	validateCase, err := worker.NewWorker(func(ctx context.Context, i int) {
+		post := posts[i]
+		s.VerifyPersistedPost(ctx, step, post, s.Comments.ByPostID(post.ID).Slice())
+	},
+		// 検証する Post の数だけ繰り返す
+		worker.WithLoopCount(int32(len(posts))),
+		worker.WithMaxParallelism(validateParallelism),
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(posts) > 0 {
+		validateCase.Process(ctx)
+	}
+
+	return nil
+}
+
+// validate サブコマンド
+// 整合性の検証でエラーがなければ成功とする
+// 既定では GET /initialize を呼ばないので、ベンチマーカーが書き込んだデータも残したまま検証する
+func ValidateCommand(args []string) int {
+	option := Option{}
+	initialize := DefaultValidateInitialize
+
+	fs := newFlagSet("validate")
+	addTargetFlags(fs, &option)
+	fs.IntVar(&option.ValidatePosts, "validate-posts", DefaultValidatePosts, "Number of newest posts whose page is validated")
+	fs.BoolVar(&initialize, "initialize", DefaultValidateInitialize, "Call GET /initialize before validating, which removes data written by earlier runs")
+	addErrorFlags(fs, &option)
+	addLogFlags(fs, &option)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	closeLogs, err := setupLoggers(option)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	defer closeLogs()
+
+	if err := prepareTargetOption(&option); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeUsage
+	}
+	option.SkipInitialize = !initialize
+	AdminLogger.Print(option)
+
+	scenario := &ValidateScenario{
+		Scenario: &Scenario{Option: option},
+	}
+	result, err := startBenchmark(context.Background(), scenario, ValidateLoadTimeout)
+	if err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+
+	if err := reportErrors(option, result); err != nil {
+		AdminLogger.Print(err)
+		return ExitCodeError
+	}
+	ContestantLogger.Printf("validated posts: %s", &scenario.Persistence)
+
+	return reportCheckResult("validate", result)
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -25,8 +26,13 @@ const (
 	ErrInvalidStatusCode failure.StringCode = "status-code"
 	ErrInvalidPath       failure.StringCode = "path"
 	ErrNotFound          failure.StringCode = "not-found"
+	ErrUnexpectedBody    failure.StringCode = "unexpected-body"
+	ErrInvalidDocument   failure.StringCode = "document"
 	ErrCSRFToken         failure.StringCode = "csrf-token"
 	ErrInvalidPostOrder  failure.StringCode = "post-order"
+	ErrStaleTimeline     failure.StringCode = "stale-timeline"
+	ErrLostPost          failure.StringCode = "lost-post"
+	ErrLostComment       failure.StringCode = "lost-comment"
 	ErrInvalidAsset      failure.StringCode = "asset"
 )
 
@@ -65,6 +71,23 @@ func (v ValidationError) IsEmpty() bool {
 	return true
 }
 
+// 指定したエラーコードを持つエラーの数を返す
+// 中身が ValidationError なら展開して数える
+func (v ValidationError) Count(code failure.Code) int {
+	count := 0
+	for _, err := range v.Errors {
+		if err == nil {
+			continue
+		}
+		if ve, ok := err.(ValidationError); ok {
+			count += ve.Count(code)
+		} else if failure.IsCode(err, code) {
+			count++
+		}
+	}
+	return count
+}
+
 // isucandar.BenchmarkStep に自身の持つエラーをすべて追加
 func (v ValidationError) Add(step *isucandar.BenchmarkStep) {
 	for _, err := range v.Errors {
@@ -79,18 +102,73 @@ func (v ValidationError) Add(step *isucandar.BenchmarkStep) {
 	}
 }
 
+// バリデータ関数に渡すレスポンス
+// http.Response.Body は1度しか読めないため、読み込んだボディとパース済みの HTML を共有する
+type Response struct {
+	*http.Response
+
+	body    []byte
+	bodyErr error
+	doc     *goquery.Document
+	docErr  error
+}
+
+// http.Response のボディを読み込んで Response を生成
+// 元の Body は閉じられ、以降は読み込んだ内容を何度でも読める Body に差し替えられる
+func NewResponse(res *http.Response) *Response {
+	r := &Response{
+		Response: res,
+	}
+
+	if res.Body != nil {
+		r.body, r.bodyErr = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	r.resetBody()
+
+	return r
+}
+
+// 読み込み済みのボディを先頭から読めるよう http.Response.Body を差し替える
+func (r *Response) resetBody() {
+	r.Response.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+}
+
+// 読み込み済みのレスポンスボディを返す
+func (r *Response) Bytes() ([]byte, error) {
+	return r.body, r.bodyErr
+}
+
+// レスポンスボディを HTML としてパースした goquery.Document を返す
+// パースは初回の呼び出し時に1度だけ行われる
+func (r *Response) Document() (*goquery.Document, error) {
+	if r.doc == nil && r.docErr == nil {
+		if r.bodyErr != nil {
+			r.docErr = r.bodyErr
+		} else {
+			r.doc, r.docErr = goquery.NewDocumentFromReader(bytes.NewReader(r.body))
+		}
+	}
+
+	return r.doc, r.docErr
+}
+
 // レスポンスを検証するバリデータ関数の型
-type ResponseValidator func(*http.Response) error
+type ResponseValidator func(*Response) error
 
 // レスポンスを検証する関数
 // 複数のバリデータ関数を受け取ってすべてでレスポンスを検証し、 ValidationError を返す
+// ボディは最初に1度だけ読み込まれ、すべてのバリデータで共有される
 func ValidateResponse(res *http.Response, validators ...ResponseValidator) ValidationError {
 	errs := []error{}
 
+	r := NewResponse(res)
 	for _, validator := range validators {
-		if err := validator(res); err != nil {
+		if err := validator(r); err != nil {
 			errs = append(errs, err)
 		}
+		// Body を直接読むバリデータがいても次のバリデータが先頭から読めるようにする
+		r.resetBody()
 	}
 
 	return ValidationError{
@@ -101,7 +179,7 @@ func ValidateResponse(res *http.Response, validators ...ResponseValidator) Valid
 // ステータスコードコードを検証するバリデータ関数を返す高階関数
 // 例: ValidateResponse(res, WithStatusCode(200))
 func WithStatusCode(statusCode int) ResponseValidator {
-	return func(r *http.Response) error {
+	return func(r *Response) error {
 		if r.StatusCode != statusCode {
 			// ステータスコードが一致しなければ HTTP メソッド、URL パス、期待したステータスコード、実際のステータスコードを持つ
 			// エラーを返す
@@ -122,7 +200,7 @@ func WithStatusCode(statusCode int) ResponseValidator {
 
 // レスポンスヘッダを検証するバリデータ関数を返す高階関数
 func WithLocation(val string) ResponseValidator {
-	return func(r *http.Response) error {
+	return func(r *Response) error {
 		target := r.Request.URL.ResolveReference(&url.URL{Path: val})
 		if r.Header.Get("Location") != target.String() {
 			// ヘッダーが一致しなければ HTTP メソッド、URL パス、期待したパス、実際の Location ヘッダを持つ
@@ -145,10 +223,8 @@ func WithLocation(val string) ResponseValidator {
 
 // レスポンスボディに特定の文字列が含まれていることを検証するバリデータ関数を返す高階関数
 func WithIncludeBody(val string) ResponseValidator {
-	return func(r *http.Response) error {
-		defer r.Body.Close()
-
-		body, err := ioutil.ReadAll(r.Body)
+	return func(r *Response) error {
+		body, err := r.Bytes()
 		if err != nil {
 			return failure.NewError(
 				ErrInvalidResponse,
@@ -161,7 +237,7 @@ func WithIncludeBody(val string) ResponseValidator {
 			)
 		}
 
-		if bytes.IndexAny(body, val) == -1 {
+		if !bytes.Contains(body, []byte(val)) {
 			return failure.NewError(
 				ErrNotFound,
 				fmt.Errorf(
@@ -177,13 +253,189 @@ func WithIncludeBody(val string) ResponseValidator {
 	}
 }
 
-func WithCSRFToken(user *User) ResponseValidator {
-	return func(r *http.Response) error {
-		defer r.Body.Close()
+// レスポンスボディに特定の文字列が含まれていないことを検証するバリデータ関数を返す高階関数
+func WithExcludeBody(val string) ResponseValidator {
+	return func(r *Response) error {
+		body, err := r.Bytes()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		if bytes.Contains(body, []byte(val)) {
+			return failure.NewError(
+				ErrUnexpectedBody,
+				fmt.Errorf(
+					"%s %s : %s is found in body",
+					r.Request.Method,
+					r.Request.URL.Path,
+					val,
+				),
+			)
+		}
+
+		return nil
+	}
+}
+
+// レスポンスボディが正規表現にマッチすることを検証するバリデータ関数を返す高階関数
+func WithMatchBody(pattern *regexp.Regexp) ResponseValidator {
+	return func(r *Response) error {
+		body, err := r.Bytes()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		if !pattern.Match(body) {
+			return failure.NewError(
+				ErrNotFound,
+				fmt.Errorf(
+					"%s %s : /%s/ does not match body",
+					r.Request.Method,
+					r.Request.URL.Path,
+					pattern.String(),
+				),
+			)
+		}
 
+		return nil
+	}
+}
+
+// CSS セレクタに一致する要素が存在することを検証するバリデータ関数を返す高階関数
+func WithSelector(selector string) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		if doc.Find(selector).Length() == 0 {
+			return failure.NewError(
+				ErrNotFound,
+				fmt.Errorf(
+					"%s %s : %s is not found in document",
+					r.Request.Method,
+					r.Request.URL.Path,
+					selector,
+				),
+			)
+		}
+
+		return nil
+	}
+}
+
+// CSS セレクタに一致する要素の個数を検証するバリデータ関数を返す高階関数
+func WithSelectorCount(selector string, count int) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		if actual := doc.Find(selector).Length(); actual != count {
+			return failure.NewError(
+				ErrInvalidDocument,
+				fmt.Errorf(
+					"%s %s : count of %s, expected(%d) != actual(%d)",
+					r.Request.Method,
+					r.Request.URL.Path,
+					selector,
+					count,
+					actual,
+				),
+			)
+		}
+
+		return nil
+	}
+}
+
+// CSS セレクタに一致する最初の要素のテキストを検証するバリデータ関数を返す高階関数
+// テキストの前後の空白は無視する
+func WithSelectorText(selector string, text string) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		selection := doc.Find(selector).First()
+		if selection.Length() == 0 {
+			return failure.NewError(
+				ErrNotFound,
+				fmt.Errorf(
+					"%s %s : %s is not found in document",
+					r.Request.Method,
+					r.Request.URL.Path,
+					selector,
+				),
+			)
+		}
+
+		if actual := strings.TrimSpace(selection.Text()); actual != text {
+			return failure.NewError(
+				ErrInvalidDocument,
+				fmt.Errorf(
+					"%s %s : text of %s, expected(%s) != actual(%s)",
+					r.Request.Method,
+					r.Request.URL.Path,
+					selector,
+					text,
+					actual,
+				),
+			)
+		}
+
+		return nil
+	}
+}
+
+func WithCSRFToken(user *User) ResponseValidator {
+	return func(r *Response) error {
 		user.SetCSRFToken("")
 
-		doc, err := goquery.NewDocumentFromReader(r.Body)
+		doc, err := r.Document()
 		if err != nil {
 			return failure.NewError(
 				ErrInvalidResponse,
@@ -230,9 +482,8 @@ func WithCSRFToken(user *User) ResponseValidator {
 }
 
 func WithOrderedPosts() ResponseValidator {
-	return func(r *http.Response) error {
-		defer r.Body.Close()
-		doc, err := goquery.NewDocumentFromReader(r.Body)
+	return func(r *Response) error {
+		doc, err := r.Document()
 		if err != nil {
 			return failure.NewError(
 				ErrInvalidResponse,
@@ -282,6 +533,153 @@ func WithOrderedPosts() ResponseValidator {
 	}
 }
 
+// タイムラインの鮮度を検証するバリデータ関数を返す高階関数
+// requestedAt より grace 以上前に書き込みが完了した Post は、タイムラインに表示されている
+// 最も古い Post より新しければ表示されていなければならない
+// それより前の期間の Post はそれまでのリクエストで検証済みなので、直近の grace の期間だけを調べる
+func WithFreshTimeline(writes *WriteLog[*Post], grace time.Duration, requestedAt time.Time) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		// タイムラインに表示されている Post の ID を収集
+		displayed := map[int]struct{}{}
+		oldestID := 0
+		doc.Find(".isu-posts .isu-post").Each(func(_ int, s *goquery.Selection) {
+			idAttr, exists := s.Attr("id")
+			if !exists {
+				return
+			}
+			id, err := strconv.Atoi(strings.TrimPrefix(idAttr, "pid_"))
+			if err != nil {
+				return
+			}
+
+			displayed[id] = struct{}{}
+			if oldestID == 0 || id < oldestID {
+				oldestID = id
+			}
+		})
+
+		errs := []error{}
+		// 前のリクエストで検証済みとはみなさず、猶予時間を過ぎたすべての書き込みを検証する
+		// 前回の実行から再開した場合の書き込みも含まれる
+		cutoff := requestedAt.Add(-grace)
+		for _, record := range writes.WrittenBetween(time.Time{}, cutoff) {
+			post := record.Model
+			// タイムラインの範囲より古い Post は押し出されているので対象外
+			if post.ID < oldestID {
+				continue
+			}
+			if _, ok := displayed[post.ID]; ok {
+				continue
+			}
+
+			errs = append(errs,
+				failure.NewError(
+					ErrStaleTimeline,
+					fmt.Errorf(
+						"%s %s : post %d is not found in timeline %s after it was created",
+						r.Request.Method,
+						r.Request.URL.Path,
+						post.ID,
+						requestedAt.Sub(record.WrittenAt).Round(time.Millisecond),
+					),
+				),
+			)
+		}
+
+		return ValidationError{errs}
+	}
+}
+
+// 書き込んだ Post がページに表示されていることを検証するバリデータ関数を返す高階関数
+func WithPersistedPost(post *Post) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		if doc.Find(fmt.Sprintf("#pid_%d", post.ID)).Length() == 0 {
+			return failure.NewError(
+				ErrLostPost,
+				fmt.Errorf(
+					"%s %s : post %d is lost",
+					r.Request.Method,
+					r.Request.URL.Path,
+					post.ID,
+				),
+			)
+		}
+
+		return nil
+	}
+}
+
+// 書き込んだ Comment がすべてページに表示されていることを検証するバリデータ関数を返す高階関数
+// 見つからない Comment ごとにエラーを返す
+func WithPersistedComments(comments []*Comment) ResponseValidator {
+	return func(r *Response) error {
+		doc, err := r.Document()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		texts := map[string]struct{}{}
+		doc.Find(".isu-comment .isu-comment-text").Each(func(_ int, s *goquery.Selection) {
+			texts[strings.TrimSpace(s.Text())] = struct{}{}
+		})
+
+		errs := []error{}
+		for _, comment := range comments {
+			if _, ok := texts[comment.Comment]; ok {
+				continue
+			}
+
+			errs = append(errs,
+				failure.NewError(
+					ErrLostComment,
+					fmt.Errorf(
+						"%s %s : comment %q is lost",
+						r.Request.Method,
+						r.Request.URL.Path,
+						comment.Comment,
+					),
+				),
+			)
+		}
+
+		return ValidationError{errs}
+	}
+}
+
 // アセットの MD5 ハッシュ
 var (
 	assetsMD5 = map[string]string{
@@ -294,8 +692,21 @@ var (
 
 // 静的ファイルを検証するバリデータ関数を返す高階関数
 func WithAssets(ctx context.Context, ag *agent.Agent) ResponseValidator {
-	return func(r *http.Response) error {
-		resources, err := ag.ProcessHTML(ctx, r, r.Body)
+	return func(r *Response) error {
+		body, err := r.Bytes()
+		if err != nil {
+			return failure.NewError(
+				ErrInvalidResponse,
+				fmt.Errorf(
+					"%s %s : %s",
+					r.Request.Method,
+					r.Request.URL.Path,
+					err.Error(),
+				),
+			)
+		}
+
+		resources, err := ag.ProcessHTML(ctx, r.Response, ioutil.NopCloser(bytes.NewReader(body)))
 		if err != nil {
 			return failure.NewError(
 				ErrInvalidAsset,
@@ -314,14 +725,18 @@ func WithAssets(ctx context.Context, ag *agent.Agent) ResponseValidator {
 			path := strings.TrimPrefix(uri, ag.BaseURL.String())
 			// リソースの取得時にエラー
 			if res.Error != nil {
+				// 負荷試験の終了で中断されたものは無視
+				if ctx.Err() != nil {
+					continue
+				}
 				errs = append(errs,
 					failure.NewError(
 						ErrInvalidAsset,
 						fmt.Errorf(
-							"%s /%s : %v",
+							"%s /%s : %w",
 							"GET",
 							path,
-							res.Error,
+							ClassifyRequestError(res.Error),
 						),
 					),
 				)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucandar/failure"
+	"github.com/stretchr/testify/assert"
+)
+
+const testValidationBody = `<html><body>
+<div id="notice-message" class="alert alert-danger"> アカウント名かパスワードが間違っています </div>
+<div class="isu-posts"><div class="isu-post"></div><div class="isu-post"></div></div>
+</body></html>`
+
+func newTestResponse(body string) *Response {
+	return NewResponse(&http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request: &http.Request{
+			Method: http.MethodGet,
+			URL:    &url.URL{Path: "/login"},
+		},
+	})
+}
+
+func TestWithIncludeBody(t *testing.T) {
+	err := WithIncludeBody("アカウント名かパスワードが間違っています")(newTestResponse(testValidationBody))
+	assert.NoError(t, err)
+
+	// 1文字でも一致すれば通っていた bytes.IndexAny の誤りを検出
+	err = WithIncludeBody("isu-comment")(newTestResponse(testValidationBody))
+	assert.Error(t, err)
+	assert.True(t, failure.IsCode(err, ErrNotFound))
+}
+
+func TestWithExcludeBody(t *testing.T) {
+	err := WithExcludeBody("isu-comment")(newTestResponse(testValidationBody))
+	assert.NoError(t, err)
+
+	err = WithExcludeBody("isu-post")(newTestResponse(testValidationBody))
+	assert.Error(t, err)
+	assert.True(t, failure.IsCode(err, ErrUnexpectedBody))
+}
+
+func TestWithMatchBody(t *testing.T) {
+	err := WithMatchBody(regexp.MustCompile(`class="isu-posts?"`))(newTestResponse(testValidationBody))
+	assert.NoError(t, err)
+
+	err = WithMatchBody(regexp.MustCompile(`id="pid_\d+"`))(newTestResponse(testValidationBody))
+	assert.Error(t, err)
+	assert.True(t, failure.IsCode(err, ErrNotFound))
+}
+
+func TestWithSelector(t *testing.T) {
+	assert.NoError(t, WithSelector(".isu-posts .isu-post")(newTestResponse(testValidationBody)))
+
+	err := WithSelector(".isu-comment")(newTestResponse(testValidationBody))
+	assert.True(t, failure.IsCode(err, ErrNotFound))
+
+	assert.NoError(t, WithSelectorCount(".isu-post", 2)(newTestResponse(testValidationBody)))
+
+	err = WithSelectorCount(".isu-post", 3)(newTestResponse(testValidationBody))
+	assert.True(t, failure.IsCode(err, ErrInvalidDocument))
+	assert.Contains(t, fmt.Sprintf("%v", err), "expected(3) != actual(2)")
+}
+
+func TestWithSelectorText(t *testing.T) {
+	err := WithSelectorText("#notice-message", "アカウント名かパスワードが間違っています")(newTestResponse(testValidationBody))
+	assert.NoError(t, err)
+
+	err = WithSelectorText("#notice-message", "ログインしました")(newTestResponse(testValidationBody))
+	assert.True(t, failure.IsCode(err, ErrInvalidDocument))
+
+	err = WithSelectorText("#missing", "")(newTestResponse(testValidationBody))
+	assert.True(t, failure.IsCode(err, ErrNotFound))
+}
+
+func TestValidateResponseSharesBody(t *testing.T) {
+	body := `<html><body>
+<form><input type="hidden" name="csrf_token" value="token-value"></form>
+<div class="isu-posts"><div class="isu-post"></div></div>
+</body></html>`
+	res := newTestResponse(body).Response
+	user := &User{}
+
+	// 複数のバリデータがボディを読んでも空にならない
+	validation := ValidateResponse(
+		res,
+		WithCSRFToken(user),
+		WithSelectorCount(".isu-post", 1),
+		WithIncludeBody("isu-posts"),
+	)
+	assert.True(t, validation.IsEmpty(), validation.Error())
+	assert.Equal(t, "token-value", user.GetCSRFToken())
+
+	// 検証後も Body は先頭から読める
+	raw, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(raw))
+}
+
+func TestWithFreshTimeline(t *testing.T) {
+	body := `<div class="isu-posts">
+<div class="isu-post" id="pid_12"></div>
+<div class="isu-post" id="pid_10"></div>
+</div>`
+	now := time.Now()
+	writes := &WriteLog[*Post]{}
+	// タイムラインの範囲より古い
+	writes.Add(&Post{ID: 9}, now.Add(-4*time.Second))
+	// 表示されている
+	writes.Add(&Post{ID: 10}, now.Add(-4*time.Second))
+	// 猶予時間を過ぎても表示されていない
+	writes.Add(&Post{ID: 11}, now.Add(-4*time.Second))
+	// 猶予時間内なので表示されていなくてもよい
+	writes.Add(&Post{ID: 13}, now.Add(-1*time.Second))
+
+	err := WithFreshTimeline(writes, 3*time.Second, now)(newTestResponse(body))
+	ve, ok := err.(ValidationError)
+	assert.True(t, ok)
+	assert.Len(t, ve.Errors, 1)
+	assert.True(t, failure.IsCode(ve.Errors[0], ErrStaleTimeline))
+	assert.Contains(t, fmt.Sprintf("%v", ve.Errors[0]), "post 11")
+}
+
+func TestWithFreshTimelineLongAfterWrite(t *testing.T) {
+	body := `<div class="isu-posts">
+<div class="isu-post" id="pid_10"></div>
+</div>`
+	now := time.Now()
+	writes := &WriteLog[*Post]{}
+	// 猶予時間の2倍より前の書き込みも、その間にタイムラインを見ていなければ検証する
+	writes.Add(&Post{ID: 11}, now.Add(-10*time.Second))
+	writes.Add(&Post{ID: 10}, now.Add(-10*time.Second))
+
+	err := WithFreshTimeline(writes, 3*time.Second, now)(newTestResponse(body))
+	ve, ok := err.(ValidationError)
+	assert.True(t, ok)
+	assert.Len(t, ve.Errors, 1)
+	assert.Contains(t, fmt.Sprintf("%v", err), "post 11")
+}
+
+func TestWriteLogWrittenBetween(t *testing.T) {
+	now := time.Now()
+	writes := &WriteLog[*Post]{}
+	// 完了時刻の前後する追記も時刻順に並ぶ
+	writes.Add(&Post{ID: 1}, now.Add(1*time.Second))
+	writes.Add(&Post{ID: 3}, now.Add(3*time.Second))
+	writes.Add(&Post{ID: 2}, now.Add(2*time.Second))
+	writes.Add(&Post{ID: 4}, now.Add(4*time.Second))
+
+	ids := func(records []WriteRecord[*Post]) []int {
+		ids := []int{}
+		for _, r := range records {
+			ids = append(ids, r.Model.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, ids(writes.Records()))
+	assert.Equal(t, []int{2, 3}, ids(writes.WrittenBetween(now.Add(2*time.Second), now.Add(4*time.Second))))
+	assert.Empty(t, writes.WrittenBetween(now.Add(5*time.Second), now.Add(6*time.Second)))
+}
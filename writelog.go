@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ベンチマーカーが書き込んだモデルと書き込み完了時刻の組
+type WriteRecord[T Model] struct {
+	Model     T         `json:"model"`
+	WrittenAt time.Time `json:"written_at"`
+}
+
+// ベンチマーカーによる書き込みを時系列で記録する構造体
+// 複数のワーカーから同時に追記される。記録は常に完了時刻の順に並べる
+type WriteLog[T Model] struct {
+	mu      sync.RWMutex
+	records []WriteRecord[T]
+}
+
+// 書き込みを記録するメソッド
+func (l *WriteLog[T]) Add(model T, writtenAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// ほぼ完了時刻の順に追記されるので、後ろから挿入位置を探す
+	i := len(l.records)
+	for i > 0 && l.records[i-1].WrittenAt.After(writtenAt) {
+		i--
+	}
+	l.records = append(l.records, WriteRecord[T]{})
+	copy(l.records[i+1:], l.records[i:])
+	l.records[i] = WriteRecord[T]{
+		Model:     model,
+		WrittenAt: writtenAt,
+	}
+}
+
+// 記録された書き込みの件数を返す
+func (l *WriteLog[T]) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.records)
+}
+
+// 記録された書き込みのうち、 from 以降 to より前に完了したものを返す
+// 記録は完了時刻の順なので範囲を二分探索で求める。返り値はコピーなので呼び出し元で自由に扱える
+func (l *WriteLog[T]) WrittenBetween(from, to time.Time) []WriteRecord[T] {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start := sort.Search(len(l.records), func(i int) bool {
+		return !l.records[i].WrittenAt.Before(from)
+	})
+	end := sort.Search(len(l.records), func(i int) bool {
+		return !l.records[i].WrittenAt.Before(to)
+	})
+	if start >= end {
+		return []WriteRecord[T]{}
+	}
+
+	records := make([]WriteRecord[T], end-start)
+	copy(records, l.records[start:end])
+
+	return records
+}
+
+// 記録されたすべての書き込みを記録順に返す
+func (l *WriteLog[T]) Records() []WriteRecord[T] {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	records := make([]WriteRecord[T], len(l.records))
+	copy(records, l.records)
+
+	return records
+}